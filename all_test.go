@@ -5,12 +5,25 @@
 package virtual
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	tim "time"
+	"unsafe"
+
+	"github.com/cznic/ir"
 )
 
 func caller(s string, va ...interface{}) {
@@ -51,6 +64,9 @@ func init() {
 
 // ============================================================================
 
+// setCode replaces the code of m.
+func (m *Machine) setCode(code []Operation) { m.img.Store(&image{code: code}) }
+
 func TestAbort(t *testing.T) {
 	m, err := newMachine(nil, 0, nil, nil, nil, "")
 	if err != nil {
@@ -68,15 +84,264 @@ func TestAbort(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	m.code = []Operation{
+	m.setCode([]Operation{
 		{abort, 0},
-	}
+	})
 	if g, _ := thread.cpu.run(0); g == 0 {
 		t.Fatal("expected non zero exit code")
 	}
 }
 
-func TestExit(t *testing.T) {
+func TestAtExit(t *testing.T) {
+	m, err := newMachine(nil, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []int32
+	nm := ir.NameID(dict.SID("record"))
+	m.host = map[ir.NameID]HostFunction{
+		nm: func(call *HostCall) error {
+			calls = append(calls, call.Int32())
+			return nil
+		},
+	}
+	m.setCode([]Operation{
+		{AddSP, -i32StackSz},
+		{Arguments, 0},
+		{FP, 14},
+		{atexit, 0},
+		{AddSP, i32StackSz},
+		{AddSP, -i32StackSz},
+		{Arguments, 0},
+		{FP, 21},
+		{atexit, 0},
+		{AddSP, i32StackSz},
+		{Push32, 42},
+		{exit, 0},
+
+		{Call, 14},
+		{FFIReturn, 0},
+		{Func, 0},
+		{Arguments, 0},
+		{Push32, 1},
+		{hostFunction, int(nm)},
+		{Return, 0},
+
+		{Call, 21},
+		{FFIReturn, 0},
+		{Func, 0},
+		{Arguments, 0},
+		{Push32, 2},
+		{hostFunction, int(nm)},
+		{Return, 0},
+	})
+	if g, err := thread.cpu.run(0); g != 42 || err != nil {
+		t.Fatal("exit code", g, err)
+	}
+
+	if g, e := fmt.Sprint(calls), "[2 1]"; g != e {
+		t.Fatalf("got %s, expected %s", g, e)
+	}
+}
+
+func TestBinary(t *testing.T) {
+	f := ir.NameID(dict.SID("f"))
+	b := &Binary{
+		BSS:            16,
+		CSRelative:     []byte{4},
+		Code:           []Operation{{Call, 2}, {FFIReturn, 0}, {Func, 0}, {Push32, -1}, {Return, 0}},
+		CodeCSRelative: []byte{8},
+		DSRelative:     []byte{1},
+		Data:           []byte{1, 2, 3},
+		Functions:      []PCInfo{{PC: 2, Line: 1, Column: 1, Name: f}},
+		GOARCH:         "arch",
+		GOOS:           "os",
+		Globals:        map[ir.NameID]Global{ir.NameID(dict.SID("g")): {Offset: 8, Size: 4, Type: ir.TypeID(dict.SID("int32"))}},
+		Lines:          []PCInfo{{PC: 2, Line: 1, Column: 1, Name: ir.NameID(dict.SID("f.c"))}},
+		Signatures:     map[ir.NameID]ir.TypeID{f: ir.TypeID(dict.SID("func()"))},
+		Sym:            map[ir.NameID]int{f: 0},
+		TSRelative:     []byte{2},
+		Text:           []byte("abc"),
+		TextCSRelative: []byte{8},
+	}
+	buf := bytes.NewBufferString("#!/usr/bin/env virtual\n")
+	if _, err := b.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var b2 Binary
+	if _, err := b2.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := fmt.Sprintf("%+v", b2), fmt.Sprintf("%+v", *b); g != e {
+		t.Fatalf("\ngot %s\nexp %s", g, e)
+	}
+
+	file, err := NewBinaryFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := fmt.Sprint(file.GOOS, file.GOARCH, file.CodeVersion), fmt.Sprint("os", "arch", binaryVersion); g != e {
+		t.Fatalf("got %s, expected %s", g, e)
+	}
+
+	b3, err := file.Binary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b3.Functions != nil {
+		t.Fatal("unexpected debug information")
+	}
+
+	if err := file.LoadDebug(b3); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := fmt.Sprint(b3.Functions), fmt.Sprint(b.Functions); g != e {
+		t.Fatalf("got %s, expected %s", g, e)
+	}
+
+	if _, err := newMachine(b3, 0, nil, nil, nil, ""); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if _, err := NewBinaryFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()-1)); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	bad := append([]byte(nil), buf.Bytes()...)
+	binary.LittleEndian.PutUint64(bad[strings.IndexByte(buf.String(), '\n')+1+len(magic)+8+16:], 1<<62)
+	if _, err := NewBinaryFile(bytes.NewReader(bad), int64(len(bad))); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	for i, v := range []*Binary{
+		{Code: b.Code, Sym: map[ir.NameID]int{f: len(b.Code)}},
+		{Data: b.Data, BSS: b.BSS, Globals: map[ir.NameID]Global{f: {Offset: 8, Size: 12}}},
+		{Data: b.Data, BSS: b.BSS, Globals: map[ir.NameID]Global{f: {Offset: 20}}},
+	} {
+		var buf bytes.Buffer
+		if _, err := v.WriteTo(&buf); err != nil {
+			t.Fatal(i, err)
+		}
+
+		var b2 Binary
+		if _, err := b2.ReadFrom(&buf); err == nil || !strings.Contains(err.Error(), "corrupted file") {
+			t.Fatal(i, err)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	f := ir.NameID(dict.SID("f"))
+	b := &Binary{
+		Code: []Operation{
+			{AddSP, -i32StackSz}, // f() result
+			{AddSP, -ptrStackSz}, // dlsym result
+			{Arguments, 0},
+			{Push64, 0}, // RTLD_DEFAULT
+			{DS, 16},
+			{dlsym, 0},
+			{ArgumentsFP, 0},
+			{CallFP, 0},
+			{exit, 0},
+
+			{Call, 11},
+			{FFIReturn, 0},
+			{Func, 0},
+			{AP, 0},
+			{Push32, 42},
+			{Store32, 0},
+			{AddSP, i32StackSz},
+			{Return, 0},
+		},
+		Data:       make([]byte, 64),
+		Globals:    map[ir.NameID]Global{ir.NameID(dict.SID("g")): {Offset: 24, Size: 8, Type: ir.TypeID(dict.SID("int64"))}},
+		Signatures: map[ir.NameID]ir.TypeID{f: ir.TypeID(dict.SID("func()int32"))},
+		Sym:        map[ir.NameID]int{f: 9},
+	}
+	copy(b.Data[16:], "f")
+	m, err := newMachine(b, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if _, err := m.NewThread(mmapPage); err != nil {
+		t.Fatal(err)
+	}
+
+	p := m.malloc(ptrSize)
+	writePtr(m.ds, p)
+	writePtr(p, m.ds+8)
+	m2, err := m.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m2.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if g, e := len(m2.Threads), 0; g != e {
+		t.Fatalf("got %v threads, expected %v", g, e)
+	}
+
+	if g, ok := m2.LookupGlobal("g"); !ok || g != m2.ds+24 {
+		t.Fatalf("got %#x %v, expected %#x", g, ok, m2.ds+24)
+	}
+
+	if err := m2.checkFFI(9, []FFIResult{Int32Result{}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m2.checkFFI(9, []FFIResult{Int64Result{}}, nil); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	p2 := readPtr(m2.ds)
+	if g, e := readPtr(p2), m2.ds+8; p2 == p || g != e {
+		t.Fatalf("got %#x, expected %#x", g, e)
+	}
+
+	writePtr(p2, 0)
+	if g, e := readPtr(p), m.ds+8; g != e {
+		t.Fatalf("original modified: got %#x, expected %#x", g, e)
+	}
+
+	thread, err := m2.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if es, err := thread.run(0); err != nil || es != 42 {
+		t.Fatal(es, err)
+	}
+}
+
+func TestContext(t *testing.T) {
 	m, err := newMachine(nil, 0, nil, nil, nil, "")
 	if err != nil {
 		t.Fatal(err)
@@ -94,17 +359,194 @@ func TestExit(t *testing.T) {
 	}
 
 	e := 42
-	m.code = []Operation{
+	m.setCode([]Operation{
+		{Jmp, 0},
 		{Push32, e},
 		{exit, 0},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*tim.Millisecond)
+	defer cancel()
+	if _, err := thread.FFIContext(ctx, 0, nil); err != (ContextError{context.DeadlineExceeded}) {
+		t.Fatal(err)
 	}
-	if g, _ := thread.cpu.run(0); g != e {
-		t.Fatal("exit code", g, e)
+
+	if g, err := thread.FFI0(1); g != e || err != nil {
+		t.Fatal(g, err)
+	}
+
+	// Threads created by pthread_create inherit the context.
+	b := &Binary{
+		Code: []Operation{
+			{AddSP, -i32StackSz}, // pthread_create result
+			{Arguments, 0},
+			{DS, 0},     // &thread
+			{Push64, 0}, // attr
+			{FP, 18},
+			{Push64, 0},
+			{pthread_create, 0},
+			{AddSP, i32StackSz},
+			{AddSP, -i32StackSz}, // pthread_join result
+			{Arguments, 0},
+			{DS, 0},
+			{Load64, 0},
+			{Push64, 0},
+			{pthread_join, 0},
+			{AddSP, i32StackSz},
+			{Jmp, 15},
+
+			// void *f(void *arg) { for (;;); }
+			{Call, 18},
+			{FFIReturn, 0},
+			{Func, 0},
+			{Jmp, 19},
+		},
+		Data: make([]byte, 8),
+	}
+	m2, err := newMachine(b, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m2.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	thread2, err := m2.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*tim.Millisecond)
+	defer cancel()
+	if _, err := thread2.FFIContext(ctx, 0, nil); err != (ContextError{context.DeadlineExceeded}) {
+		t.Fatal(err)
+	}
+
+	m2.threadsMu.Lock()
+	var child *Thread
+	for _, v := range m2.Threads {
+		if v != thread2 {
+			child = v
+		}
+	}
+	m2.threadsMu.Unlock()
+	if child == nil {
+		t.Fatal("missing thread")
+	}
+
+	select {
+	case <-child.done:
+	case <-tim.After(10 * tim.Second):
+		t.Fatal("thread not stopped")
+	}
+
+	select {
+	case <-m2.stop:
+		t.Fatal("machine killed")
+	default:
 	}
 }
 
-func TestKill(t *testing.T) {
-	m, err := newMachine(nil, 0, nil, nil, nil, "")
+func TestCoverage(t *testing.T) {
+	b := &Binary{
+		Code: []Operation{
+			{Push32, 0},
+			{Jz, 4},
+			{Push32, 1},
+			{exit, 0},
+			{Push32, 42},
+			{exit, 0},
+		},
+		Lines: []PCInfo{
+			{PC: 0, Line: 1, Column: 1, Name: ir.NameID(dict.SID("/tmp/a.c"))},
+			{PC: 2, Line: 2, Column: 3, Name: ir.NameID(dict.SID("/tmp/a.c"))},
+			{PC: 4, Line: 3, Column: 1, Name: ir.NameID(dict.SID("/tmp/a.c"))},
+		},
+	}
+	var cov Coverage
+	for i := 0; i < 2; i++ {
+		m, err := newMachine(b, 0, nil, nil, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m.setOptions(&options{coverage: &cov, fuel: -1})
+		thread, err := m.NewThread(mmapPage)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if es, err := thread.run(0); err != nil || es != 42 {
+			t.Fatal(es, err)
+		}
+
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := cov.WriteGoCover(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	e := `mode: count
+/tmp/a.c:1.1,2.1 1 2
+/tmp/a.c:2.3,3.1 1 0
+/tmp/a.c:3.1,4.1 1 2
+`
+	if g := buf.String(); g != e {
+		t.Fatalf("got\n%s\nexpected\n%s", g, e)
+	}
+
+	var cov2 Coverage
+	if err := cov2.ReadGoCover(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	cov2.Merge(&cov)
+	buf.Reset()
+	if err := cov2.WriteLCOV(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	e = `TN:
+SF:/tmp/a.c
+DA:1,4
+DA:2,0
+DA:3,4
+LF:3
+LH:2
+end_of_record
+`
+	if g := buf.String(); g != e {
+		t.Fatalf("got\n%s\nexpected\n%s", g, e)
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	b := &Binary{
+		Code: []Operation{
+			{Arguments, 0},
+			{Call, 4},
+			{Push32, 42},
+			{exit, 0},
+			{Func, 0},
+			{Return, 0},
+		},
+		Functions: []PCInfo{
+			{PC: 0, Name: ir.NameID(dict.SID("main"))},
+			{PC: 4, Name: ir.NameID(dict.SID("f"))},
+		},
+		Lines: []PCInfo{
+			{PC: 0, Line: 1, Name: ir.NameID(dict.SID("/tmp/a.c"))},
+			{PC: 1, Line: 2, Name: ir.NameID(dict.SID("/tmp/a.c"))},
+			{PC: 4, Line: 10, Name: ir.NameID(dict.SID("/tmp/a.c"))},
+		},
+	}
+	m, err := newMachine(b, 0, nil, nil, nil, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -120,11 +562,1837 @@ func TestKill(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	ch := make(chan int)
-	go func() {
-		m.code = []Operation{
-			{Jmp, 0},
+	d := NewDebugger(b)
+	if _, err := d.BreakLine("a.c", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	m.debugger = d
+	for i, v := range []struct {
+		cmds []DebugCommand
+		pcs  string
+	}{
+		{[]DebugCommand{DebugStepInto, DebugStepOver, DebugContinue}, "[1 4 5]"},
+		{[]DebugCommand{DebugStepOver, DebugContinue}, "[1 2]"},
+	} {
+		var pcs []int
+		d.OnStop = func(s *DebugState) DebugCommand {
+			pcs = append(pcs, s.PC)
+			return v.cmds[len(pcs)-1]
+		}
+		if g, err := thread.cpu.run(0); g != 42 || err != nil {
+			t.Fatal(i, g, err)
+		}
+
+		if g, e := fmt.Sprint(pcs), v.pcs; g != e {
+			t.Fatalf("%v: got %s, expected %s", i, g, e)
+		}
+	}
+
+	if pcs, err := d.BreakFunction("f"); err != nil || fmt.Sprint(pcs) != "[5]" {
+		t.Fatal(pcs, err)
+	}
+
+	if g, e := fmt.Sprint(d.Breakpoints()), "[1 5]"; g != e {
+		t.Fatalf("got %s, expected %s", g, e)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	start := tim.Date(2017, 1, 2, 15, 4, 5, 0, tim.UTC)
+	run := func() []int64 {
+		m, err := newMachine(nil, 0, nil, nil, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer func() {
+			if err := m.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		var o options
+		if err := Deterministic(DeterministicConfig{Seed: 42, Start: start})(&o); err != nil {
+			t.Fatal(err)
+		}
+
+		m.det = o.det
+		thread, err := m.NewThread(mmapPage)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mem := m.calloc(40)
+		defer m.free(mem)
+
+		call := func(slot uintptr, op Opcode, args ...int) []Operation {
+			r := []Operation{{Push64, int(slot)}, {AddSP, -ptrStackSz}, {Arguments, 0}}
+			for _, v := range args {
+				r = append(r, Operation{Push64, v})
+			}
+			return append(r, Operation{op, 0}, Operation{Store64, 0}, Operation{AddSP, i64StackSz})
+		}
+		code := call(mem, time, 0)
+		code = append(code, call(mem+8, random)...)
+		code = append(code, Operation{AddSP, -i32StackSz}, Operation{Arguments, 0}, Operation{Push32, 1500000}, Operation{usleep, 0}, Operation{AddSP, i32StackSz})
+		code = append(code, call(mem+16, time, 0)...)
+		code = append(code, call(mem+24, localtime, int(mem))...)
+		code = append(code, call(mem+32, gettimeofday, 0, 0)...)
+		m.setCode(append(code, Operation{Push32, 0}, Operation{exit, 0}))
+		if _, err := thread.cpu.run(0); err != nil {
+			t.Fatal(err)
+		}
+
+		tm := readPtr(mem + 24)
+		return []int64{readI64(mem), readI64(mem + 8), readI64(mem + 16), int64(readI32(tm + 5*4)), int64(readI32(tm + 2*4)), int64(readI32(mem + 32))}
+	}
+
+	a := run()
+	if g, e := fmt.Sprint(a), fmt.Sprint(run()); g != e {
+		t.Fatalf("runs differ: %s, %s", g, e)
+	}
+
+	if g, e := a[0], start.Unix(); g != e {
+		t.Errorf("time: got %v, expected %v", g, e)
+	}
+
+	if g, e := a[2]-a[0], int64(1); g != e {
+		t.Errorf("time after usleep: got +%v, expected +%v", g, e)
+	}
+
+	if g, e := fmt.Sprint(a[3:5]), "[117 15]"; g != e {
+		t.Errorf("localtime: got %v, expected %v", g, e)
+	}
+
+	if g, e := a[5], int64(0); g != e {
+		t.Errorf("gettimeofday(NULL, NULL): got %v, expected %v", g, e)
+	}
+}
+
+func TestDlopen(t *testing.T) {
+	lib := &Binary{
+		Code: []Operation{
+			{Call, 2},
+			{FFIReturn, 0},
+			{Func, 0},
+			{Push64, 6}, // &&label
+			{JmpP, 0},
+			{Panic, 0},
+			{AP, 0}, // label:
+			{DSI32, 0},
+			{Store32, 0},
+			{AddSP, i32StackSz},
+			{Return, 0},
+		},
+		CSRelative:     []byte{0, 0, 1},
+		CodeCSRelative: []byte{1 << 3},
+		Data:           make([]byte, 24),
+		Sym:            map[ir.NameID]int{ir.NameID(dict.SID("answer")): 0},
+	}
+	binary.LittleEndian.PutUint32(lib.Data, 42)
+	binary.LittleEndian.PutUint32(lib.Data[8:], 2)  // Not a pointer.
+	binary.LittleEndian.PutUint32(lib.Data[16:], 2) // &answer
+	var buf bytes.Buffer
+	if _, err := lib.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewMemFileSystem()
+	if err := fs.WriteFile("/lib.so", buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 32)
+	copy(data, "/lib.so")
+	copy(data[16:], "answer")
+	b := &Binary{
+		Code: []Operation{
+			{AddSP, -i32StackSz}, // answer() result
+			{AddSP, -ptrStackSz}, // dlsym result
+			{Arguments, 0},
+			{AddSP, -ptrStackSz}, // dlopen result
+			{Arguments, 0},
+			{DS, 0},
+			{Push32, 0},
+			{dlopen, 0},
+			{DS, 16},
+			{dlsym, 0},
+			{ArgumentsFP, 0},
+			{CallFP, 0},
+			{exit, 0},
+		},
+		Data: data,
+	}
+	m, err := newMachine(b, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	m.fs = fs
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if es, err := thread.run(0); err != nil || es != 42 {
+		t.Fatal(es, err)
+	}
+
+	if g, e := len(m.libs), 1; g != e {
+		t.Fatalf("got %v libraries, expected %v", g, e)
+	}
+
+	ds := uintptr(unsafe.Pointer(&m.libs[0].dsMem[0]))
+	if g, e := fmt.Sprint(readPtr(ds+8), readPtr(ds+16)), fmt.Sprint(2, len(b.Code)+2); g != e {
+		t.Fatalf("got %s, expected %s", g, e)
+	}
+
+	if err := fs.WriteFile("/lib2.so", buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 4
+	var threads [n]*Thread
+	for i := range threads {
+		if threads[i], err = m.NewThread(mmapPage); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var handles [n]uintptr
+	var errs [n]error
+	var wg sync.WaitGroup
+	for i, thread := range threads {
+		wg.Add(1)
+		go func(i int, c *cpu) {
+			defer wg.Done()
+
+			handles[i], errs[i] = c.dlopenPath("/lib2.so")
+			c.sp -= ptrStackSz
+			c.rp = c.sp // dlerror result
+			c.dlfail("%d", i)
+			c.dlerror()
+		}(i, &thread.cpu)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil || handles[i] != handles[0] {
+			t.Fatal(i, handles[i], handles[0], err)
 		}
+	}
+
+	if g, e := fmt.Sprint(len(m.libs), m.libs[1].refs), fmt.Sprint(2, n); g != e {
+		t.Fatalf("got %s, expected %s", g, e)
+	}
+}
+
+func TestExit(t *testing.T) {
+	m, err := newMachine(nil, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := 42
+	m.setCode([]Operation{
+		{Push32, e},
+		{exit, 0},
+	})
+	if g, _ := thread.cpu.run(0); g != e {
+		t.Fatal("exit code", g, e)
+	}
+}
+
+func TestFFI(t *testing.T) {
+	m, err := newMachine(nil, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// struct { int32_t x, y; } f(struct { int32_t x, y; } s, char *buf, int8_t c)
+	m.setCode([]Operation{
+		{Call, 2},
+		{FFIReturn, 0},
+		{Func, 0},
+		{AP, 0},
+		{Argument32, -4},
+		{Store32, 0},
+		{AddSP, i32StackSz},
+		{AP, 4},
+		{Argument32, -8},
+		{Store32, 0},
+		{AddSP, i32StackSz},
+		{Argument64, -8 - ptrStackSz},
+		{Argument8, -8 - ptrStackSz - i8StackSz},
+		{Store8, 0},
+		{AddSP, i8StackSz},
+		{Return, 0},
+	})
+	in := make([]byte, 8)
+	binary.LittleEndian.PutUint32(in, 1)
+	binary.LittleEndian.PutUint32(in[4:], 2)
+	out := make([]byte, 8)
+	buf := []byte("abc")
+	if _, err := thread.FFI1(0, StructResult{out}, Struct(in), Bytes(buf), Int8('z')); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := fmt.Sprint(binary.LittleEndian.Uint32(out), binary.LittleEndian.Uint32(out[4:])), "2 1"; g != e {
+		t.Fatalf("got %s, expected %s", g, e)
+	}
+
+	if g, e := string(buf), "zbc"; g != e {
+		t.Fatalf("got %q, expected %q", g, e)
+	}
+
+	if g := len(m.blocks); g != 0 {
+		t.Fatalf("got %v heap blocks, expected 0", g)
+	}
+}
+
+func TestFFISignature(t *testing.T) {
+	f := ir.NameID(dict.SID("f"))
+	b := &Binary{
+		Code: []Operation{ // int32_t f(int32_t x) { return x; }
+			{Call, 2},
+			{FFIReturn, 0},
+			{Func, 0},
+			{AP, 0},
+			{Argument32, -i32StackSz},
+			{Store32, 0},
+			{AddSP, i32StackSz},
+			{Return, 0},
+		},
+		Globals:    map[ir.NameID]Global{ir.NameID(dict.SID("g")): {Size: 8, Type: ir.TypeID(dict.SID("int64"))}},
+		Signatures: map[ir.NameID]ir.TypeID{f: ir.TypeID(dict.SID("func(int32)int32"))},
+		Sym:        map[ir.NameID]int{f: 0},
+	}
+	if g, e := fmt.Sprint(b.Symbols()), "[{true f func(int32)int32} {false g int64}]"; g != e {
+		t.Fatalf("got %s, expected %s", g, e)
+	}
+
+	m, err := newMachine(b, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r int32
+	if _, err := thread.FFI1(0, Int32Result{&r}, Int32(42)); err != nil {
+		t.Fatal(err)
+	}
+
+	if r != 42 {
+		t.Fatalf("got %v, expected 42", r)
+	}
+
+	for i, v := range []struct {
+		out []FFIResult
+		in  []FFIArgument
+	}{
+		{[]FFIResult{Int32Result{&r}}, nil},
+		{[]FFIResult{Int32Result{&r}}, []FFIArgument{Int32(1), Int32(2)}},
+		{[]FFIResult{Int32Result{&r}}, []FFIArgument{Int64(1)}},
+		{[]FFIResult{Float64Result{}}, []FFIArgument{Int32(1)}},
+		{nil, []FFIArgument{Int32(1)}},
+	} {
+		if _, err := thread.FFI(0, v.out, v.in...); err == nil {
+			t.Fatalf("%v: unexpected success", i)
+		}
+	}
+
+	// An unknown signature, eg. read from a corrupted file, is an error.
+	m.libsMu.Lock()
+	m.sigs[0] = signature{f, ir.TypeID(dict.SID("func(bogus)int32"))}
+	m.libsMu.Unlock()
+	if _, err := thread.FFI1(0, Int32Result{&r}, Int32(42)); err == nil || !strings.HasPrefix(err.Error(), "FFI f: ") {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSystem(t *testing.T) {
+	m, err := newMachine(nil, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewMemFileSystem()
+	if err := fs.WriteFile("/in.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m.fs = fs
+	mem := m.calloc(256)
+	defer m.free(mem)
+
+	slot := mem + 192
+	open := func(name, mode string) []Operation {
+		CopyString(mem, name, true)
+		CopyString(mem+64, mode, true)
+		return []Operation{
+			{Push64, int(slot)},
+			{AddSP, -ptrStackSz},
+			{Arguments, 0},
+			{Push64, int(mem)},
+			{Push64, int(mem + 64)},
+			{fopen64, 0},
+			{Store64, 0},
+			{AddSP, i64StackSz},
+		}
+	}
+	rw := func(op Opcode) []Operation {
+		return []Operation{
+			{AddSP, -longStackSz},
+			{Arguments, 0},
+			{Push64, int(mem + 128)},
+			{Push64, 1},
+			{Push64, 5},
+			{Push64, int(slot)},
+			{Load64, 0},
+			{op, 0},
+			{AddSP, longStackSz},
+			{AddSP, -i32StackSz},
+			{Arguments, 0},
+			{Push64, int(slot)},
+			{Load64, 0},
+			{fclose, 0},
+			{AddSP, i32StackSz},
+			{Push32, 0},
+			{exit, 0},
+		}
+	}
+
+	m.setCode(append(open("/in.txt", "r"), rw(fread)...))
+	if _, err := thread.cpu.run(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := GoString(mem+128), "hello"; g != e {
+		t.Fatalf("got %q, expected %q", g, e)
+	}
+
+	CopyString(mem+128, "world", true)
+	m.setCode(append(open("sub/../out.txt", "w"), rw(fwrite)...))
+	if _, err := thread.cpu.run(0); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := fs.ReadFile("/out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := string(b), "world"; g != e {
+		t.Fatalf("got %q, expected %q", g, e)
+	}
+
+	m.setCode(append(open("/missing", "r"), Operation{Push32, 0}, Operation{exit, 0}))
+	if _, err := thread.cpu.run(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if g := readPtr(slot); g != 0 {
+		t.Fatalf("got %#x, expected 0", g)
+	}
+
+	if g, e := fmt.Sprint(fs.Names()), "[/ /in.txt /out.txt]"; g != e {
+		t.Fatalf("got %s, expected %s", g, e)
+	}
+
+	f, err := fs.OpenFile("/out.txt", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd := int(m.fds.add(f)) // Closed by exit.
+	CopyString(mem+64, "ab", false)
+	CopyString(mem+128, "cd", false)
+	writePtr(mem, mem+64)
+	writeULong(mem+ptrSize, 2)
+	writePtr(mem+2*ptrSize, mem+128)
+	writeULong(mem+3*ptrSize, 2)
+	m.setCode([]Operation{
+		{AddSP, -longStackSz},
+		{Arguments, 0},
+		{Push32, fd},
+		{Push64, int(mem)},
+		{Push32, 2},
+		{writev, 0},
+		{exit, 0},
+	})
+	if es, err := thread.cpu.run(0); err != nil || es != 4 {
+		t.Fatal(es, err)
+	}
+
+	if b, err = fs.ReadFile("/out.txt"); err != nil || string(b) != "abcd" {
+		t.Fatalf("%q %v", b, err)
+	}
+
+	if f, err = fs.OpenFile("/out.txt", os.O_RDONLY, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	fd = int(m.fds.add(f)) // Closed by exit.
+	m.setCode([]Operation{
+		{AddSP, -ptrStackSz},
+		{Arguments, 0},
+		{Push64, 0},
+		{Push64, mmapPage},
+		{Push32, syscall.PROT_READ},
+		{Push32, syscall.MAP_SHARED},
+		{Push32, fd},
+		{Push64, 0},
+		{mmap64, 0},
+		{exit, 0},
+	})
+	if es, err := thread.cpu.run(0); err != nil || es != -1 {
+		t.Fatal(es, err)
+	}
+
+	if g, e := readI32(thread.cpu.tls+unsafe.Offsetof(tls{}.errno)), int32(syscall.EBADF); g != e {
+		t.Fatalf("got errno %v, expected %v", g, e)
+	}
+
+	if err := fs.Chtimes("/out.txt", tim.Unix(0, 0), tim.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := fs.Stat("/out.txt"); err != nil || fi.ModTime().Unix() != 42 {
+		t.Fatal(fi, err)
+	}
+
+	// Descriptors of files which are not OS files do not collide with
+	// sockets.
+	m.setCode([]Operation{
+		{AddSP, -i32StackSz},
+		{Arguments, 0},
+		{Push32, syscall.AF_UNIX},
+		{Push32, syscall.SOCK_STREAM},
+		{Push32, 0},
+		{socket, 0},
+		{exit, 0},
+	})
+	sock, err := thread.cpu.run(0)
+	if err != nil || sock < 0 {
+		t.Fatal(sock, err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if f, err = fs.OpenFile("/out.txt", os.O_RDONLY, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if fd := int(m.fds.add(f)); fd == sock { // Closed by exit.
+			t.Fatalf("memfs file got the descriptor %v of a socket", fd)
+		}
+	}
+
+	if err := thread.cpu.hostFd(int32(sock)); err != nil {
+		t.Fatal(err)
+	}
+
+	m.setCode([]Operation{
+		{AddSP, -i32StackSz},
+		{Arguments, 0},
+		{Push32, sock},
+		{close_, 0},
+		{exit, 0},
+	})
+	if es, err := thread.cpu.run(0); err != nil || es != 0 {
+		t.Fatal(es, err)
+	}
+
+	if err := syscall.Close(sock); err != syscall.EBADF {
+		t.Fatalf("socket not closed: %v", err)
+	}
+}
+
+func TestFuzzer(t *testing.T) {
+	b := &Binary{
+		Code: []Operation{
+			{Call, 2},
+			{FFIReturn, 0},
+			{Func, 0},
+			{DSI8, 0}, // Panic if the global was not reset.
+			{ConvI8I32, 0},
+			{Jz, 7},
+			{Panic, 0},
+			{DS, 0},
+			{Argument64, -ptrStackSz},
+			{Load8, 0},
+			{Store8, 0},
+			{ConvI8I32, 0},
+			{Push32, 'X'},
+			{EqI32, 0},
+			{Jz, 16},
+			{Panic, 0},
+			{AP, 0},
+			{Push32, 0},
+			{Store32, 0},
+			{AddSP, i32StackSz},
+			{Return, 0},
+		},
+		Data: make([]byte, 16),
+		Sym:  map[ir.NameID]int{idLLVMFuzzerTestOneInput: 0},
+	}
+	f, err := NewFuzzer(b, nil, nil, 0, mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := f.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for i, v := range []struct {
+		data  string
+		crash bool
+	}{
+		{"a", false},
+		{"b", false},
+		{"X", true},
+		{"c", false},
+	} {
+		if err := f.TestOneInput([]byte(v.data)); (err != nil) != v.crash {
+			t.Fatal(i, err)
+		}
+	}
+
+	// The localtime buffer allocated by a call is freed by the reset.
+	m := f.m
+	m.tmOnce.Do(func() { m.tm = m.calloc(tmSize + tmZoneSz) })
+	if !f.reset() || m.tm != 0 {
+		t.Fatalf("%#x", m.tm)
+	}
+
+	m.tmOnce.Do(func() { m.tm = m.calloc(tmSize + tmZoneSz) })
+	if m.tm == 0 {
+		t.Fatal("localtime buffer not reallocated")
+	}
+}
+
+func TestFuel(t *testing.T) {
+	m, err := newMachine(nil, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.SetFuel(4096)
+	m.setCode([]Operation{
+		{Jmp, 0},
+	})
+	if _, err := thread.cpu.run(0); err != (OutOfFuelError{}) {
+		t.Fatal(err)
+	}
+
+	if g := m.Fuel(); g != 0 {
+		t.Fatal(g)
+	}
+
+	if g := thread.cpu.rtdsc; g != 4096 {
+		t.Fatal(g)
+	}
+
+	// A budget smaller than the batch size must not fail up front and the
+	// instructions run are charged exactly. The exit instruction leaves the
+	// CPU before it's counted.
+	m.SetFuel(10)
+	e := 42
+	m.setCode([]Operation{
+		{Push32, e},
+		{Push32, e},
+		{exit, 0},
+	})
+	if g, err := thread.cpu.run(0); g != e || err != nil {
+		t.Fatal(g, err)
+	}
+
+	if g, e := m.Fuel(), int64(8); g != e {
+		t.Fatalf("got %v, expected %v", g, e)
+	}
+
+	m.SetFuel(1500)
+	m.setCode([]Operation{
+		{Jmp, 0},
+	})
+	if _, err := thread.cpu.run(0); err != (OutOfFuelError{}) {
+		t.Fatal(err)
+	}
+
+	if g := m.Fuel(); g != 0 {
+		t.Fatal(g)
+	}
+}
+
+func TestHostFunction(t *testing.T) {
+	m, err := newMachine(nil, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nm := ir.NameID(dict.SID("add"))
+	m.host = map[ir.NameID]HostFunction{
+		nm: func(call *HostCall) error {
+			a := call.Int32()
+			call.SetInt32(a + call.Int32())
+			return nil
+		},
+	}
+	m.setCode([]Operation{
+		{AddSP, -i32StackSz},
+		{Arguments, 0},
+		{Push32, 20},
+		{Push32, 22},
+		{hostFunction, int(nm)},
+		{exit, 0},
+	})
+	if g, e := thread.cpu.run(0); g != 42 {
+		t.Fatal("exit code", g, e)
+	}
+}
+
+func TestLookupGlobal(t *testing.T) {
+	b := &Binary{
+		BSS:  8,
+		Data: make([]byte, 16),
+		Globals: map[ir.NameID]Global{
+			ir.NameID(dict.SID("x")): {Offset: 8, Size: 4, Type: ir.TypeID(dict.SID("int32"))},
+			ir.NameID(dict.SID("y")): {Offset: 16, Size: 8, Type: ir.TypeID(dict.SID("int64"))},
+		},
+	}
+	binary.LittleEndian.PutUint32(b.Data[8:], 42)
+	m, err := newMachine(b, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	x, ok := m.LookupGlobal("x")
+	if !ok {
+		t.Fatal("x not found")
+	}
+
+	if g, e := readI32(x), int32(42); g != e {
+		t.Fatalf("got %v, expected %v", g, e)
+	}
+
+	y, ok := m.LookupGlobal("y")
+	if !ok {
+		t.Fatal("y not found")
+	}
+
+	if g, e := y, m.bss; g != e {
+		t.Fatalf("got %#x, expected %#x", g, e)
+	}
+
+	writeI64(y, -1)
+	if _, ok := m.LookupGlobal("z"); ok {
+		t.Fatal("unexpected z")
+	}
+}
+
+func TestMachines(t *testing.T) {
+	// The streams and the pthread mutexes of two machines are separate even
+	// when their addresses are the same.
+	const mutex = 0x1000
+	var m [2]*Machine
+	var threads [2]*Thread
+	var bufs [2]bytes.Buffer
+	for i := range m {
+		var err error
+		if m[i], err = newMachine(nil, 0, nil, &bufs[i], nil, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		defer func(m *Machine) {
+			if err := m.Close(); err != nil {
+				t.Error(err)
+			}
+		}(m[i])
+
+		if threads[i], err = m[i].NewThread(mmapPage); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, v := range m {
+		stdin := 0x100 * (i + 1)
+		v.setCode([]Operation{
+			{Arguments, 0},
+			{Push64, stdin},
+			{Push64, stdin + 8},
+			{Push64, stdin + 16},
+			{register_stdfiles, 0},
+			{Push32, 0},
+			{exit, 0},
+		})
+		if es, err := threads[i].run(0); es != 0 || err != nil {
+			t.Fatal(i, es, err)
+		}
+	}
+
+	for i, v := range m {
+		p := v.calloc(1)
+		defer v.free(p)
+
+		writeI8(p, int8('a'+i))
+		stdout := 0x100*(i+1) + 8
+		v.setCode([]Operation{
+			{AddSP, -longStackSz},
+			{Arguments, 0},
+			{Push64, int(p)},
+			{Push64, 1},
+			{Push64, 1},
+			{Push64, stdout},
+			{fwrite, 0},
+			{AddSP, longStackSz},
+			{AddSP, -i32StackSz},
+			{Arguments, 0},
+			{Push64, mutex},
+			{pthread_mutex_trylock, 0},
+			{exit, 0},
+		})
+		if es, err := threads[i].run(0); es != 0 || err != nil {
+			t.Fatal(i, es, err)
+		}
+
+		if g, e := bufs[i].String(), string(rune('a'+i)); g != e {
+			t.Fatalf("%v: got %q, expected %q", i, g, e)
+		}
+	}
+}
+
+func TestMemCheck(t *testing.T) {
+	m, err := newMachine(nil, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	fault := func(p uintptr, n int, write bool) (r bool) {
+		defer func() { r = recover() != nil }()
+
+		memCheck(p, n, write)
+		return false
+	}
+
+	memMapAdd(m, 0x1000, 0x100, false)
+	memMapAdd(m, 0x2000, 0x100, true)
+	memMapAdd(m, 0x3f00, 0x300, false)
+	for i, v := range []struct {
+		p     uintptr
+		n     int
+		write bool
+		fault bool
+	}{
+		{0x0fff, 1, false, true},
+		{0x1000, 1, false, false},
+		{0x1000, 0x100, true, false},
+		{0x10ff, 2, false, true},
+		{0x1100, 1, false, true},
+		{0x2000, 8, false, false},
+		{0x2000, 8, true, true},
+		{0x3ffc, 8, true, false},
+		{0x4100, 0x100, false, false},
+		{0x4100, 0x101, false, true},
+	} {
+		if g, e := fault(v.p, v.n, v.write), v.fault; g != e {
+			t.Errorf("%v: %#x %v %v: got %v, expected %v", i, v.p, v.n, v.write, g, e)
+		}
+	}
+	memMapRemove(0x1000)
+	if !fault(0x1000, 1, false) {
+		t.Error("access to removed memory")
+	}
+	memMapRemove(0x3f00)
+	if !fault(0x4000, 1, false) {
+		t.Error("access to removed memory")
+	}
+
+	if !memcheck {
+		return
+	}
+
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.setCode([]Operation{
+		{Push64, 0x10},
+		{Load32, 0},
+		{exit, 0},
+	})
+	if _, err := thread.cpu.run(0); err == nil || !strings.Contains(err.Error(), "memory fault") {
+		t.Fatal(err)
+	}
+}
+
+// pbField is a decoded protocol buffers field.
+type pbField struct {
+	num int
+	v   uint64 // Varint value.
+	b   []byte // Length-delimited value.
+}
+
+func pbVarint(b []byte) (uint64, []byte, error) {
+	var n uint64
+	for i, v := range b {
+		if i == 10 {
+			break
+		}
+
+		n |= uint64(v&0x7f) << (7 * uint(i))
+		if v < 0x80 {
+			return n, b[i+1:], nil
+		}
+	}
+	return 0, nil, fmt.Errorf("invalid varint")
+}
+
+func pbDecode(b []byte) (r []pbField, err error) {
+	for len(b) != 0 {
+		var tag, n uint64
+		if tag, b, err = pbVarint(b); err != nil {
+			return nil, err
+		}
+
+		f := pbField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case 0:
+			if f.v, b, err = pbVarint(b); err != nil {
+				return nil, err
+			}
+		case 2:
+			if n, b, err = pbVarint(b); err != nil {
+				return nil, err
+			}
+
+			if n > uint64(len(b)) {
+				return nil, fmt.Errorf("field %v: invalid length %v", f.num, n)
+			}
+
+			f.b, b = b[:n], b[n:]
+		default:
+			return nil, fmt.Errorf("field %v: unsupported wire type %v", f.num, tag&7)
+		}
+		r = append(r, f)
+	}
+	return r, nil
+}
+
+func pbInts(b []byte) (r []uint64, err error) {
+	for len(b) != 0 {
+		var n uint64
+		if n, b, err = pbVarint(b); err != nil {
+			return nil, err
+		}
+
+		r = append(r, n)
+	}
+	return r, nil
+}
+
+func TestPprof(t *testing.T) {
+	file := ir.NameID(dict.SID("/tmp/a.c"))
+	b := &Binary{
+		Code: []Operation{
+			{Arguments, 0},
+			{Call, 4},
+			{Push32, 42},
+			{exit, 0},
+			{Func, 0},
+			{Return, 0},
+		},
+		Functions: []PCInfo{
+			{PC: 0, Name: ir.NameID(dict.SID("main"))},
+			{PC: 4, Name: ir.NameID(dict.SID("f"))},
+		},
+		Lines: []PCInfo{
+			{PC: 0, Line: 1, Name: file},
+			{PC: 1, Line: 2, Name: file},
+			{PC: 4, Line: 10, Name: file},
+		},
+	}
+	m, err := newMachine(b, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if err := m.WritePprof(ioutil.Discard); err == nil {
+		t.Fatal("expected error")
+	}
+
+	stack := func(pcs ...uint64) string {
+		var b []byte
+		var a [8]byte
+		for _, v := range pcs {
+			binary.LittleEndian.PutUint64(a[:], v)
+			b = append(b, a[:]...)
+		}
+		return string(b)
+	}
+
+	m.ProfileRate = 10
+	m.profileStacks = map[string]int{
+		stack(5, 1): 3,
+		stack(1):    2,
+	}
+	var buf bytes.Buffer
+	if err := m.WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, err := pbDecode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		functions = map[uint64][]pbField{}
+		locations = map[uint64][]pbField{}
+		period    uint64
+		samples   [][]pbField
+		strtab    []string
+		types     [][]pbField
+	)
+	for _, f := range fields {
+		var sub []pbField
+		if f.b != nil && f.num != 6 {
+			if sub, err = pbDecode(f.b); err != nil {
+				t.Fatal(f.num, err)
+			}
+		}
+		switch f.num {
+		case 1:
+			types = append(types, sub)
+		case 2:
+			samples = append(samples, sub)
+		case 4:
+			locations[sub[0].v] = sub
+		case 5:
+			functions[sub[0].v] = sub
+		case 6:
+			strtab = append(strtab, string(f.b))
+		case 12:
+			period = f.v
+		}
+	}
+	if g, e := period, uint64(10); g != e {
+		t.Fatalf("period: got %v, expected %v", g, e)
+	}
+
+	str := func(n uint64) string {
+		if n >= uint64(len(strtab)) {
+			t.Fatalf("invalid string index %v", n)
+		}
+
+		return strtab[n]
+	}
+
+	var a []string
+	for _, v := range types {
+		a = append(a, str(v[0].v)+"/"+str(v[1].v))
+	}
+	if g, e := strings.Join(a, " "), "samples/count instructions/count"; g != e {
+		t.Fatalf("sample types: got %q, expected %q", g, e)
+	}
+
+	// Location: id, address, line{function id, line}. Function: id, name,
+	// system name, file name.
+	loc := func(id uint64) string {
+		l, ok := locations[id]
+		if !ok || len(l) != 3 {
+			t.Fatalf("invalid location %v: %v", id, l)
+		}
+
+		line, err := pbDecode(l[2].b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, ok := functions[line[0].v]
+		if !ok || len(f) != 4 {
+			t.Fatalf("invalid function %v: %v", line[0].v, f)
+		}
+
+		return fmt.Sprintf("%s@%#x(%s:%v)", str(f[1].v), l[1].v, str(f[3].v), line[1].v)
+	}
+
+	a = a[:0]
+	for _, v := range samples {
+		ids, err := pbInts(v[0].b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values, err := pbInts(v[1].b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var s []string
+		for _, id := range ids {
+			s = append(s, loc(id))
+		}
+		a = append(a, fmt.Sprintf("%s %v", strings.Join(s, " "), values))
+	}
+	if g, e := strings.Join(a, "\n"), `main@0x1(/tmp/a.c:2) [2 20]
+f@0x5(/tmp/a.c:10) main@0x1(/tmp/a.c:2) [3 30]`; g != e {
+		t.Fatalf("samples: got\n%s\nexpected\n%s", g, e)
+	}
+}
+
+func TestPrintf(t *testing.T) {
+	m, err := newMachine(nil, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	const size = 4096
+	mem := m.calloc(size)
+	defer m.free(mem)
+
+	// Strings are stored from mem up, arguments grow down from mem+size.
+	printf := func(w io.Writer, limit int64, format string, args ...interface{}) int32 {
+		data := mem
+		str := func(s string) uintptr {
+			p := data
+			CopyString(p, s, true)
+			data += uintptr(len(s) + 1)
+			return p
+		}
+		f := str(format)
+		argp := mem + size
+		for _, v := range args {
+			switch x := v.(type) {
+			case int:
+				argp -= i32StackSz
+				writeI32(argp, int32(x))
+			case int64:
+				argp -= i64StackSz
+				writeI64(argp, x)
+			case float64:
+				argp -= f64StackSz
+				writeF64(argp, x)
+			case uintptr:
+				argp -= ptrStackSz
+				writePtr(argp, x)
+			case string:
+				argp -= ptrStackSz
+				writePtr(argp, str(x))
+			default:
+				t.Fatalf("%T", x)
+			}
+		}
+		return goFprintf(w, f, mem+size, limit)
+	}
+
+	inf, nan := math.Inf(1), math.NaN()
+	for i, v := range []struct {
+		format string
+		args   []interface{}
+		out    string
+	}{
+		// Expected outputs produced by glibc.
+		{"%d|%5d|%-5d|%05d|%+d|% d|%+05d", []interface{}{42, 42, 42, 42, 42, 42, -42}, "42|   42|42   |00042|+42| 42|-0042"},
+		{"%.3d|%8.3d|%08.3d|%.0d|%-+6.2d|", []interface{}{7, 7, 7, 0, 7}, "007|     007|     007||+07   |"},
+		{"%hhd %hd %hhu %hu", []interface{}{300, 70000, -1, -1}, "44 4464 255 65535"},
+		{"%lld %llu", []interface{}{int64(-1), int64(-1)}, "-1 18446744073709551615"},
+		{"%o %#o %#o %x %#x %#X %#x %#.0o %.0x|", []interface{}{8, 8, 0, 255, 255, 255, 0, 0, 0}, "10 010 0 ff 0xff 0XFF 0 0 |"},
+		{"%#08x|%-#8o|%08.4X", []interface{}{0x1f, 8, 0xab}, "0x00001f|010     |    00AB"},
+		{"%c|%3c|%-3c|%lc", []interface{}{int('a'), int('b'), int('c'), int('w')}, "a|  b|c  |w"},
+		{"%s|%.2s|%5s|%-5s|%s|%.3s|%10.7s|", []interface{}{"hello", "hello", "ab", "ab", uintptr(0), uintptr(0), uintptr(0)}, "hello|he|   ab|ab   |(null)||    (null)|"},
+		{"%p %p %10p|%-6p|", []interface{}{uintptr(0x1234), uintptr(0), uintptr(0x1234), uintptr(0)}, "0x1234 (nil)     0x1234|(nil) |"},
+		{"%f %.2f %10.3f %-10.1f| %+f %#.0f %.0f %.0f", []interface{}{3.14159, 3.14159, 3.14159, 2.5, 1.0, 2.0, 2.5, 3.5}, "3.141590 3.14      3.142 2.5       | +1.000000 2. 2 4"},
+		{"%e %E %.0e %#.0e %.3e %e", []interface{}{12345.678, 0.000123, 5e10, 5e10, 0.0, 1e-300}, "1.234568e+04 1.230000E-04 5e+10 5.e+10 0.000e+00 1.000000e-300"},
+		{"%g %g %g %g %G %g %#g %g %.0g %#.3g %g", []interface{}{100000.0, 1000000.0, 0.0001, 0.00001, 1e-10, 123456789.0, 1.0, 0.0, 123.0, 100.0, 1e100}, "100000 1e+06 0.0001 1e-05 1E-10 1.23457e+08 1.00000 0 1e+02 100. 1e+100"},
+		{"%a %A %.1a %a %a %.3a %a %#.0a %.0a", []interface{}{1.0, 0.5, 1.96875, 0.0, -2.5, 1.0, 5e-324, 1.0, 1.5}, "0x1p+0 0X1P-1 0x2.0p+0 0x0p+0 -0x1.4p+1 0x1.000p+0 0x0.0000000000001p-1022 0x1.p+0 0x2p+0"},
+		{"%f %F %e %g %5f|%05f|%-6E|%+f", []interface{}{inf, -inf, nan, math.Copysign(nan, -1), inf, inf, inf, nan}, "inf -INF nan -nan   inf|  inf|INF   |+nan"},
+		{"%5.1f|%-10.3e|%08.2f|%+.3g|% 08.2f", []interface{}{-1.25, 1.5, -3.14159, 1234.5, 2.5}, " -1.2|1.500e+00 |-0003.14|+1.23e+03| 0002.50"},
+		{"%*d|%-*d|%.*f|%*d|%.*d", []interface{}{5, 42, 5, 42, 2, 3.14159, -5, 42, -1, 7}, "   42|42   |3.14|42   |7"},
+		{"%zu %td %jd %zd", []interface{}{uintptr(42), ^uintptr(0), int64(-1), ^uintptr(2)}, "42 -1 -1 -3"},
+		{"%%|%5%|%-5%|", nil, "%|%|%|"},
+		{"%.20f|%.15e|%.17g", []interface{}{0.1, 1.0 / 3, 0.1}, "0.10000000000000000555|3.333333333333333e-01|0.10000000000000001"},
+		{"%lf %Lf", []interface{}{1.5, 2.5}, "1.500000 2.500000"},
+		{"%#g %#.1g %#G", []interface{}{0.0001, 5.0, 1e20}, "0.000100000 5. 1.00000E+20"},
+		{"%.0f %.0f %.1f %.2f", []interface{}{0.5, 1.5, 0.05, 1.005}, "0 2 0.1 1.00"},
+		{"% x %+u %+o", []interface{}{1, 2, 3}, "1 2 3"},
+		{"%y|%", nil, "%y|%"},
+	} {
+		var buf bytes.Buffer
+		n := printf(&buf, -1, v.format, v.args...)
+		if g, e := buf.String(), v.out; g != e || n != int32(len(e)) {
+			t.Errorf("%v: %q: got %q (%v), expected %q", i, v.format, g, n, e)
+		}
+	}
+
+	var buf bytes.Buffer
+	if g, e := printf(&buf, 3, "%s\n%d", "ab", 42), int32(5); g != e || buf.String() != "ab\n" {
+		t.Errorf("got %v %q, expected %v %q", g, buf.String(), e, "ab\n")
+	}
+
+	if g, e := printf(ioutil.Discard, -1, "abc%n%s", mem+size/2, "d"), int32(4); g != e || readI32(mem+size/2) != 3 {
+		t.Errorf("got %v %v, expected %v 3", g, readI32(mem+size/2), e)
+	}
+}
+
+func TestPthread(t *testing.T) {
+	b := &Binary{
+		Code: []Operation{
+			{AddSP, -i32StackSz}, // pthread_create result
+			{Arguments, 0},
+			{DS, 0},  // &thread
+			{DS, 16}, // attr, ignored
+			{FP, 20},
+			{Push64, 42},
+			{pthread_create, 0},
+			{AddSP, i32StackSz},
+			{AddSP, -i32StackSz}, // pthread_join result
+			{Arguments, 0},
+			{DS, 0},
+			{Load64, 0},
+			{DS, 8}, // &value
+			{pthread_join, 0},
+			{AddSP, i32StackSz},
+			{DS, 8},
+			{Load64, 0},
+			{exit, 0},
+
+			// void *f(void *arg) { return arg; }
+			{Call, 20},
+			{FFIReturn, 0},
+			{Func, 0},
+			{AP, 0},
+			{Argument64, -ptrStackSz},
+			{Store64, 0},
+			{AddSP, i64StackSz},
+			{Return, 0},
+		},
+		Data: make([]byte, 24),
+	}
+	m, err := newMachine(b, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if es, err := thread.run(0); err != nil || es != 42 {
+		t.Fatal(es, err)
+	}
+
+	m.threadsMu.Lock()
+	n := len(m.Threads)
+	m.threadsMu.Unlock()
+	if g, e := n, 1; g != e {
+		t.Fatalf("got %v threads, expected %v", g, e)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	m, err := newMachine(nil, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := m.calloc(64)
+	defer m.free(mem)
+
+	os.Setenv("VIRTUAL_SANDBOX", "1")
+	CopyString(mem, "VIRTUAL_SANDBOX", true)
+	m.setCode([]Operation{
+		{Push64, int(mem + 32)},
+		{AddSP, -ptrStackSz},
+		{Arguments, 0},
+		{Push64, int(mem)},
+		{getenv, 0},
+		{Store64, 0},
+		{AddSP, i64StackSz},
+		{Push32, 0},
+		{exit, 0},
+	})
+	for _, v := range []struct {
+		action SyscallAction
+		log    string
+		null   bool
+	}{
+		{SyscallAllow, "", false},
+		{SyscallAudit, "audit process getenv", false},
+		{SyscallDeny, "deny process getenv", true},
+	} {
+		var buf bytes.Buffer
+		var o options
+		if err := Sandbox(SandboxPolicy{ProcessCalls: {Action: v.action, Errno: syscall.EACCES}}, &buf)(&o); err != nil {
+			t.Fatal(err)
+		}
+
+		m.sandbox = o.sandbox
+		writePtr(mem+32, 0)
+		writeI32(thread.cpu.tls+unsafe.Offsetof(tls{}.errno), 0)
+		if _, err := thread.cpu.run(0); err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := readPtr(mem+32) == 0, v.null; g != e {
+			t.Errorf("%v: got NULL %v, expected %v", v.action, g, e)
+		}
+
+		if g, e := buf.String(), v.log; !strings.HasPrefix(g, e) || (e == "") != (g == "") {
+			t.Errorf("%v: got %q, expected prefix %q", v.action, g, e)
+		}
+
+		if g, e := readI32(thread.cpu.tls+unsafe.Offsetof(tls{}.errno)), int32(syscall.EACCES); v.null && g != e {
+			t.Errorf("%v: got errno %v, expected %v", v.action, g, e)
+		}
+	}
+
+	// writev is a file system call using a file descriptor.
+	var buf bytes.Buffer
+	var o options
+	if err := Sandbox(SandboxPolicy{FileSystemCalls: {Action: SyscallDeny, Errno: syscall.EACCES}}, &buf)(&o); err != nil {
+		t.Fatal(err)
+	}
+
+	m.sandbox = o.sandbox
+	m.setCode([]Operation{
+		{AddSP, -longStackSz},
+		{Arguments, 0},
+		{Push32, 100},
+		{Push64, int(mem)},
+		{Push32, 0},
+		{writev, 0},
+		{exit, 0},
+	})
+	writeI32(thread.cpu.tls+unsafe.Offsetof(tls{}.errno), 0)
+	if es, err := thread.cpu.run(0); err != nil || es != -1 {
+		t.Fatal(es, err)
+	}
+
+	if g, e := buf.String(), "deny filesystem writev"; !strings.HasPrefix(g, e) {
+		t.Errorf("got %q, expected prefix %q", g, e)
+	}
+
+	if g, e := readI32(thread.cpu.tls+unsafe.Offsetof(tls{}.errno)), int32(syscall.EACCES); g != e {
+		t.Errorf("got errno %v, expected %v", g, e)
+	}
+}
+
+func TestScanf(t *testing.T) {
+	m, err := newMachine(nil, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	const size = 1024
+	mem := m.calloc(size)
+	defer m.free(mem)
+
+	// Results are stored at res+16*i, arguments grow down from mem+size.
+	res := mem + size/2
+	scan := func(input, format string, args int) int32 {
+		for i := uintptr(0); i < size; i++ {
+			writeU8(mem+i, 0)
+		}
+		CopyString(mem, input, true)
+		CopyString(mem+size/4, format, true)
+		argp := mem + size
+		for i := 0; i < args; i++ {
+			argp -= ptrStackSz
+			writePtr(argp, res+16*uintptr(i))
+		}
+		r := strReader(mem)
+		return goFscanf(&scanInput{r: &r}, mem+size/4, mem+size)
+	}
+
+	if g, e := scan(" -12 0x1F 017 42", "%d %i %i %u", 4), int32(4); g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := []int32{readI32(res), readI32(res + 16), readI32(res + 32), readI32(res + 48)}, []int32{-12, 31, 15, 42}; fmt.Sprint(g) != fmt.Sprint(e) {
+		t.Error(g, e)
+	}
+
+	if g, e := scan("ff 1.5e2 -0.25 abc", "%hhx %f %lf %2c", 4), int32(4); g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := fmt.Sprintf("%v %v %v %s", readU8(res), readF32(res+16), readF64(res+32), GoString(res+48)), "255 150 -0.25 ab"; g != e {
+		t.Error(g, e)
+	}
+
+	if g, e := scan("key = value;rest", "%[a-z] = %*[^;]%n;%s", 3), int32(2); g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := fmt.Sprintf("%s %v %s", GoString(res), readI32(res+16), GoString(res+32)), "key 11 rest"; g != e {
+		t.Error(g, e)
+	}
+
+	if g, e := scan("12 x", "%d %d", 2), int32(1); g != e {
+		t.Error(g, e)
+	}
+
+	if g, e := scan("  ", "%d", 1), int32(-1); g != e {
+		t.Error(g, e)
+	}
+
+	if g, e := scan("12345", "%3lld%%", 1), int32(1); g != e || readI64(res) != 123 {
+		t.Error(g, e, readI64(res))
+	}
+
+	if g, e := scan("-5000000000", "%Ld", 1), int32(1); g != e || readI64(res) != -5000000000 {
+		t.Error(g, e, readI64(res))
+	}
+
+	// A byte read ahead by scanf is not consumed by the program.
+	fs := NewMemFileSystem()
+	if err := fs.WriteFile("/f", []byte("abcdef"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile("/f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.files.stdin, m.stdin = mem, f // exit does not close stdin.
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(op Opcode, args ...Operation) int {
+		m.setCode(append(append([]Operation{{AddSP, -longStackSz}, {Arguments, 0}, {Push64, int(mem)}}, args...), Operation{op, 0}, Operation{exit, 0}))
+		es, err := thread.cpu.run(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return es
+	}
+
+	f.Seek(3, io.SeekStart)
+	m.files.unread(mem, 'c')
+	if g, e := call(ftell), 2; g != e {
+		t.Fatalf("got %v, expected %v", g, e)
+	}
+
+	if g, e := call(fseek, Operation{Push64, 1}, Operation{Push32, io.SeekCurrent}), 0; g != e {
+		t.Fatalf("got %v, expected %v", g, e)
+	}
+
+	if g, e := call(ftell), 3; g != e || m.files.pushed(mem) {
+		t.Fatalf("got %v, expected %v", g, e)
+	}
+
+	m.files.unread(mem, 'd')
+	call(rewind)
+	if g, e := call(ftell), 0; g != e || m.files.pushed(mem) {
+		t.Fatalf("got %v, expected %v", g, e)
+	}
+
+	// fread after fscanf gets the byte read ahead and fills whole items.
+	if err := fs.WriteFile("/g", []byte("12 abcd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.stdin, err = fs.OpenFile("/g", os.O_RDONLY, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	CopyString(mem+64, "%d", true)
+	m.setCode([]Operation{
+		{AddSP, -i32StackSz},
+		{Arguments, 0},
+		{Push64, int(mem)},
+		{Push64, int(mem + 64)},
+		{Push64, int(res)},
+		{fscanf, 0},
+		{AddSP, i32StackSz},
+		{AddSP, -longStackSz},
+		{Arguments, 0},
+		{Push64, int(mem + 128)},
+		{Push64, 4},
+		{Push64, 1},
+		{Push64, int(mem)},
+		{fread, 0},
+		{exit, 0},
+	})
+	if es, err := thread.cpu.run(0); es != 1 || err != nil {
+		t.Fatal(es, err)
+	}
+
+	if g, e := fmt.Sprintf("%v %q", readI32(res), memBytes(mem+128, 4)), `12 " abc"`; g != e {
+		t.Fatalf("got %s, expected %s", g, e)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	rel := relocator{{hi: 0x1010, lo: 0x1000, to: 0x5000}, {hi: 0x1020, lo: 0x1010, to: 0x8000}, {hi: 0x2010, lo: 0x2000, to: 0x9000}}
+	if g, e := fmt.Sprintf("%#x", rel.ptrs([]uintptr{0xfff, 0x1008, 0x1010, 0x2010, 0x2011})), "[0xfff 0x5008 0x8000 0x9010 0x2011]"; g != e {
+		t.Fatalf("got %s, expected %s", g, e)
+	}
+
+	b := &Binary{
+		Code: []Operation{
+			{Push32, 42},
+			{exit, 0},
+		},
+		DSRelative: []byte{0, 0, 0, 0, 2}, // Unaligned pointer at 33.
+		Data:       make([]byte, 64),
+		Globals:    map[ir.NameID]Global{ir.NameID(dict.SID("g")): {Offset: 48, Size: 8, Type: ir.TypeID(dict.SID("int64"))}},
+		Signatures: map[ir.NameID]ir.TypeID{ir.NameID(dict.SID("main")): ir.TypeID(dict.SID("func()int32"))},
+		Sym:        map[ir.NameID]int{ir.NameID(dict.SID("main")): 0},
+		Text:       []byte("text\x00"),
+	}
+	binary.LittleEndian.PutUint64(b.Data[33:], 16)
+	m, err := newMachine(b, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ds[0] -> p, p[0] -> q, p[1] -> ds[8], q -> "text", stack -> q.
+	p := m.malloc(2 * ptrSize)
+	q := m.malloc(ptrSize)
+	writePtr(m.ds, p)
+	writePtr(p, q)
+	writePtr(p+ptrSize, m.ds+8)
+	writePtr(q, m.ts)
+	thread.sp -= ptrStackSz
+	writePtr(thread.sp, q)
+
+	var buf bytes.Buffer
+	if err := m.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	m2, err := Restore(&buf, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m2.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	p2 := readPtr(m2.ds)
+	if p2 == p || p2 == 0 {
+		t.Fatalf("not relocated: %#x", p2)
+	}
+
+	q2 := readPtr(p2)
+	thread2 := m2.Threads[0]
+	if g, e := readPtr(p2+ptrSize), m2.ds+8; g != e {
+		t.Fatalf("got %#x, expected %#x", g, e)
+	}
+
+	if g, e := readPtr(m2.ds+33), m2.ds+16; g != e {
+		t.Fatalf("got %#x, expected %#x", g, e)
+	}
+
+	if g, ok := m2.LookupGlobal("g"); !ok || g != m2.ds+48 {
+		t.Fatalf("got %#x %v, expected %#x", g, ok, m2.ds+48)
+	}
+
+	if err := m2.checkFFI(0, nil, []FFIArgument{Int32(1)}); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if g, e := readPtr(thread2.sp), q2; g != e {
+		t.Fatalf("got %#x, expected %#x", g, e)
+	}
+
+	if g, e := GoString(readPtr(q2)), "text"; g != e {
+		t.Fatalf("got %q, expected %q", g, e)
+	}
+
+	if g, e := thread2.sp-thread2.ss, thread.sp-thread.ss; g != e {
+		t.Fatalf("got %#x, expected %#x", g, e)
+	}
+
+	if g, e := thread2.tlsp.threadID, thread.tlsp.threadID; g != e {
+		t.Fatalf("got %v, expected %v", g, e)
+	}
+
+	if g, e := len(m2.blocks), 2; g != e {
+		t.Fatalf("got %v blocks, expected %v", g, e)
+	}
+
+	es, err := thread2.run(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := es, 42; g != e {
+		t.Fatalf("got %v, expected %v", g, e)
+	}
+}
+
+func TestTrackAllocations(t *testing.T) {
+	m, err := newMachine(nil, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	m.allocs = newAllocTracker(&buf)
+	m.setCode([]Operation{
+		{AddSP, -ptrStackSz},
+		{Arguments, 0},
+		{Push64, 16},
+		{malloc, 0},
+		{AddSP, -ptrStackSz},
+		{Arguments, 0},
+		{Push64, 32},
+		{malloc, 0},
+		{Arguments, 0},
+		{free, 0},
+		{Push32, 0},
+		{exit, 0},
+	})
+	if _, err := thread.cpu.run(0); err != nil {
+		t.Fatal(err)
+	}
+
+	leaks := m.Leaks()
+	if len(leaks) != 1 || leaks[0].Size != 16 {
+		t.Fatalf("%+v", leaks)
+	}
+
+	if err := m.reportLeaks(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := buf.String(), "16 bytes in 1 blocks leaked\n"; !strings.HasSuffix(g, e) {
+		t.Fatalf("got %q, expected suffix %q", g, e)
+	}
+
+	for _, v := range []struct {
+		p   uintptr
+		err string
+	}{
+		{leaks[0].Addr, "double free"},
+		{0x1234, "free of non-heap pointer"},
+	} {
+		m.setCode([]Operation{
+			{Push64, int(v.p)},
+			{Arguments, 0},
+			{free, 0},
+			{Arguments, 0},
+			{free, 0},
+			{Push32, 0},
+			{exit, 0},
+		})
+		if _, err := thread.cpu.run(0); err == nil || !strings.Contains(err.Error(), v.err) {
+			t.Fatalf("got %v, expected %q", err, v.err)
+		}
+	}
+
+	// Blocks allocated by the VM can be reallocated and freed by the program.
+	// The block passed to realloc is freed if realloc moves it.
+	p := m.CString("abc")
+	m.setCode([]Operation{
+		{AddSP, -ptrStackSz},
+		{Arguments, 0},
+		{Push64, int(p)},
+		{Push64, 4096},
+		{realloc, 0},
+		{Arguments, 0},
+		{free, 0},
+		{Push64, int(p)},
+		{Arguments, 0},
+		{free, 0},
+		{Push32, 0},
+		{exit, 0},
+	})
+	if _, err := thread.cpu.run(0); err == nil || !strings.Contains(err.Error(), "double free") {
+		t.Fatalf("got %v, expected double free", err)
+	}
+
+	m.CString("not a leak")
+	if g := len(m.Leaks()); g != 0 {
+		t.Fatalf("got %v leaks, expected 0", g)
+	}
+}
+
+func TestKill(t *testing.T) {
+	m, err := newMachine(nil, 0, nil, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	thread, err := m.NewThread(mmapPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan int)
+	go func() {
+		m.setCode([]Operation{
+			{Jmp, 0},
+		})
 		es, _ := thread.cpu.run(0)
 		ch <- es
 	}()
@@ -0,0 +1,652 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sort"
+
+	"github.com/cznic/ir"
+	"github.com/cznic/mathutil"
+)
+
+// Binary file format
+//
+// A file written by Binary.WriteTo consists of a file header, a section table
+// and the section payloads. All fixed size integers are little endian.
+//
+//	file    = [ "#!" ... "\n" ] magic version count { entry } { payload } .
+//	magic   = 03 91 7a ef 55 ad cc ce .
+//	version = uint32 .                 // Format version, currently 1.
+//	count   = uint32 .                 // Number of section table entries.
+//	entry   = kind flags offset size .
+//	kind    = uint32 .                 // SectionKind.
+//	flags   = uint32 .                 // Bit 0: The payload is DEFLATE compressed.
+//	offset  = uint64 .                 // Offset of the payload from magic.
+//	size    = uint64 .                 // Stored size of the payload.
+//
+// The payloads use unsigned and signed varints, as in encoding/binary, and
+//
+//	bytes   = uvarint(len) { byte } .
+//	string  = bytes .
+//	list(x) = uvarint(len) { x } .
+//
+// The sections are
+//
+//	HeaderSection     GOOS:string GOARCH:string codeVersion:uvarint
+//	CodeSection       list(opcode:uvarint N:varint)
+//	DataSection       Data:bytes BSS:uvarint Text:bytes
+//	RelocationSection DSRelative:bytes TSRelative:bytes CSRelative:bytes TextCSRelative:bytes
+//	                  CodeCSRelative:bytes
+//	LineSection       list(PC:uvarint Line:uvarint Column:uvarint file:string)
+//	SymbolSection     list(name:string PC:uvarint type:string)
+//	                  list(name:string Offset:uvarint Size:uvarint type:string)
+//	DebugSection      list(PC:uvarint Line:uvarint Column:uvarint function:string)
+//
+// Names and types are stored as strings, an empty type means unknown. The
+// header section is required, any other section may be missing. Readers
+// ignore sections of unknown kinds and data following the known fields of a
+// section, so new sections and fields can be added without changing the
+// format version.
+
+const (
+	binaryFormat   = 1       // Version of the binary file format.
+	maxSectionSize = 1 << 30 // Limit of the uncompressed size of a section.
+)
+
+// SectionKind identifies a section of a binary file.
+type SectionKind uint32
+
+// Values of SectionKind.
+const (
+	HeaderSection SectionKind = iota + 1
+	CodeSection
+	DataSection
+	RelocationSection
+	LineSection
+	SymbolSection
+	DebugSection
+)
+
+func (k SectionKind) String() string {
+	switch k {
+	case HeaderSection:
+		return "header"
+	case CodeSection:
+		return "code"
+	case DataSection:
+		return "data"
+	case RelocationSection:
+		return "relocations"
+	case LineSection:
+		return "lines"
+	case SymbolSection:
+		return "symbols"
+	case DebugSection:
+		return "debug"
+	default:
+		return fmt.Sprintf("SectionKind(%d)", uint32(k))
+	}
+}
+
+// Section is an entry of the section table of a binary file.
+type Section struct {
+	Compressed bool
+	Kind       SectionKind
+	Offset     int64 // From the start of the file.
+	Size       int64 // Stored size.
+}
+
+// BinaryFile is an open binary file. Sections are read only when needed, so
+// inspecting a file, for example a file built for another platform, does not
+// need to load it completely.
+type BinaryFile struct {
+	CodeVersion int    // Compatibility version of the code, see Binary.
+	GOARCH      string // Of the binary.
+	GOOS        string // Of the binary.
+	Sections    []Section
+	r           io.ReaderAt
+}
+
+// NewBinaryFile reads the header and the section table of the binary file in
+// r having size bytes. On all platforms the file may start with a #! line.
+func NewBinaryFile(r io.ReaderAt, size int64) (*BinaryFile, error) {
+	var base int64
+	var buf [4096]byte
+	n, err := r.ReadAt(buf[:], 0)
+	if n < 2 && err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(buf[:n], []byte("#!")) {
+		i := bytes.IndexByte(buf[:n], '\n')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid file header: #! line too long")
+		}
+
+		base = int64(i + 1)
+	}
+
+	hdr := make([]byte, len(magic)+8)
+	if _, err := r.ReadAt(hdr, base); err != nil {
+		return nil, fmt.Errorf("unrecognized file format")
+	}
+
+	if !bytes.Equal(hdr[:len(magic)], magic) {
+		return nil, fmt.Errorf("unrecognized file format")
+	}
+
+	if v := binary.LittleEndian.Uint32(hdr[len(magic):]); v > binaryFormat {
+		return nil, fmt.Errorf("unsupported file format version %v", v)
+	}
+
+	count := binary.LittleEndian.Uint32(hdr[len(magic)+4:])
+	if count > 1<<16 {
+		return nil, fmt.Errorf("corrupted file: %v sections", count)
+	}
+
+	tab := make([]byte, 24*count)
+	if _, err := r.ReadAt(tab, base+int64(len(hdr))); err != nil {
+		return nil, fmt.Errorf("corrupted file: section table: %v", err)
+	}
+
+	f := &BinaryFile{r: r}
+	for i := 0; i < len(tab); i += 24 {
+		flags := binary.LittleEndian.Uint32(tab[i+4:])
+		if flags&^1 != 0 {
+			return nil, fmt.Errorf("corrupted file: section flags %#x", flags)
+		}
+
+		off := binary.LittleEndian.Uint64(tab[i+8:])
+		n := binary.LittleEndian.Uint64(tab[i+16:])
+		if off > uint64(size-base) || n > uint64(size-base)-off {
+			return nil, fmt.Errorf("corrupted file: section at %#x of size %#x exceeds the file size", off, n)
+		}
+
+		f.Sections = append(f.Sections, Section{
+			Compressed: flags&1 != 0,
+			Kind:       SectionKind(binary.LittleEndian.Uint32(tab[i:])),
+			Offset:     base + int64(off),
+			Size:       int64(n),
+		})
+	}
+
+	d, err := f.section(HeaderSection)
+	if err != nil {
+		return nil, err
+	}
+
+	if d == nil {
+		return nil, fmt.Errorf("corrupted file: missing header section")
+	}
+
+	f.GOOS = d.string()
+	f.GOARCH = d.string()
+	f.CodeVersion = d.int()
+	if d.err != nil {
+		return nil, fmt.Errorf("corrupted file: header section: %v", d.err)
+	}
+
+	switch v := f.CodeVersion; {
+	case v < 16:
+		if v != binaryVersion {
+			return nil, fmt.Errorf("invalid version number %v", v)
+		}
+	default:
+		if v > binaryVersion {
+			return nil, fmt.Errorf("incompatible version number %v", v)
+		}
+	}
+
+	return f, nil
+}
+
+// Data returns the uncompressed payload of s.
+func (f *BinaryFile) Data(s Section) ([]byte, error) {
+	sr := io.NewSectionReader(f.r, s.Offset, s.Size)
+	if !s.Compressed {
+		b, err := ioutil.ReadAll(sr)
+		if err == nil && int64(len(b)) != s.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("section %v: %v", s.Kind, err)
+		}
+
+		return b, nil
+	}
+
+	fr := flate.NewReader(sr)
+	b, err := ioutil.ReadAll(io.LimitReader(fr, maxSectionSize+1))
+	if e := fr.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil && len(b) > maxSectionSize {
+		err = fmt.Errorf("uncompressed size exceeds %v bytes", maxSectionSize)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("section %v: %v", s.Kind, err)
+	}
+
+	return b, nil
+}
+
+// section returns a decoder of the first section of kind k or nil if there
+// is no such section.
+func (f *BinaryFile) section(k SectionKind) (*decoder, error) {
+	for _, v := range f.Sections {
+		if v.Kind == k {
+			b, err := f.Data(v)
+			if err != nil {
+				return nil, err
+			}
+
+			return &decoder{b: b}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Binary returns the program in f without the debug information, see
+// LoadDebug.
+func (f *BinaryFile) Binary() (*Binary, error) {
+	b := newBinary()
+	b.GOARCH = f.GOARCH
+	b.GOOS = f.GOOS
+	for _, k := range []SectionKind{CodeSection, DataSection, RelocationSection, LineSection, SymbolSection} {
+		d, err := f.section(k)
+		if err != nil {
+			return nil, err
+		}
+
+		if d == nil {
+			continue
+		}
+
+		switch k {
+		case CodeSection:
+			b.Code = make([]Operation, d.len())
+			for i := range b.Code {
+				b.Code[i] = Operation{Opcode(d.int()), int(d.varint())}
+			}
+		case DataSection:
+			b.Data = d.bytes()
+			b.BSS = d.int()
+			b.Text = d.bytes()
+		case RelocationSection:
+			b.DSRelative = d.bytes()
+			b.TSRelative = d.bytes()
+			if len(d.b) != 0 {
+				b.CSRelative = d.bytes()
+				b.TextCSRelative = d.bytes()
+			}
+			if len(d.b) != 0 {
+				b.CodeCSRelative = d.bytes()
+			}
+		case LineSection:
+			b.Lines = d.pcInfos()
+		case SymbolSection:
+			for n := d.len(); n > 0; n-- {
+				nm := ir.NameID(dict.SID(d.string()))
+				b.Sym[nm] = d.int()
+				if t := d.string(); t != "" {
+					b.Signatures[nm] = ir.TypeID(dict.SID(t))
+				}
+			}
+			for n := d.len(); n > 0; n-- {
+				nm := ir.NameID(dict.SID(d.string()))
+				g := Global{Offset: d.int(), Size: d.int()}
+				if t := d.string(); t != "" {
+					g.Type = ir.TypeID(dict.SID(t))
+				}
+				b.Globals[nm] = g
+			}
+		}
+		if d.err != nil {
+			return nil, fmt.Errorf("corrupted file: section %v: %v", k, d.err)
+		}
+	}
+	if b.BSS > mathutil.MaxInt-len(b.Data) {
+		return nil, fmt.Errorf("corrupted file: section %v: invalid BSS size %v", DataSection, b.BSS)
+	}
+
+	for k, v := range b.Sym {
+		if v >= len(b.Code) {
+			return nil, fmt.Errorf("corrupted file: section %v: function %s: invalid address %#05x", SymbolSection, k, v)
+		}
+	}
+	n := len(b.Data) + b.BSS
+	for k, v := range b.Globals {
+		if v.Size > n || v.Offset > n-v.Size {
+			return nil, fmt.Errorf("corrupted file: section %v: variable %s: invalid offset %v or size %v", SymbolSection, k, v.Offset, v.Size)
+		}
+	}
+	return b, nil
+}
+
+// LoadDebug sets the Functions table of b, which was returned by f.Binary.
+func (f *BinaryFile) LoadDebug(b *Binary) error {
+	d, err := f.section(DebugSection)
+	if err != nil || d == nil {
+		return err
+	}
+
+	if b.Functions = d.pcInfos(); d.err != nil {
+		return fmt.Errorf("corrupted file: section %v: %v", DebugSection, d.err)
+	}
+
+	return nil
+}
+
+// ReadFrom reads b from r, including the debug information. The data may be
+// preceded by a #! line.
+func (b *Binary) ReadFrom(r io.Reader) (n int64, err error) {
+	buf, err := ioutil.ReadAll(r)
+	if n = int64(len(buf)); err != nil {
+		return n, err
+	}
+
+	f, err := NewBinaryFile(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return n, fmt.Errorf("%T.ReadFrom: %v", b, err)
+	}
+
+	nb, err := f.Binary()
+	if err != nil {
+		return n, fmt.Errorf("%T.ReadFrom: %v", b, err)
+	}
+
+	if err := f.LoadDebug(nb); err != nil {
+		return n, fmt.Errorf("%T.ReadFrom: %v", b, err)
+	}
+
+	*b = *nb
+	return n, nil
+}
+
+// WriteTo writes b to w in the binary file format.
+func (b *Binary) WriteTo(w io.Writer) (n int64, err error) {
+	goos, goarch := b.GOOS, b.GOARCH
+	if goos == "" {
+		goos, goarch = runtime.GOOS, runtime.GOARCH
+	}
+
+	var sections []encoder
+	var e encoder
+
+	e = encoder{kind: HeaderSection}
+	e.string(goos)
+	e.string(goarch)
+	e.uvarint(binaryVersion)
+	sections = append(sections, e)
+
+	e = encoder{kind: CodeSection}
+	e.uvarint(len(b.Code))
+	for _, v := range b.Code {
+		e.uvarint(int(v.Opcode))
+		e.varint(int64(v.N))
+	}
+	sections = append(sections, e)
+
+	e = encoder{kind: DataSection}
+	e.bytes(b.Data)
+	e.uvarint(b.BSS)
+	e.bytes(b.Text)
+	sections = append(sections, e)
+
+	e = encoder{kind: RelocationSection}
+	e.bytes(b.DSRelative)
+	e.bytes(b.TSRelative)
+	e.bytes(b.CSRelative)
+	e.bytes(b.TextCSRelative)
+	e.bytes(b.CodeCSRelative)
+	sections = append(sections, e)
+
+	e = encoder{kind: LineSection}
+	e.pcInfos(b.Lines)
+	sections = append(sections, e)
+
+	e = encoder{kind: SymbolSection}
+	var a []ir.NameID
+	for k := range b.Sym {
+		a = append(a, k)
+	}
+	sortNames(a)
+	e.uvarint(len(a))
+	for _, k := range a {
+		e.name(k)
+		e.uvarint(b.Sym[k])
+		e.typ(b.Signatures[k])
+	}
+	a = a[:0]
+	for k := range b.Globals {
+		a = append(a, k)
+	}
+	sortNames(a)
+	e.uvarint(len(a))
+	for _, k := range a {
+		g := b.Globals[k]
+		e.name(k)
+		e.uvarint(g.Offset)
+		e.uvarint(g.Size)
+		e.typ(g.Type)
+	}
+	sections = append(sections, e)
+
+	if len(b.Functions) != 0 {
+		e = encoder{kind: DebugSection}
+		e.pcInfos(b.Functions)
+		sections = append(sections, e)
+	}
+
+	var hdr []byte
+	hdr = append(hdr, magic...)
+	hdr = appendU32(hdr, binaryFormat)
+	hdr = appendU32(hdr, uint32(len(sections)))
+	off := len(hdr) + 24*len(sections)
+	var payloads [][]byte
+	for _, v := range sections {
+		p, flags := v.b, uint32(0)
+		if v.kind != HeaderSection {
+			if p, err = deflate(p); err != nil {
+				return 0, err
+			}
+
+			flags = 1
+		}
+		hdr = appendU32(hdr, uint32(v.kind))
+		hdr = appendU32(hdr, flags)
+		hdr = appendU64(hdr, uint64(off))
+		hdr = appendU64(hdr, uint64(len(p)))
+		payloads = append(payloads, p)
+		off += len(p)
+	}
+
+	for _, v := range append([][]byte{hdr}, payloads...) {
+		m, err := w.Write(v)
+		if n += int64(m); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// checkPlatform returns an error if b cannot run on this platform.
+func (b *Binary) checkPlatform() error {
+	if b.GOOS != "" && (b.GOOS != runtime.GOOS || b.GOARCH != runtime.GOARCH) {
+		return fmt.Errorf("cannot run a binary for %s/%s on %s/%s", b.GOOS, b.GOARCH, runtime.GOOS, runtime.GOARCH)
+	}
+
+	return nil
+}
+
+func appendU32(b []byte, n uint32) []byte {
+	var a [4]byte
+	binary.LittleEndian.PutUint32(a[:], n)
+	return append(b, a[:]...)
+}
+
+func appendU64(b []byte, n uint64) []byte {
+	var a [8]byte
+	binary.LittleEndian.PutUint64(a[:], n)
+	return append(b, a[:]...)
+}
+
+func deflate(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func sortNames(a []ir.NameID) {
+	sort.Slice(a, func(i, j int) bool { return bytes.Compare(dict.S(int(a[i])), dict.S(int(a[j]))) < 0 })
+}
+
+// encoder produces the payload of a section.
+type encoder struct {
+	b    []byte
+	kind SectionKind
+}
+
+func (e *encoder) uvarint(n int) {
+	var a [binary.MaxVarintLen64]byte
+	e.b = append(e.b, a[:binary.PutUvarint(a[:], uint64(n))]...)
+}
+
+func (e *encoder) varint(n int64) {
+	var a [binary.MaxVarintLen64]byte
+	e.b = append(e.b, a[:binary.PutVarint(a[:], n)]...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(len(b))
+	e.b = append(e.b, b...)
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(len(s))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) name(nm ir.NameID) { e.bytes(dict.S(int(nm))) }
+
+func (e *encoder) typ(t ir.TypeID) {
+	if t == 0 {
+		e.string("")
+		return
+	}
+
+	e.bytes(dict.S(int(t)))
+}
+
+func (e *encoder) pcInfos(a []PCInfo) {
+	e.uvarint(len(a))
+	for _, v := range a {
+		e.uvarint(v.PC)
+		e.uvarint(v.Line)
+		e.uvarint(v.Column)
+		e.name(v.Name)
+	}
+}
+
+// decoder consumes the payload of a section. After the first error all
+// values are zero.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.b = nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	n, k := binary.Uvarint(d.b)
+	if k <= 0 {
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+
+	d.b = d.b[k:]
+	return n
+}
+
+func (d *decoder) varint() int64 {
+	n, k := binary.Varint(d.b)
+	if k <= 0 {
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+
+	d.b = d.b[k:]
+	return n
+}
+
+func (d *decoder) int() int {
+	n := d.uvarint()
+	if n > mathutil.MaxInt {
+		d.fail(fmt.Errorf("value out of range: %v", n))
+		return 0
+	}
+
+	return int(n)
+}
+
+// len returns the length of a list or of a byte slice.
+func (d *decoder) len() int {
+	n := d.int()
+	if n > len(d.b) { // Every item takes at least one byte.
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+
+	return n
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.len()
+	if n == 0 {
+		return nil
+	}
+
+	r := d.b[:n:n]
+	d.b = d.b[n:]
+	return r
+}
+
+func (d *decoder) string() string { return string(d.bytes()) }
+
+func (d *decoder) pcInfos() []PCInfo {
+	a := make([]PCInfo, d.len())
+	for i := range a {
+		a[i] = PCInfo{PC: d.int(), Line: d.int(), Column: d.int(), Name: ir.NameID(dict.SID(d.string()))}
+	}
+	if d.err != nil {
+		return nil
+	}
+
+	return a
+}
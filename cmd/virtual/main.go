@@ -0,0 +1,306 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command virtual runs and inspects virtual binaries.
+//
+// Usage:
+//
+//	virtual run [flags] binary [args...]
+//	virtual binary [args...]
+//	virtual dump binary
+//	virtual symbols binary
+//	virtual lines binary
+//
+// Run executes the program in binary with args. The program's argv[0] is the
+// name of the binary. The command exits with the exit status of the program.
+// A first argument which is not a subcommand is the binary to run with the
+// default flags, so binaries starting with a line like
+//
+//	#!/usr/bin/env virtual
+//
+// can be executed directly. The flags of run are
+//
+//	-heap size               Heap size in bytes (default 32 MiB).
+//	-stack size              Stack size of the main thread in bytes (default 1 MiB).
+//	-stdin, -stdout, -stderr Files used as the standard streams of the program.
+//	-trace path              Directory of the sources used in stack traces.
+//	-profile-functions       Collect a profile of functions.
+//	-profile-lines           Collect a profile of source lines.
+//	-profile-instructions    Collect a profile of instructions.
+//	-profile-rate n          Sample every nth instruction (default 1000).
+//	-profile file            Write the profiles to file instead of stderr.
+//
+// Profiles are collected only when the command is built with the
+// virtual.profile tag.
+//
+// Dump writes the disassembled code of binary to stdout. Symbols lists the
+// external functions and variables of binary with their types. Lines lists
+// the line table of binary. These subcommands work also for binaries built
+// for other platforms.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cznic/ir"
+	"github.com/cznic/virtual"
+	"github.com/cznic/xc"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage:
+	%[1]s run [flags] binary [args...]
+	%[1]s binary [args...]
+	%[1]s dump binary
+	%[1]s symbols binary
+	%[1]s lines binary
+`, filepath.Base(os.Args[0]))
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "run":
+		var status int
+		if status, err = run(args); err == nil {
+			os.Exit(status)
+		}
+	case "dump", "symbols", "lines":
+		if len(args) != 1 {
+			usage()
+		}
+
+		err = inspect(cmd, args[0])
+	default:
+		if strings.HasPrefix(cmd, "-") {
+			usage()
+		}
+
+		var status int
+		if status, err = run(os.Args[1:]); err == nil {
+			os.Exit(status)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) (int, error) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	heap := fs.Int("heap", 32<<20, "heap size in bytes")
+	profile := fs.String("profile", "", "write the profiles to `file` instead of stderr")
+	profileFunctions := fs.Bool("profile-functions", false, "collect a profile of functions")
+	profileInstructions := fs.Bool("profile-instructions", false, "collect a profile of instructions")
+	profileLines := fs.Bool("profile-lines", false, "collect a profile of source lines")
+	profileRate := fs.Int("profile-rate", 1000, "sample every `n`th instruction")
+	stack := fs.Int("stack", 1<<20, "stack size of the main thread in bytes")
+	stderr := fs.String("stderr", "", "use `file` as the standard error of the program")
+	stdin := fs.String("stdin", "", "use `file` as the standard input of the program")
+	stdout := fs.String("stdout", "", "use `file` as the standard output of the program")
+	trace := fs.String("trace", "", "directory of the sources used in stack traces")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		usage()
+	}
+
+	b, err := load(fs.Arg(0), true)
+	if err != nil {
+		return -1, err
+	}
+
+	var in io.Reader = os.Stdin
+	var out, errOut io.Writer = os.Stdout, os.Stderr
+	if *stdin != "" {
+		f, err := os.Open(*stdin)
+		if err != nil {
+			return -1, err
+		}
+
+		defer f.Close()
+		in = f
+	}
+	for _, v := range []struct {
+		name string
+		w    *io.Writer
+	}{
+		{*stdout, &out},
+		{*stderr, &errOut},
+	} {
+		if v.name == "" {
+			continue
+		}
+
+		f, err := os.Create(v.name)
+		if err != nil {
+			return -1, err
+		}
+
+		defer f.Close()
+		*v.w = f
+	}
+
+	opts := []virtual.Option{virtual.ProfileRate(*profileRate)}
+	if *profileFunctions {
+		opts = append(opts, virtual.ProfileFunctions())
+	}
+	if *profileInstructions {
+		opts = append(opts, virtual.ProfileInstructions())
+	}
+	if *profileLines {
+		opts = append(opts, virtual.ProfileLines())
+	}
+	m, status, err := virtual.New(b, fs.Args(), in, out, errOut, *heap, *stack, *trace, opts...)
+	if err != nil {
+		return status, err
+	}
+
+	var w io.Writer = os.Stderr
+	if *profile != "" {
+		f, err := os.Create(*profile)
+		if err != nil {
+			m.Close()
+			return -1, err
+		}
+
+		defer f.Close()
+		w = f
+	}
+	writeProfiles(w, m)
+	return status, m.Close()
+}
+
+// load reads the binary file nm.
+func load(nm string, debug bool) (*virtual.Binary, error) {
+	f, err := os.Open(nm)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	bf, err := virtual.NewBinaryFile(f, fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", nm, err)
+	}
+
+	b, err := bf.Binary()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", nm, err)
+	}
+
+	if debug {
+		if err := bf.LoadDebug(b); err != nil {
+			return nil, fmt.Errorf("%s: %v", nm, err)
+		}
+	}
+
+	return b, nil
+}
+
+type profileItem struct {
+	n int
+	s string
+}
+
+func writeProfile(w io.Writer, title string, a []profileItem) {
+	if len(a) == 0 {
+		return
+	}
+
+	sort.Slice(a, func(i, j int) bool {
+		if a[i].n != a[j].n {
+			return a[i].n > a[j].n
+		}
+
+		return a[i].s < a[j].s
+	})
+	var sum int
+	for _, v := range a {
+		sum += v.n
+	}
+	fmt.Fprintf(w, "---- %s\n", title)
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', tabwriter.AlignRight)
+	for _, v := range a {
+		fmt.Fprintf(tw, "%d\t%.2f%%\t %s\n", v.n, 100*float64(v.n)/float64(sum), v.s)
+	}
+	tw.Flush()
+}
+
+func writeProfiles(w io.Writer, m *virtual.Machine) {
+	var a []profileItem
+	for k, v := range m.ProfileFunctions {
+		a = append(a, profileItem{v, string(xc.Dict.S(int(k.Name)))})
+	}
+	writeProfile(w, "functions", a)
+	a = nil
+	for k, v := range m.ProfileLines {
+		a = append(a, profileItem{v, k.Position().String()})
+	}
+	writeProfile(w, "lines", a)
+	a = nil
+	for k, v := range m.ProfileInstructions {
+		a = append(a, profileItem{v, k.String()})
+	}
+	writeProfile(w, "instructions", a)
+}
+
+// typ returns the name of t.
+func typ(t ir.TypeID) string {
+	if t == 0 {
+		return "?"
+	}
+
+	return string(xc.Dict.S(int(t)))
+}
+
+func inspect(cmd, nm string) error {
+	b, err := load(nm, cmd == "dump")
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "dump":
+		return virtual.DumpCode(os.Stdout, b.Code, 0, b.Functions, b.Lines)
+	case "symbols":
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+		for _, v := range b.Symbols() {
+			nm := ir.NameID(xc.Dict.SID(v.Name))
+			switch {
+			case v.Function:
+				fmt.Fprintf(w, "func\t%s\t%#05x\t\t%s\n", v.Name, b.Sym[nm], typ(v.Type))
+			default:
+				g := b.Globals[nm]
+				fmt.Fprintf(w, "var\t%s\t%#05x\t%d\t%s\n", v.Name, g.Offset, g.Size, typ(v.Type))
+			}
+		}
+		return w.Flush()
+	case "lines":
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+		for _, v := range b.Lines {
+			fmt.Fprintf(w, "%#05x\t%s\n", v.PC, v.Position())
+		}
+		return w.Flush()
+	}
+	panic("internal error")
+}
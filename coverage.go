@@ -0,0 +1,219 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Cover turns on collecting code coverage. The execution counts of the
+// program are added to cov when the machine is closed, so a single Coverage
+// can accumulate the results of any number of machines, for example of
+// several calls to Exec.
+func Cover(cov *Coverage) Option {
+	return func(o *options) error {
+		o.coverage = cov
+		return nil
+	}
+}
+
+// CoverBlock is a unit of code coverage: The code generated for a source line
+// starting at Column, as recorded in the Lines table of a Binary.
+type CoverBlock struct {
+	File   string
+	Line   int
+	Column int
+}
+
+// Coverage collects the execution counts of source code. The zero value is
+// ready to use. Coverage is safe for concurrent use.
+type Coverage struct {
+	counts map[CoverBlock]int64
+	mu     sync.Mutex
+}
+
+// Blocks returns the execution counts of the blocks seen so far.
+func (c *Coverage) Blocks() map[CoverBlock]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := make(map[CoverBlock]int64, len(c.counts))
+	for k, v := range c.counts {
+		r[k] = v
+	}
+	return r
+}
+
+// Merge adds the counts of d to c.
+func (c *Coverage) Merge(d *Coverage) {
+	for k, v := range d.Blocks() {
+		c.add(k, v)
+	}
+}
+
+func (c *Coverage) add(b CoverBlock, n int64) {
+	c.mu.Lock()
+	if c.counts == nil {
+		c.counts = map[CoverBlock]int64{}
+	}
+	c.counts[b] += n
+	c.mu.Unlock()
+}
+
+// record adds the counts of a machine. The count of a block is the maximum
+// count of its instructions. Code of the same block appearing at different
+// PCs, like that of a static inline function, is counted once per copy.
+func (c *Coverage) record(counts []*uint64, lines []PCInfo) {
+	for i, v := range lines {
+		end := len(counts)
+		if i+1 < len(lines) {
+			end = lines[i+1].PC
+		}
+		var n uint64
+		for pc := v.PC; pc < end && pc < len(counts); pc++ {
+			if v := atomic.LoadUint64(counts[pc]); v > n {
+				n = v
+			}
+		}
+		pos := v.Position()
+		c.add(CoverBlock{File: pos.Filename, Line: pos.Line, Column: pos.Column}, int64(n))
+	}
+}
+
+// sorted returns the blocks of c ordered by file, line and column, and their
+// counts.
+func (c *Coverage) sorted() ([]CoverBlock, map[CoverBlock]int64) {
+	m := c.Blocks()
+	a := make([]CoverBlock, 0, len(m))
+	for k := range m {
+		a = append(a, k)
+	}
+	sort.Slice(a, func(i, j int) bool {
+		x, y := a[i], a[j]
+		if x.File != y.File {
+			return x.File < y.File
+		}
+
+		if x.Line != y.Line {
+			return x.Line < y.Line
+		}
+
+		return x.Column < y.Column
+	})
+	return a, m
+}
+
+// WriteGoCover writes c to w in the format of the profiles produced by 'go
+// test -coverprofile' using the count mode. Every block is reported as a
+// single statement extending to the start of the next block on the same line
+// or to the end of the line.
+func (c *Coverage) WriteGoCover(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("mode: count\n")
+	a, m := c.sorted()
+	for i, v := range a {
+		endLine, endCol := v.Line+1, 1
+		if i+1 < len(a) && a[i+1].File == v.File && a[i+1].Line == v.Line {
+			endLine, endCol = v.Line, a[i+1].Column
+		}
+		fmt.Fprintf(bw, "%s:%d.%d,%d.%d 1 %d\n", v.File, v.Line, v.Column, endLine, endCol, m[v])
+	}
+	return bw.Flush()
+}
+
+// ReadGoCover adds the counts of a profile written by WriteGoCover to c.
+func (c *Coverage) ReadGoCover(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	for ln := 1; s.Scan(); ln++ {
+		t := s.Text()
+		if ln == 1 {
+			if !strings.HasPrefix(t, "mode: ") {
+				return fmt.Errorf("ReadGoCover: missing mode line")
+			}
+
+			continue
+		}
+
+		if t == "" {
+			continue
+		}
+
+		b, n, err := parseGoCover(t)
+		if err != nil {
+			return fmt.Errorf("ReadGoCover: line %d: %v", ln, err)
+		}
+
+		c.add(b, n)
+	}
+	return s.Err()
+}
+
+// parseGoCover parses "file:line.col,line.col stmts count".
+func parseGoCover(s string) (b CoverBlock, n int64, err error) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return b, 0, fmt.Errorf("invalid block: %q", s)
+	}
+
+	b.File = s[:i]
+	f := strings.Fields(s[i+1:])
+	if len(f) != 3 {
+		return b, 0, fmt.Errorf("invalid block: %q", s)
+	}
+
+	pos := strings.SplitN(strings.SplitN(f[0], ",", 2)[0], ".", 2)
+	if len(pos) != 2 {
+		return b, 0, fmt.Errorf("invalid position: %q", f[0])
+	}
+
+	if b.Line, err = strconv.Atoi(pos[0]); err != nil {
+		return b, 0, err
+	}
+
+	if b.Column, err = strconv.Atoi(pos[1]); err != nil {
+		return b, 0, err
+	}
+
+	if n, err = strconv.ParseInt(f[2], 10, 64); err != nil {
+		return b, 0, err
+	}
+
+	return b, n, nil
+}
+
+// WriteLCOV writes c to w in the LCOV tracefile format. The count of a line
+// is the maximum count of its blocks.
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	a, m := c.sorted()
+	for i := 0; i < len(a); {
+		file := a[i].File
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", file)
+		var found, hit int
+		for i < len(a) && a[i].File == file {
+			line := a[i].Line
+			var n int64
+			for ; i < len(a) && a[i].File == file && a[i].Line == line; i++ {
+				if m[a[i]] > n {
+					n = m[a[i]]
+				}
+			}
+			fmt.Fprintf(bw, "DA:%d,%d\n", line, n)
+			found++
+			if n != 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", found, hit)
+	}
+	return bw.Flush()
+}
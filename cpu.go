@@ -6,6 +6,7 @@ package virtual
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"go/token"
 	"io"
@@ -14,6 +15,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"sync/atomic"
 	"syscall"
 	"text/tabwriter"
 
@@ -21,6 +23,7 @@ import (
 	"unsafe"
 
 	"github.com/cznic/internal/buffer"
+	"github.com/cznic/ir"
 )
 
 var (
@@ -49,12 +52,19 @@ type cpu struct {
 	jmpBuf
 
 	code    []Operation
-	ds      uintptr // Data segment
+	cover   []*uint64       // Of code.
+	ctx     context.Context // Context of the current New or FFI call, if any.
+	ctxDone <-chan struct{} // ctx.Done()
+	ds      uintptr         // Data segment
+	fueled  uint64          // Value of rtdsc when the fuel was last charged.
+	hooks   bool            // The debugger or coverage is active, see refresh.
 	fpStack []uintptr
 	ip0     uintptr // Last instruction fetched
 	m       *Machine
 	rpStack []uintptr
 	rtdsc   uint64
+	sandbox *sandbox // Of the machine, see refresh.
+	step    stepper
 	stop    chan struct{}
 	thread  *Thread
 	tls     uintptr
@@ -62,7 +72,7 @@ type cpu struct {
 	ts      uintptr // Text segment
 }
 
-func addPtr(p uintptr, v uintptr)          { *(*uintptr)(unsafe.Pointer(p)) += v }
+func addPtr(p uintptr, v uintptr)          { *(*uintptr)(memW(p, ptrSize)) += v }
 func popF64(p uintptr) (uintptr, float64)  { return p + f64StackSz, readF64(p) }
 func popI32(p uintptr) (uintptr, int32)    { return p + i32StackSz, readI32(p) }
 func popI64(p uintptr) (uintptr, int64)    { return p + i64StackSz, readI64(p) }
@@ -70,35 +80,35 @@ func popLong(p uintptr) (uintptr, int64)   { return p + longStackSz, readLong(p)
 func popPtr(p uintptr) (uintptr, uintptr)  { return p + ptrStackSz, readPtr(p) }
 func popU32(p uintptr) (uintptr, uint32)   { return p + i32StackSz, readU32(p) }
 func popULong(p uintptr) (uintptr, uint64) { return p + longStackSz, readULong(p) }
-func readC128(p uintptr) complex128        { return *(*complex128)(unsafe.Pointer(p)) }
-func readC64(p uintptr) complex64          { return *(*complex64)(unsafe.Pointer(p)) }
-func readF32(p uintptr) float32            { return *(*float32)(unsafe.Pointer(p)) }
-func readF64(p uintptr) float64            { return *(*float64)(unsafe.Pointer(p)) }
-func readI16(p uintptr) int16              { return *(*int16)(unsafe.Pointer(p)) }
-func readI32(p uintptr) int32              { return *(*int32)(unsafe.Pointer(p)) }
-func readI64(p uintptr) int64              { return *(*int64)(unsafe.Pointer(p)) }
-func readI8(p uintptr) int8                { return *(*int8)(unsafe.Pointer(p)) }
-func readPtr(p uintptr) uintptr            { return *(*uintptr)(unsafe.Pointer(p)) }
-func readU16(p uintptr) uint16             { return *(*uint16)(unsafe.Pointer(p)) }
-func readU32(p uintptr) uint32             { return *(*uint32)(unsafe.Pointer(p)) }
-func readU64(p uintptr) uint64             { return *(*uint64)(unsafe.Pointer(p)) }
-func readU8(p uintptr) uint8               { return *(*uint8)(unsafe.Pointer(p)) }
-func writeC128(p uintptr, v complex128)    { *(*complex128)(unsafe.Pointer(p)) = v }
-func writeC64(p uintptr, v complex64)      { *(*complex64)(unsafe.Pointer(p)) = v }
-func writeF32(p uintptr, v float32)        { *(*float32)(unsafe.Pointer(p)) = v }
-func writeF64(p uintptr, v float64)        { *(*float64)(unsafe.Pointer(p)) = v }
-func writeI16(p uintptr, v int16)          { *(*int16)(unsafe.Pointer(p)) = v }
-func writeI32(p uintptr, v int32)          { *(*int32)(unsafe.Pointer(p)) = v }
-func writeI64(p uintptr, v int64)          { *(*int64)(unsafe.Pointer(p)) = v }
-func writeI8(p uintptr, v int8)            { *(*int8)(unsafe.Pointer(p)) = v }
-func writePtr(p uintptr, v uintptr)        { *(*uintptr)(unsafe.Pointer(p)) = v }
-func writeU16(p uintptr, v uint16)         { *(*uint16)(unsafe.Pointer(p)) = v }
-func writeU32(p uintptr, v uint32)         { *(*uint32)(unsafe.Pointer(p)) = v }
-func writeU64(p uintptr, v uint64)         { *(*uint64)(unsafe.Pointer(p)) = v }
-func writeU8(p uintptr, v uint8)           { *(*uint8)(unsafe.Pointer(p)) = v }
+func readC128(p uintptr) complex128        { return *(*complex128)(memR(p, 16)) }
+func readC64(p uintptr) complex64          { return *(*complex64)(memR(p, 8)) }
+func readF32(p uintptr) float32            { return *(*float32)(memR(p, 4)) }
+func readF64(p uintptr) float64            { return *(*float64)(memR(p, 8)) }
+func readI16(p uintptr) int16              { return *(*int16)(memR(p, 2)) }
+func readI32(p uintptr) int32              { return *(*int32)(memR(p, 4)) }
+func readI64(p uintptr) int64              { return *(*int64)(memR(p, 8)) }
+func readI8(p uintptr) int8                { return *(*int8)(memR(p, 1)) }
+func readPtr(p uintptr) uintptr            { return *(*uintptr)(memR(p, ptrSize)) }
+func readU16(p uintptr) uint16             { return *(*uint16)(memR(p, 2)) }
+func readU32(p uintptr) uint32             { return *(*uint32)(memR(p, 4)) }
+func readU64(p uintptr) uint64             { return *(*uint64)(memR(p, 8)) }
+func readU8(p uintptr) uint8               { return *(*uint8)(memR(p, 1)) }
+func writeC128(p uintptr, v complex128)    { *(*complex128)(memW(p, 16)) = v }
+func writeC64(p uintptr, v complex64)      { *(*complex64)(memW(p, 8)) = v }
+func writeF32(p uintptr, v float32)        { *(*float32)(memW(p, 4)) = v }
+func writeF64(p uintptr, v float64)        { *(*float64)(memW(p, 8)) = v }
+func writeI16(p uintptr, v int16)          { *(*int16)(memW(p, 2)) = v }
+func writeI32(p uintptr, v int32)          { *(*int32)(memW(p, 4)) = v }
+func writeI64(p uintptr, v int64)          { *(*int64)(memW(p, 8)) = v }
+func writeI8(p uintptr, v int8)            { *(*int8)(memW(p, 1)) = v }
+func writePtr(p uintptr, v uintptr)        { *(*uintptr)(memW(p, ptrSize)) = v }
+func writeU16(p uintptr, v uint16)         { *(*uint16)(memW(p, 2)) = v }
+func writeU32(p uintptr, v uint32)         { *(*uint32)(memW(p, 4)) = v }
+func writeU64(p uintptr, v uint64)         { *(*uint64)(memW(p, 8)) = v }
+func writeU8(p uintptr, v uint8)           { *(*uint8)(memW(p, 1)) = v }
 
-func (c *cpu) fn() *PCInfo   { return pcInfo(int(c.ip0), c.m.functions) }
-func (c *cpu) line() *PCInfo { return pcInfo(int(c.ip0), c.m.lines) }
+func (c *cpu) fn() *PCInfo   { return pcInfo(int(c.ip0), c.m.image().functions) }
+func (c *cpu) line() *PCInfo { return pcInfo(int(c.ip0), c.m.image().lines) }
 
 func (c *cpu) pos() string {
 	f := c.fn()
@@ -116,6 +126,9 @@ func (c *cpu) bool(b bool) {
 }
 
 func (c *cpu) builtin(f func()) {
+	if c.sandbox != nil {
+		f = c.sandboxed(c.code[c.ip0].Opcode, f)
+	}
 	f()
 	n := len(c.rpStack)
 	c.sp = c.rp
@@ -123,6 +136,14 @@ func (c *cpu) builtin(f func()) {
 	c.rpStack = c.rpStack[:n-1]
 }
 
+// setContext makes c watch ctx and returns a function restoring the previous
+// state.
+func (c *cpu) setContext(ctx context.Context) func() {
+	ctx0, done0 := c.ctx, c.ctxDone
+	c.ctx, c.ctxDone = ctx, ctx.Done()
+	return func() { c.ctx, c.ctxDone = ctx0, done0 }
+}
+
 func (c *cpu) setErrno(err interface{}) {
 	switch x := err.(type) {
 	case int:
@@ -131,6 +152,17 @@ func (c *cpu) setErrno(err interface{}) {
 		c.setErrno(x.Err)
 	case syscall.Errno:
 		writeI32(c.tls+unsafe.Offsetof(tls{}.errno), int32(x))
+	case error:
+		switch {
+		case os.IsNotExist(x):
+			c.setErrno(syscall.ENOENT)
+		case os.IsExist(x):
+			c.setErrno(syscall.EEXIST)
+		case os.IsPermission(x):
+			c.setErrno(syscall.EACCES)
+		default:
+			c.setErrno(syscall.EIO)
+		}
 	default:
 		panic(fmt.Errorf("TODO %T(%#v)", x, x))
 	}
@@ -150,8 +182,8 @@ func (c *cpu) stackTrace() (err error) {
 	sp := c.sp
 	ap := c.ap
 	for ip < uintptr(len(c.code)) {
-		fi := c.m.pcInfo(int(ip), c.m.functions)
-		li := c.m.pcInfo(int(ip), c.m.lines)
+		fi := c.m.pcInfo(int(ip), c.m.image().functions)
+		li := c.m.pcInfo(int(ip), c.m.image().lines)
 		switch p := li.Position(); {
 		case p.IsValid():
 			fmt.Fprintf(&buf, "%s.%s(", p.Filename, dict.S(int(fi.Name)))
@@ -187,6 +219,10 @@ func (c *cpu) stackTrace() (err error) {
 		default:
 			dumpCode(&buf, c.code[ip:ip+1], int(ip), nil, nil)
 		}
+		if bp < c.thread.ss || bp >= c.thread.ss+uintptr(len(c.thread.stackMem)) {
+			break
+		}
+
 		sp = bp
 		bp = readPtr(sp)
 		sp += ptrStackSz
@@ -208,7 +244,19 @@ func (c *cpu) trace(w io.Writer) {
 	for h < uintptr(len(c.code)) && c.code[h].Opcode == Ext {
 		h++
 	}
-	w.Write(dumpCodeStr(c.code[c.ip:h], int(c.ip), c.m.functions, c.m.lines))
+	w.Write(dumpCodeStr(c.code[c.ip:h], int(c.ip), c.m.image().functions, c.m.image().lines))
+}
+
+// refresh updates the code of c to the current image of the machine. Code of
+// a library loaded by dlopen can be entered only via a function pointer, so
+// it's enough to refresh in run and CallFP. Refresh also caches the optional
+// features checked by the CPU loop.
+func (c *cpu) refresh() {
+	img := c.m.image()
+	c.code = img.code
+	c.cover = img.cover
+	c.hooks = c.m.debugger != nil || c.cover != nil
+	c.sandbox = c.m.sandbox
 }
 
 func (c *cpu) run(ip uintptr) (exitStatus int, err error) {
@@ -220,47 +268,88 @@ func (c *cpu) run(ip uintptr) (exitStatus int, err error) {
 		defer tracew.Flush()
 
 	}
-	c.code = c.m.code
+	c.refresh()
 	c.ip = ip
 	//fmt.Printf("%#v\n", c)
 	defer func() {
+		c.m.burn(int64(c.rtdsc - c.fueled))
+		c.fueled = c.rtdsc
 		if e := recover(); e != nil && err == nil {
+			switch x := e.(type) {
+			case HeapError, MemoryFault:
+				err = fmt.Errorf("%v\nrtdsc %#x, last instruction fetch: %#05x\t%s\n%s", x, c.rtdsc, c.ip0, c.pos(), c.stackTrace())
+				return
+			}
+
 			err = fmt.Errorf("PANIC: %v\nrtdsc %#x, last instruction fetch: %#05x\t%s\n%s\n%s", e, c.rtdsc, c.ip0, c.pos(), c.stackTrace(), debug.Stack())
 		}
 	}()
 
 	for ; ; c.rtdsc++ {
 		if c.rtdsc%1024 == 0 {
+			if c.m.det != nil && c.rtdsc != 0 {
+				atomic.AddInt64(&c.m.cycles, 1024)
+			}
+
 			select {
 			case <-c.m.stop:
 				return -1, KillError{}
+			case <-c.ctxDone:
+				return -1, ContextError{c.ctx.Err()}
 			default:
 			}
+
+			// Charge the instructions executed since the last check.
+			n := c.rtdsc - c.fueled
+			c.fueled = c.rtdsc
+			if !c.m.burn(int64(n)) {
+				return -1, OutOfFuelError{}
+			}
 		}
 
 		if trace {
 			c.trace(tracew)
 		}
+		if c.hooks {
+			if c.m.debugger != nil {
+				if err := c.debug(); err != nil {
+					return -1, err
+				}
+			}
+			if c.cover != nil {
+				atomic.AddUint64(c.cover[c.ip], 1)
+			}
+		}
 		op := c.code[c.ip]
 		c.ip0 = c.ip
 		if profile {
 			if c.m.ProfileRate == 0 || c.rtdsc%uint64(c.m.ProfileRate) == 0 {
+				var stack string
+				if c.m.profileStacks != nil {
+					stack = c.callers()
+				}
+				c.m.profileMu.Lock()
 				if c.m.ProfileFunctions != nil {
-					nfo := *c.m.pcInfo(int(c.ip), c.m.functions)
+					nfo := *c.m.pcInfo(int(c.ip), c.m.image().functions)
 					nfo.PC = 0
 					c.m.ProfileFunctions[nfo]++
 				}
 				if c.m.ProfileLines != nil {
-					nfo := *c.m.pcInfo(int(c.ip), c.m.lines)
+					nfo := *c.m.pcInfo(int(c.ip), c.m.image().lines)
 					nfo.PC = 0
 					c.m.ProfileLines[nfo]++
 				}
 				if c.m.ProfileInstructions != nil {
 					c.m.ProfileInstructions[op.Opcode]++
 				}
+				if c.m.profileStacks != nil {
+					c.m.profileStacks[stack]++
+				}
+				c.m.profileMu.Unlock()
 			}
 		}
 		c.ip++
+
 	main:
 		switch op.Opcode {
 		case AP: // -> ptr
@@ -394,6 +483,9 @@ func (c *cpu) run(ip uintptr) (exitStatus int, err error) {
 			n := len(c.fpStack)
 			c.ip = c.fpStack[n-1]
 			c.fpStack = c.fpStack[:n-1]
+			if c.ip >= uintptr(len(c.code)) { // Loaded by dlopen after c.refresh.
+				c.refresh()
+			}
 		case ConvC64C128:
 			v := readC64(c.sp)
 			c.sp -= c128StackSz - c64StackSz
@@ -1619,7 +1711,7 @@ func (c *cpu) run(ip uintptr) (exitStatus int, err error) {
 
 			return 1, c.stackTrace()
 		case exit:
-			return int(readI32(c.sp)), nil
+			return c.exit(int(readI32(c.sp)))
 		case builtin:
 			var ip uintptr
 			c.sp, ip = popPtr(c.sp)
@@ -1767,6 +1859,8 @@ func (c *cpu) run(ip uintptr) (exitStatus int, err error) {
 			c.builtin(c.memmove)
 		case qsort:
 			c.builtin(c.qsort)
+		case atexit:
+			c.builtin(c.atexit)
 		case setjmp:
 			c.builtin(c.setjmp)
 		case longjmp:
@@ -1857,10 +1951,18 @@ func (c *cpu) run(ip uintptr) (exitStatus int, err error) {
 			c.builtin(c.pthreadSelf)
 		case pthread_equal:
 			c.builtin(c.pthreadEqual)
+		case pthread_create:
+			c.builtin(c.pthreadCreate)
+		case pthread_join:
+			c.builtin(c.pthreadJoin)
+		case pthread_detach:
+			c.builtin(c.pthreadDetach)
 		case pthread_mutex_trylock:
 			c.builtin(c.pthreadMutexTryLock)
 		case gettimeofday:
 			c.builtin(c.gettimeofday)
+		case utimes:
+			c.builtin(c.utimes)
 		case ftruncate64:
 			c.builtin(c.ftruncate64)
 		case getenv:
@@ -1875,6 +1977,22 @@ func (c *cpu) run(ip uintptr) (exitStatus int, err error) {
 			c.builtin(c.munmap)
 		case usleep:
 			c.builtin(c.usleep)
+		case sleep:
+			c.builtin(c.sleep)
+		case time:
+			c.builtin(c.time)
+		case localtime:
+			c.builtin(c.localtime)
+		case random:
+			c.builtin(c.random)
+		case dlclose:
+			c.builtin(c.dlclose)
+		case dlerror:
+			c.builtin(c.dlerror)
+		case dlopen:
+			c.builtin(c.dlopen)
+		case dlsym:
+			c.builtin(c.dlsym)
 		case select_:
 			c.builtin(c.select_)
 		case recv:
@@ -1923,6 +2041,28 @@ func (c *cpu) run(ip uintptr) (exitStatus int, err error) {
 			c.builtin(c.fflush)
 		case getchar:
 			c.builtin(c.getchar)
+		case fscanf:
+			c.builtin(c.fscanf)
+		case scanf:
+			c.builtin(c.scanf)
+		case sscanf:
+			c.builtin(c.sscanf)
+		case vfscanf:
+			c.builtin(c.vfscanf)
+		case vscanf:
+			c.builtin(c.vscanf)
+		case vsscanf:
+			c.builtin(c.vsscanf)
+		case mkdir:
+			c.builtin(c.mkdir)
+		case readlink:
+			c.builtin(c.readlink)
+		case rmdir:
+			c.builtin(c.rmdir)
+		case hostFunction:
+			if err := c.hostFunction(ir.NameID(op.N)); err != nil {
+				return -1, err
+			}
 
 		// windows
 		case AreFileApisANSI:
@@ -9,7 +9,6 @@ package virtual
 
 import (
 	"math"
-	"unsafe"
 )
 
 const (
@@ -27,7 +26,7 @@ func (c *cpu) pushC128(n, m int) {
 	c.ip++
 }
 
-func readLong(p uintptr) int64       { return *(*int64)(unsafe.Pointer(p)) }
-func readULong(p uintptr) uint64     { return *(*uint64)(unsafe.Pointer(p)) }
-func writeLong(p uintptr, v int64)   { *(*int64)(unsafe.Pointer(p)) = v }
-func writeULong(p uintptr, v uint64) { *(*uint64)(unsafe.Pointer(p)) = v }
+func readLong(p uintptr) int64       { return *(*int64)(memR(p, 8)) }
+func readULong(p uintptr) uint64     { return *(*uint64)(memR(p, 8)) }
+func writeLong(p uintptr, v int64)   { *(*int64)(memW(p, 8)) = v }
+func writeULong(p uintptr, v uint64) { *(*uint64)(memW(p, 8)) = v }
@@ -8,7 +8,6 @@ package virtual
 
 import (
 	"math"
-	"unsafe"
 )
 
 const (
@@ -26,15 +25,15 @@ func (c *cpu) pushC128(n, m int) {
 	c.ip++
 }
 
-func readLong(p uintptr) int64   { return int64(*(*int32)(unsafe.Pointer(p))) }
-func readULong(p uintptr) uint64 { return uint64(*(*uint32)(unsafe.Pointer(p))) }
+func readLong(p uintptr) int64   { return int64(*(*int32)(memR(p, 4))) }
+func readULong(p uintptr) uint64 { return uint64(*(*uint32)(memR(p, 4))) }
 
 func writeLong(p uintptr, v int64) {
 	if v < math.MinInt32 || v > math.MaxInt32 {
 		panic("size_t overflow")
 	}
 
-	*(*int32)(unsafe.Pointer(p)) = int32(v)
+	*(*int32)(memW(p, 4)) = int32(v)
 }
 
 func writeULong(p uintptr, v uint64) {
@@ -42,5 +41,5 @@ func writeULong(p uintptr, v uint64) {
 		panic("size_t overflow")
 	}
 
-	*(*uint32)(unsafe.Pointer(p)) = uint32(v)
+	*(*uint32)(memW(p, 4)) = uint32(v)
 }
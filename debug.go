@@ -0,0 +1,389 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"go/token"
+	"io"
+	"math"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/cznic/ir"
+)
+
+// DebugCommand determines how a thread stopped by a Debugger continues.
+type DebugCommand int
+
+// Values of DebugCommand.
+const (
+	DebugContinue DebugCommand = iota // Run until the next breakpoint.
+	DebugStepInto                     // Execute one instruction.
+	DebugStepOver                     // Execute one instruction, run called functions to completion.
+	DebugQuit                         // Kill the machine.
+)
+
+// DebugState describes a thread stopped by a Debugger.
+type DebugState struct {
+	AP         uintptr // Argument pointer.
+	BP         uintptr // Base (frame) pointer.
+	Breakpoint bool    // Stopped at a breakpoint, not after a step.
+	Function   string
+	Op         Operation // The instruction to execute next.
+	PC         int
+	Position   token.Position
+	SP         uintptr // Stack pointer.
+	Thread     *Thread
+}
+
+// Instruction returns the disassembled instruction at s.PC.
+func (s *DebugState) Instruction() string {
+	var buf bytes.Buffer
+	dumpCode(&buf, s.Thread.code[s.PC:s.PC+1], s.PC, nil, s.Thread.m.image().lines)
+	return strings.TrimSpace(buf.String())
+}
+
+// StackTrace returns the call stack of the stopped thread.
+func (s *DebugState) StackTrace() string {
+	t := s.Thread
+	ip := t.ip
+	t.ip++ // stackTrace expects the instruction already fetched.
+	old := debug.SetPanicOnFault(true)
+	r := t.stackTrace().Error()
+	debug.SetPanicOnFault(old)
+	t.ip = ip
+	return r
+}
+
+// Debugger controls the execution of a machine using breakpoints and
+// single-stepping. It is attached to a machine using the Debug option.
+type Debugger struct {
+	// OnStop is called when a thread stops at a breakpoint or after a
+	// step. Its result determines how the thread continues. Calls of
+	// OnStop are serialized. A nil OnStop is equivalent to always
+	// returning DebugContinue.
+	OnStop func(*DebugState) DebugCommand
+
+	b           *Binary
+	breakpoints atomic.Value // map[int]struct{}
+	mu          sync.Mutex   // Serializes breakpoint updates.
+	stopMu      sync.Mutex   // Serializes OnStop calls.
+}
+
+// NewDebugger returns a newly created Debugger for programs loaded from b.
+func NewDebugger(b *Binary) *Debugger {
+	d := &Debugger{b: b}
+	d.breakpoints.Store(map[int]struct{}{})
+	return d
+}
+
+func (d *Debugger) update(f func(map[int]struct{})) {
+	d.mu.Lock()
+	m := map[int]struct{}{}
+	for k := range d.breakpoints.Load().(map[int]struct{}) {
+		m[k] = struct{}{}
+	}
+	f(m)
+	d.breakpoints.Store(m)
+	d.mu.Unlock()
+}
+
+// SetBreakpoint sets a breakpoint at pc.
+func (d *Debugger) SetBreakpoint(pc int) {
+	d.update(func(m map[int]struct{}) { m[pc] = struct{}{} })
+}
+
+// ClearBreakpoint removes the breakpoint at pc, if any.
+func (d *Debugger) ClearBreakpoint(pc int) {
+	d.update(func(m map[int]struct{}) { delete(m, pc) })
+}
+
+// Breakpoints returns the sorted PCs of all breakpoints.
+func (d *Debugger) Breakpoints() []int {
+	var r []int
+	for k := range d.breakpoints.Load().(map[int]struct{}) {
+		r = append(r, k)
+	}
+	sort.Ints(r)
+	return r
+}
+
+// BreakFunction sets a breakpoint after the prologue of every function named
+// name and returns the PCs of the breakpoints.
+func (d *Debugger) BreakFunction(name string) ([]int, error) {
+	nm := ir.NameID(dict.SID(name))
+	var r []int
+	for _, v := range d.b.Functions {
+		if v.Name == nm {
+			r = append(r, v.PC+1)
+		}
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("function not found: %s", name)
+	}
+
+	d.update(func(m map[int]struct{}) {
+		for _, v := range r {
+			m[v] = struct{}{}
+		}
+	})
+	return r, nil
+}
+
+// BreakLine sets a breakpoint at the code of file:line and returns the PCs of
+// the breakpoints. File matches any source file having the same name or a
+// path ending in file.
+func (d *Debugger) BreakLine(file string, line int) ([]int, error) {
+	var r []int
+	for _, v := range d.b.Lines {
+		if v.Line != line {
+			continue
+		}
+
+		if fn := string(dict.S(int(v.Name))); fn == file || strings.HasSuffix(fn, string(filepath.Separator)+file) {
+			r = append(r, v.PC)
+		}
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("no code for %s:%v", file, line)
+	}
+
+	d.update(func(m map[int]struct{}) {
+		for _, v := range r {
+			m[v] = struct{}{}
+		}
+	})
+	return r, nil
+}
+
+// stepper is the single-stepping state of a cpu.
+type stepper struct {
+	bp   uintptr
+	cmd  DebugCommand
+	next uintptr // DebugStepOver: Instruction after the call.
+}
+
+// debug checks whether c must stop before executing the instruction at c.ip
+// and if so, calls the OnStop handler of the debugger.
+func (c *cpu) debug() error {
+	d := c.m.debugger
+	var stop bool
+	switch c.step.cmd {
+	case DebugStepInto:
+		stop = true
+	case DebugStepOver:
+		stop = c.ip == c.step.next && c.bp == c.step.bp
+	}
+	_, bp := d.breakpoints.Load().(map[int]struct{})[int(c.ip)]
+	if !stop && !bp {
+		return nil
+	}
+
+	c.step = stepper{}
+	if d.OnStop == nil {
+		return nil
+	}
+
+	op := c.code[c.ip]
+	s := &DebugState{
+		AP:         c.ap,
+		BP:         c.bp,
+		Breakpoint: bp,
+		Function:   string(dict.S(int(c.m.pcInfo(int(c.ip), c.m.image().functions).Name))),
+		Op:         op,
+		PC:         int(c.ip),
+		Position:   c.m.pcInfo(int(c.ip), c.m.image().lines).Position(),
+		SP:         c.sp,
+		Thread:     c.thread,
+	}
+	d.stopMu.Lock()
+	cmd := d.OnStop(s)
+	d.stopMu.Unlock()
+	switch cmd {
+	case DebugContinue:
+		// nop
+	case DebugStepInto:
+		c.step.cmd = cmd
+	case DebugStepOver:
+		switch op.Opcode {
+		case Call, CallFP:
+			next := c.ip + 1
+			for next < uintptr(len(c.code)) && c.code[next].Opcode == Ext {
+				next++
+			}
+			c.step = stepper{bp: c.bp, cmd: cmd, next: next}
+		default:
+			c.step.cmd = DebugStepInto
+		}
+	case DebugQuit:
+		c.m.Kill()
+		return KillError{}
+	default:
+		return fmt.Errorf("invalid debug command: %v", cmd)
+	}
+	return nil
+}
+
+// ReadMemory returns a copy of n bytes of memory at address p. Invalid
+// addresses are reported as errors.
+func (m *Machine) ReadMemory(p uintptr, n int) (b []byte, err error) {
+	if n < 0 || n > math.MaxInt32 {
+		return nil, fmt.Errorf("ReadMemory: invalid size %v", n)
+	}
+
+	old := debug.SetPanicOnFault(true)
+	defer func() {
+		debug.SetPanicOnFault(old)
+		if e := recover(); e != nil {
+			b = nil
+			err = fmt.Errorf("ReadMemory(%#x, %v): %v", p, n, e)
+		}
+	}()
+
+	b = make([]byte, n)
+	if n != 0 {
+		copy(b, (*[math.MaxInt32]byte)(unsafe.Pointer(p))[:n])
+	}
+	return b, nil
+}
+
+const replHelp = `Commands:
+  b file:line | function | pc	set breakpoint
+  bl				list breakpoints
+  bt				print stack trace
+  c				continue
+  d pc				delete breakpoint
+  f				print frame pointers
+  h				help
+  n				step over
+  q				quit (kill the machine)
+  s				step into
+  x addr [n]			dump n (default 64) bytes of memory at addr
+An empty line repeats the last step or continue command.
+`
+
+// REPL returns an OnStop handler which reads debugger commands from in and
+// writes the results to out. Use "h" to list the commands. End of input
+// quits.
+func (d *Debugger) REPL(in io.Reader, out io.Writer) func(*DebugState) DebugCommand {
+	scanner := bufio.NewScanner(in)
+	last := ""
+	return func(s *DebugState) DebugCommand {
+		fmt.Fprintf(out, "%s %s\n", s.Function, s.Instruction())
+		for {
+			fmt.Fprint(out, "(vdb) ")
+			if !scanner.Scan() {
+				fmt.Fprintln(out)
+				return DebugQuit
+			}
+
+			f := strings.Fields(scanner.Text())
+			if len(f) == 0 {
+				if last == "" {
+					continue
+				}
+
+				f = []string{last}
+			}
+			switch f[0] {
+			case "b":
+				if len(f) != 2 {
+					fmt.Fprintln(out, "usage: b file:line | function | pc")
+					break
+				}
+
+				pcs, err := d.replBreak(f[1])
+				if err != nil {
+					fmt.Fprintln(out, err)
+					break
+				}
+
+				for _, v := range pcs {
+					fmt.Fprintf(out, "breakpoint at %#05x\t; %v\n", v, pcInfo(v, d.b.Lines).Position())
+				}
+			case "bl":
+				for _, v := range d.Breakpoints() {
+					fmt.Fprintf(out, "%#05x\t; %v\n", v, pcInfo(v, d.b.Lines).Position())
+				}
+			case "bt":
+				fmt.Fprint(out, s.StackTrace())
+			case "c":
+				last = f[0]
+				return DebugContinue
+			case "d":
+				pc, err := strconv.ParseUint(f[len(f)-1], 0, 63)
+				if len(f) != 2 || err != nil {
+					fmt.Fprintln(out, "usage: d pc")
+					break
+				}
+
+				d.ClearBreakpoint(int(pc))
+			case "f":
+				fmt.Fprintf(out, "ap %#x bp %#x sp %#x\n", s.AP, s.BP, s.SP)
+			case "h":
+				fmt.Fprint(out, replHelp)
+			case "n":
+				last = f[0]
+				return DebugStepOver
+			case "q":
+				return DebugQuit
+			case "s":
+				last = f[0]
+				return DebugStepInto
+			case "x":
+				n := uint64(64)
+				p, err := strconv.ParseUint(f[len(f)-1], 0, 64)
+				if len(f) == 3 {
+					p, err = strconv.ParseUint(f[1], 0, 64)
+					if err == nil {
+						n, err = strconv.ParseUint(f[2], 0, 31)
+					}
+				}
+				if len(f) < 2 || len(f) > 3 || err != nil {
+					fmt.Fprintln(out, "usage: x addr [n]")
+					break
+				}
+
+				b, err := s.Thread.m.ReadMemory(uintptr(p), int(n))
+				if err != nil {
+					fmt.Fprintln(out, err)
+					break
+				}
+
+				fmt.Fprint(out, hex.Dump(b))
+			default:
+				fmt.Fprintf(out, "unknown command: %s\n", f[0])
+			}
+		}
+	}
+}
+
+func (d *Debugger) replBreak(s string) ([]int, error) {
+	if i := strings.LastIndexByte(s, ':'); i > 0 {
+		line, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return nil, err
+		}
+
+		return d.BreakLine(s[:i], line)
+	}
+
+	if pc, err := strconv.ParseUint(s, 0, 63); err == nil {
+		d.SetBreakpoint(int(pc))
+		return []int{int(pc)}, nil
+	}
+
+	return d.BreakFunction(s)
+}
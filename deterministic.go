@@ -0,0 +1,151 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"sync"
+	"sync/atomic"
+	tim "time"
+
+	"github.com/cznic/ccir/libc/stdlib"
+	"github.com/cznic/mathutil"
+)
+
+// DeterministicConfig configures the Deterministic option.
+type DeterministicConfig struct {
+	Hostname string       // Result of gethostname. Empty means "localhost".
+	PID      int          // Result of getpid. Zero means 1.
+	Seed     int64        // Seed of random.
+	Start    tim.Time     // Time when the machine starts. Zero means the Unix epoch.
+	Tick     tim.Duration // Time per executed instruction. Zero means 1ns.
+}
+
+// Deterministic makes the programs of a machine independent of the host
+// state: The clock seen by time, gettimeofday and localtime starts at
+// cfg.Start and advances only with the number of executed instructions and by
+// the sleep functions, which do not block. The time zone is UTC. Random
+// uses its own generator seeded with cfg.Seed. Getpid and gethostname return
+// cfg.PID and cfg.Hostname.
+//
+// Programs of a single thread having the same input produce the same output
+// on every run. The clock is shared by all threads of the machine, but it's
+// advanced in batches of 1024 instructions, so the time seen by programs of
+// more threads depends on their scheduling.
+func Deterministic(cfg DeterministicConfig) Option {
+	return func(o *options) error {
+		d := &determinism{
+			hostname: cfg.Hostname,
+			pid:      int32(cfg.PID),
+			seed:     cfg.Seed,
+			tick:     int64(cfg.Tick),
+		}
+		if err := d.seedPRNG(); err != nil {
+			return err
+		}
+
+		if d.hostname == "" {
+			d.hostname = "localhost"
+		}
+		if d.pid == 0 {
+			d.pid = 1
+		}
+		if !cfg.Start.IsZero() {
+			d.start = cfg.Start.UnixNano()
+		}
+		if d.tick == 0 {
+			d.tick = 1
+		}
+		o.det = d
+		return nil
+	}
+}
+
+type determinism struct {
+	hostname string
+	pid      int32
+	prng     *mathutil.FC32
+	prngMu   sync.Mutex
+	seed     int64
+	slept    int64 // Nanoseconds. Atomic.
+	start    int64 // Unix nanoseconds.
+	tick     int64 // Nanoseconds per instruction.
+}
+
+func (d *determinism) seedPRNG() (err error) {
+	if d.prng, err = mathutil.NewFC32(0, stdlib.XRAND_MAX, true); err != nil {
+		return err
+	}
+
+	d.prng.Seed(d.seed)
+	return nil
+}
+
+// clone returns a copy of d having the random generator reset.
+func (d *determinism) clone() (*determinism, error) {
+	r := &determinism{
+		hostname: d.hostname,
+		pid:      d.pid,
+		seed:     d.seed,
+		slept:    atomic.LoadInt64(&d.slept),
+		start:    d.start,
+		tick:     d.tick,
+	}
+	if err := r.seedPRNG(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// now returns the current time as seen by the program. In the deterministic
+// mode the clock counts the instructions executed by all threads in completed
+// batches of 1024, see m.cycles, plus the instructions executed by c in its
+// current batch. The clock never goes back for a single thread, but threads
+// running concurrently can see slightly different times, depending on their
+// scheduling.
+func (c *cpu) now() tim.Time {
+	d := c.m.det
+	if d == nil {
+		return tim.Now()
+	}
+
+	n := atomic.LoadInt64(&c.m.cycles) + int64(c.rtdsc%1024)
+	return tim.Unix(0, d.start+n*d.tick+atomic.LoadInt64(&d.slept)).UTC()
+}
+
+// location returns the time zone of the program.
+func (c *cpu) location() *tim.Location {
+	if c.m.det != nil {
+		return tim.UTC
+	}
+
+	return tim.Local
+}
+
+// sleepFor suspends c for d. In the deterministic mode only the clock of the
+// machine advances.
+func (c *cpu) sleepFor(d tim.Duration) {
+	if det := c.m.det; det != nil {
+		atomic.AddInt64(&det.slept, int64(d))
+		return
+	}
+
+	tim.Sleep(d)
+}
+
+// rand returns the next value of the random generator of the program.
+func (c *cpu) rand() int {
+	if d := c.m.det; d != nil {
+		d.prngMu.Lock()
+		r := d.prng.Next()
+		d.prngMu.Unlock()
+		return r
+	}
+
+	prngMu.Lock()
+	r := prng.Next()
+	prngMu.Unlock()
+	return r
+}
@@ -4,6 +4,15 @@
 
 package virtual
 
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/cznic/ir"
+	"github.com/edsrzf/mmap-go"
+)
+
 func init() {
 	registerBuiltins(map[int]Opcode{
 		dict.SID("dlclose"): dlclose,
@@ -12,3 +21,346 @@ func init() {
 		dict.SID("dlsym"):   dlsym,
 	})
 }
+
+// library is a Binary loaded by dlopen.
+type library struct {
+	dsMem  mmap.MMap
+	handle uintptr
+	path   string // Empty for the program.
+	refs   int
+	sym    map[ir.NameID]int // Code index of the FFI prolog.
+	tsMem  mmap.MMap
+}
+
+// relocateData adjusts the pointers in the data segment at ds of b, having
+// its text segment at ts.
+func relocateData(b *Binary, ds, ts uintptr) {
+	relocate(b.TSRelative, ds, ts)
+	relocate(b.DSRelative, ds, ds)
+}
+
+// relocate adds delta to the pointers at p marked in the bit vector bits.
+func relocate(bits []byte, p, delta uintptr) {
+	for i, v := range bits {
+		if v == 0 {
+			continue
+		}
+
+		mask := byte(1)
+		for bit := 0; bit < 8; bit++ {
+			if v&mask != 0 {
+				addPtr(p+uintptr(8*i+bit), delta)
+			}
+			mask <<= 1
+		}
+	}
+}
+
+// lookup returns the code index of the FFI prolog of the function nm exported
+// by the program or by a loaded library. Libraries are searched in the order
+// they were loaded. Must be called with libsMu locked.
+func (m *Machine) lookup(nm ir.NameID) (int, bool) {
+	if pc, ok := m.syms[nm]; ok {
+		return pc, true
+	}
+
+	for _, v := range m.libs {
+		if pc, ok := v.sym[nm]; ok {
+			return pc, true
+		}
+	}
+	return 0, false
+}
+
+// load appends the code of b to the code of m and maps the data and text
+// segments of b. External functions not defined in b, which are not builtins,
+// are bound to the functions exported by the program and the libraries
+// loaded before.
+func (m *Machine) load(b *Binary) (_ *library, err error) {
+	m.libsMu.Lock()
+	defer m.libsMu.Unlock()
+
+	lib := &library{sym: map[ir.NameID]int{}}
+	defer func() {
+		if err != nil {
+			lib.unmap()
+		}
+	}()
+
+	var ds, ts uintptr
+	if n := roundup(len(b.Data), mallocAlign) + roundup(b.BSS, mallocAlign); n != 0 {
+		if lib.dsMem, err = mmap.MapRegion(nil, roundup(n, mmapPage), mmap.RDWR, mmap.ANON, 0); err != nil {
+			return nil, fmt.Errorf("mmap data segment: %v", err)
+		}
+
+		copy(lib.dsMem, b.Data)
+		ds = uintptr(unsafe.Pointer(&lib.dsMem[0]))
+		if memcheck {
+			memMapAdd(m, ds, len(lib.dsMem), false)
+		}
+	}
+	if len(b.Text) != 0 {
+		if lib.tsMem, err = mmap.MapRegion(nil, roundup(len(b.Text), mmapPage), mmap.RDWR, mmap.ANON, 0); err != nil {
+			return nil, fmt.Errorf("mmap text segment: %v", err)
+		}
+
+		copy(lib.tsMem, b.Text)
+		ts = uintptr(unsafe.Pointer(&lib.tsMem[0]))
+		if memcheck {
+			memMapAdd(m, ts, len(lib.tsMem), true)
+		}
+	}
+	relocateData(b, ds, ts)
+
+	img := m.image()
+	base := len(img.code)
+	code := make([]Operation, base, base+len(b.Code))
+	copy(code, img.code)
+	code = append(code, b.Code...)
+	switches := map[int]bool{}
+	for i, v := range b.Code {
+		op := &code[base+i]
+		switch v.Opcode {
+		case Call, FP, Jmp, Jnz, Jz:
+			op.N += base
+		case Push32, Push64:
+			if bit(b.CodeCSRelative, i) {
+				op.N += base // Address of a label, see JmpP.
+			}
+		case DS, DSC128, DSI16, DSI32, DSI64, DSI8, DSN:
+			op.N += int(ds - m.ds)
+		case SwitchI32, SwitchI64:
+			if !switches[v.N] {
+				switches[v.N] = true
+				tab := ds + uintptr(v.N)
+				cases := uintptr(readI32(tab))
+				values := tab + i64Size
+				labels := values + cases*i64Size
+				if v.Opcode == SwitchI32 {
+					labels = roundupP(values+cases*i32Size, ptrSize)
+				}
+				for j := uintptr(0); j <= cases; j++ {
+					addPtr(labels+j*ptrSize, uintptr(base))
+				}
+			}
+			op.N += int(ds - m.ds)
+		case Text:
+			op.N += int(ts - m.ts)
+		case hostFunction:
+			if i != 0 && b.Code[i-1].Opcode == builtin {
+				if pc, ok := m.lookup(ir.NameID(v.N)); ok {
+					code[base+i-1] = Operation{Jmp, pc + ffiProlog}
+				}
+			}
+		}
+	}
+
+	relocate(b.CSRelative, ds, uintptr(base))
+	relocate(b.TextCSRelative, ts, uintptr(base))
+	for k, v := range b.Sym {
+		lib.sym[k] = v + base
+	}
+	m.addSignatures(b, base)
+	lines := append([]PCInfo(nil), img.lines...)
+	for _, v := range b.Lines {
+		v.PC += base
+		lines = append(lines, v)
+	}
+	functions := append([]PCInfo(nil), img.functions...)
+	for _, v := range b.Functions {
+		v.PC += base
+		functions = append(functions, v)
+	}
+	var cover []*uint64
+	if img.cover != nil {
+		cover = append(append([]*uint64(nil), img.cover...), newCover(len(b.Code))...)
+	}
+	m.img.Store(&image{code: code, cover: cover, functions: functions, lines: lines})
+	return lib, nil
+}
+
+func (l *library) unmap() (err error) {
+	if l.dsMem != nil {
+		if memcheck {
+			memMapRemove(uintptr(unsafe.Pointer(&l.dsMem[0])))
+		}
+		err = l.dsMem.Unmap()
+		l.dsMem = nil
+	}
+	if l.tsMem != nil {
+		if memcheck {
+			memMapRemove(uintptr(unsafe.Pointer(&l.tsMem[0])))
+		}
+		if e := l.tsMem.Unmap(); e != nil && err == nil {
+			err = e
+		}
+		l.tsMem = nil
+	}
+	return err
+}
+
+// dlfail records the error reported by dlerror.
+func (c *cpu) dlfail(format string, arg ...interface{}) {
+	c.m.libsMu.Lock()
+	c.m.dlErr = fmt.Sprintf(format, arg...)
+	c.m.libsMu.Unlock()
+}
+
+// int dlclose(void *handle);
+func (c *cpu) dlclose() {
+	handle := readPtr(c.sp)
+	m := c.m
+	m.libsMu.Lock()
+	var lib *library
+	for i, v := range m.libs {
+		if v.handle == handle {
+			lib = v
+			if v.refs--; v.refs == 0 {
+				m.libs = append(m.libs[:i], m.libs[i+1:]...)
+			}
+			break
+		}
+	}
+	m.libsMu.Unlock()
+	if strace {
+		fmt.Fprintf(os.Stderr, "dlclose(%#x)\t; %s\n", handle, c.pos())
+	}
+	if lib == nil {
+		c.dlfail("dlclose: invalid handle %#x", handle)
+		writeI32(c.rp, -1)
+		return
+	}
+
+	if lib.refs == 0 {
+		if err := lib.unmap(); err != nil {
+			c.dlfail("dlclose: %v", err)
+			writeI32(c.rp, -1)
+			return
+		}
+	}
+	writeI32(c.rp, 0)
+}
+
+// char *dlerror(void);
+func (c *cpu) dlerror() {
+	m := c.m
+	m.libsMu.Lock()
+	s := m.dlErr
+	m.dlErr = ""
+	if m.dlErrP != 0 {
+		m.free(m.dlErrP)
+		m.dlErrP = 0
+	}
+	if s != "" {
+		m.dlErrP = m.CString(s)
+	}
+	p := m.dlErrP
+	m.libsMu.Unlock()
+	writePtr(c.rp, p)
+}
+
+// void *dlopen(const char *filename, int flag);
+func (c *cpu) dlopen() {
+	sp, _ := popI32(c.sp)
+	filename := readPtr(sp)
+	var path string
+	if filename != 0 {
+		path = GoString(filename)
+	}
+	handle, err := c.dlopenPath(path)
+	if strace {
+		fmt.Fprintf(os.Stderr, "dlopen(%q) (%#x, %v)\t; %s\n", path, handle, err, c.pos())
+	}
+	if err != nil {
+		c.dlfail("%s: %v", path, err)
+	}
+	c.refresh()
+	writePtr(c.rp, handle)
+}
+
+func (c *cpu) dlopenPath(path string) (uintptr, error) {
+	m := c.m
+	// Loading a library twice would append its code twice and create two
+	// handles.
+	m.dlMu.Lock()
+	defer m.dlMu.Unlock()
+
+	m.libsMu.Lock()
+	for _, v := range m.libs {
+		if v.path == path {
+			v.refs++
+			m.libsMu.Unlock()
+			return v.handle, nil
+		}
+	}
+	m.libsMu.Unlock()
+
+	var lib *library
+	switch {
+	case path == "":
+		lib = &library{sym: m.syms}
+	default:
+		f, err := m.fs.OpenFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			return 0, err
+		}
+
+		var b Binary
+		_, err = b.ReadFrom(f)
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if err := b.checkPlatform(); err != nil {
+			return 0, err
+		}
+
+		if lib, err = m.load(&b); err != nil {
+			return 0, err
+		}
+	}
+
+	m.libsMu.Lock()
+	m.dlHandle++
+	lib.handle = m.dlHandle
+	lib.path = path
+	lib.refs = 1
+	m.libs = append(m.libs, lib)
+	m.libsMu.Unlock()
+	return lib.handle, nil
+}
+
+// void *dlsym(void *handle, const char *symbol);
+func (c *cpu) dlsym() {
+	sp, symbol := popPtr(c.sp)
+	handle := readPtr(sp)
+	nm := ir.NameID(dict.SID(GoString(symbol)))
+	m := c.m
+	m.libsMu.Lock()
+	pc, ok := 0, false
+	switch handle {
+	case 0: // RTLD_DEFAULT
+		pc, ok = m.lookup(nm)
+	default:
+		for _, v := range m.libs {
+			if v.handle == handle {
+				pc, ok = v.sym[nm]
+				break
+			}
+		}
+	}
+	m.libsMu.Unlock()
+	if strace {
+		fmt.Fprintf(os.Stderr, "dlsym(%#x, %q) (%#x, %v)\t; %s\n", handle, nm, pc, ok, c.pos())
+	}
+	if !ok {
+		c.dlfail("undefined symbol: %s", nm)
+		writePtr(c.rp, 0)
+		return
+	}
+
+	writePtr(c.rp, uintptr(pc+ffiProlog))
+}
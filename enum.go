@@ -539,4 +539,11 @@ const (
 	ungetc
 	memchr
 	perror
+	hostFunction // N: ir.NameID
+	fscanf
+	scanf
+	sscanf
+	vfscanf
+	vscanf
+	vsscanf
 )
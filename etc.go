@@ -16,14 +16,16 @@ import (
 )
 
 var (
-	idInt32  = ir.TypeID(dict.SID("int32"))
-	idInt32P = ir.TypeID(dict.SID("*int32"))
-	idInt64  = ir.TypeID(dict.SID("int64"))
-	idInt8P  = ir.TypeID(dict.SID("*int8"))
-	idStart  = ir.NameID(dict.SID("_start"))
-	idUint32 = ir.TypeID(dict.SID("uint32"))
-	idUint64 = ir.TypeID(dict.SID("uint64"))
-	idVoidP  = ir.TypeID(dict.SID("*struct{}"))
+	idInt32                  = ir.TypeID(dict.SID("int32"))
+	idInt32P                 = ir.TypeID(dict.SID("*int32"))
+	idInt64                  = ir.TypeID(dict.SID("int64"))
+	idInt8P                  = ir.TypeID(dict.SID("*int8"))
+	idLLVMFuzzerInitialize   = ir.NameID(dict.SID("LLVMFuzzerInitialize"))
+	idLLVMFuzzerTestOneInput = ir.NameID(dict.SID("LLVMFuzzerTestOneInput"))
+	idStart                  = ir.NameID(dict.SID("_start"))
+	idUint32                 = ir.TypeID(dict.SID("uint32"))
+	idUint64                 = ir.TypeID(dict.SID("uint64"))
+	idVoidP                  = ir.TypeID(dict.SID("*struct{}"))
 )
 
 // KillError is the error returned by the CPU of a killed machine.
@@ -32,6 +34,26 @@ type KillError struct{}
 // Error implements error.
 func (e KillError) Error() string { return "SIGKILL" }
 
+// ContextError is the error returned by the CPU when the context of an
+// operation, like NewContext, ExecContext or Thread.FFIContext, is done. Err is
+// the value of the context's Err method.
+type ContextError struct {
+	Err error
+}
+
+// Error implements error.
+func (e ContextError) Error() string { return e.Err.Error() }
+
+// Unwrap returns e.Err.
+func (e ContextError) Unwrap() error { return e.Err }
+
+// OutOfFuelError is the error returned by the CPU of a machine which exhausted
+// its instruction budget. See the Fuel option.
+type OutOfFuelError struct{}
+
+// Error implements error.
+func (e OutOfFuelError) Error() string { return "out of fuel" }
+
 // if n%m != 0 { n += m-n%m }. m must be a power of 2.
 func roundup(n, m int) int { return (n + m - 1) &^ (m - 1) }
 
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"os"
 	"syscall"
+
+	"github.com/cznic/ccir/libc/errno"
 )
 
 func init() {
@@ -26,6 +28,27 @@ func (c *cpu) fcntl() {
 	cmd := readI32(ap)
 	ap -= i32StackSz
 	arg := readPtr(ap)
+	if f := c.m.fds.get(fildes); f != nil && !osFile(f) {
+		// Not an OS file, locks always succeed.
+		r := int32(0)
+		switch cmd {
+		case syscall.F_GETFL:
+			r = syscall.O_RDWR
+		case syscall.F_GETLK:
+			writeI16(arg, syscall.F_UNLCK)
+		case syscall.F_GETFD, syscall.F_SETFD, syscall.F_SETFL, syscall.F_SETLK, syscall.F_SETLKW:
+			// nop
+		default:
+			c.setErrno(errno.XEINVAL)
+			r = -1
+		}
+		if strace {
+			fmt.Fprintf(os.Stderr, "fcntl(%v, %v, %#x) %v\t; %s\n", fildes, cmdString(cmd), arg, r, c.pos())
+		}
+		writeI32(c.rp, r)
+		return
+	}
+
 	r, _, err := syscall.Syscall(syscall.SYS_FCNTL64, uintptr(fildes), uintptr(cmd), arg)
 	if strace {
 		fmt.Fprintf(os.Stderr, "fcntl(%v, %v, %#x) %v %v\t; %s\n", fildes, cmdString(cmd), arg, r, err, c.pos())
@@ -44,12 +67,16 @@ func (c *cpu) open64() {
 	flags := readI32(ap)
 	ap -= i32StackSz
 	mode := readU32(ap)
-	r, _, err := syscall.Syscall(syscall.SYS_OPEN, pathname, uintptr(flags), uintptr(mode))
+	f, err := c.m.fs.OpenFile(GoString(pathname), int(flags), os.FileMode(mode)&os.ModePerm)
+	r := int32(-1)
+	if err == nil {
+		r = c.m.fds.add(f)
+	}
 	if strace {
 		fmt.Fprintf(os.Stderr, "open(%q, %v, %#o) %v %v\t; %s\n", GoString(pathname), modeString(flags), mode, r, err, c.pos())
 	}
-	if err != 0 {
-		c.thread.setErrno(err)
+	if err != nil {
+		c.setErrno(err)
 	}
-	writeI32(c.rp, int32(r))
+	writeI32(c.rp, r)
 }
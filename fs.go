@@ -0,0 +1,570 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	tim "time"
+)
+
+// FileSystem is the file system seen by a program. Paths are passed as
+// written by the program. Errors should be *os.PathError values wrapping a
+// syscall.Errno, which becomes the errno of the program. Other errors are
+// mapped to ENOENT, EEXIST, EACCES or EIO.
+type FileSystem interface {
+	// Access checks the accessibility of name like access(2). Mode is a
+	// combination of R_OK, W_OK and X_OK or F_OK.
+	Access(name string, mode uint32) error
+	// Chtimes changes the access and modification times of name like
+	// os.Chtimes.
+	Chtimes(name string, atime, mtime tim.Time) error
+	Getwd() (string, error)
+	Lstat(name string) (os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	// OpenFile opens name like os.OpenFile. Flag uses the os.O_* values.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Readlink(name string) (string, error)
+	Remove(name string) error
+	Stat(name string) (os.FileInfo, error)
+}
+
+// File is an open file of a FileSystem. Files having a method Fd() uintptr
+// are assumed to be OS files and their descriptors are passed to the program
+// unchanged. Other files get descriptors above the range used by the OS.
+type File interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS makes the programs of a machine use fs for all file I/O, except the
+// standard streams. The default is OSFileSystem.
+func FS(fs FileSystem) Option {
+	return func(o *options) error {
+		o.fs = fs
+		return nil
+	}
+}
+
+type osFileSystem struct{}
+
+// OSFileSystem returns a FileSystem passing all operations to the OS.
+func OSFileSystem() FileSystem { return osFileSystem{} }
+
+func (osFileSystem) Chtimes(name string, atime, mtime tim.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+func (osFileSystem) Getwd() (string, error)                 { return os.Getwd() }
+func (osFileSystem) Lstat(name string) (os.FileInfo, error) { return os.Lstat(name) }
+func (osFileSystem) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+func (osFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+func (osFileSystem) Readlink(name string) (string, error)  { return os.Readlink(name) }
+func (osFileSystem) Remove(name string) error              { return os.Remove(name) }
+func (osFileSystem) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+// MemFileSystem is a FileSystem keeping files in memory. Relative paths are
+// resolved from the root directory. Symbolic links are not supported. Use
+// NewMemFileSystem to create a MemFileSystem.
+type MemFileSystem struct {
+	ino   uint64 // Last inode number.
+	mu    sync.Mutex
+	nodes map[string]*memNode // Key: Clean absolute path.
+}
+
+type memNode struct {
+	data    []byte
+	ino     memIno
+	mode    os.FileMode
+	modTime tim.Time
+	name    string
+}
+
+// memIno is the Sys value of the os.FileInfo of a MemFileSystem file.
+type memIno uint64
+
+// NewMemFileSystem returns a newly created MemFileSystem having only the root
+// directory.
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{
+		ino:   1,
+		nodes: map[string]*memNode{"/": {ino: 1, mode: os.ModeDir | 0777, modTime: tim.Now(), name: "/"}},
+	}
+}
+
+// newNode returns a new node for path p. The caller must hold fs.mu.
+func (fs *MemFileSystem) newNode(p string, mode os.FileMode) *memNode {
+	fs.ino++
+	n := &memNode{ino: memIno(fs.ino), mode: mode, modTime: tim.Now(), name: path.Base(p)}
+	fs.nodes[p] = n
+	return n
+}
+
+func memPath(name string) string { return path.Clean("/" + name) }
+
+func memError(op, name string, errno syscall.Errno) error {
+	return &os.PathError{Op: op, Path: name, Err: errno}
+}
+
+// node returns the node at p and the node of its parent directory. The
+// caller must hold fs.mu.
+func (fs *MemFileSystem) node(op, name string) (n, dir *memNode, err error) {
+	p := memPath(name)
+	if p != "/" {
+		if dir = fs.nodes[path.Dir(p)]; dir == nil {
+			return nil, nil, memError(op, name, syscall.ENOENT)
+		}
+
+		if !dir.mode.IsDir() {
+			return nil, nil, memError(op, name, syscall.ENOTDIR)
+		}
+	}
+	return fs.nodes[p], dir, nil
+}
+
+// Access implements FileSystem. The permissions are checked against the owner
+// bits of the file mode.
+func (fs *MemFileSystem) Access(name string, mode uint32) error {
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	if uint32(fi.Mode().Perm()>>6)&mode != mode {
+		return memError("access", name, syscall.EACCES)
+	}
+
+	return nil
+}
+
+// Chtimes implements FileSystem. Only the modification time is kept.
+func (fs *MemFileSystem) Chtimes(name string, atime, mtime tim.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, _, err := fs.node("chtimes", name)
+	if err != nil {
+		return err
+	}
+
+	if n == nil {
+		return memError("chtimes", name, syscall.ENOENT)
+	}
+
+	n.modTime = mtime
+	return nil
+}
+
+// Getwd implements FileSystem.
+func (fs *MemFileSystem) Getwd() (string, error) { return "/", nil }
+
+// Lstat implements FileSystem.
+func (fs *MemFileSystem) Lstat(name string) (os.FileInfo, error) { return fs.Stat(name) }
+
+// Mkdir implements FileSystem.
+func (fs *MemFileSystem) Mkdir(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, _, err := fs.node("mkdir", name)
+	if err != nil {
+		return err
+	}
+
+	if n != nil {
+		return memError("mkdir", name, syscall.EEXIST)
+	}
+
+	fs.newNode(memPath(name), os.ModeDir|perm&os.ModePerm)
+	return nil
+}
+
+// OpenFile implements FileSystem.
+func (fs *MemFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, _, err := fs.node("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch {
+	case n == nil && flag&os.O_CREATE == 0:
+		return nil, memError("open", name, syscall.ENOENT)
+	case n == nil:
+		n = fs.newNode(memPath(name), perm&os.ModePerm)
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, memError("open", name, syscall.EEXIST)
+	case n.mode.IsDir() && write:
+		return nil, memError("open", name, syscall.EISDIR)
+	case flag&os.O_TRUNC != 0 && write:
+		n.data = nil
+		n.modTime = tim.Now()
+	}
+	return &memFile{fs: fs, flag: flag, n: n}, nil
+}
+
+// Readlink implements FileSystem.
+func (fs *MemFileSystem) Readlink(name string) (string, error) {
+	if _, err := fs.Stat(name); err != nil {
+		return "", err
+	}
+
+	return "", memError("readlink", name, syscall.EINVAL)
+}
+
+// Remove implements FileSystem.
+func (fs *MemFileSystem) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, _, err := fs.node("remove", name)
+	if err != nil {
+		return err
+	}
+
+	p := memPath(name)
+	switch {
+	case n == nil:
+		return memError("remove", name, syscall.ENOENT)
+	case p == "/":
+		return memError("remove", name, syscall.EBUSY)
+	case n.mode.IsDir():
+		for k := range fs.nodes {
+			if strings.HasPrefix(k, p+"/") {
+				return memError("remove", name, syscall.ENOTEMPTY)
+			}
+		}
+	}
+	delete(fs.nodes, p)
+	return nil
+}
+
+// Stat implements FileSystem.
+func (fs *MemFileSystem) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, _, err := fs.node("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if n == nil {
+		return nil, memError("stat", name, syscall.ENOENT)
+	}
+
+	return n.info(), nil
+}
+
+// ReadFile returns the content of the file name.
+func (fs *MemFileSystem) ReadFile(name string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, _, err := fs.node("read", name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case n == nil:
+		return nil, memError("read", name, syscall.ENOENT)
+	case n.mode.IsDir():
+		return nil, memError("read", name, syscall.EISDIR)
+	}
+
+	return append([]byte(nil), n.data...), nil
+}
+
+// WriteFile creates or truncates the file name and writes data to it. The
+// directory of the file must exist.
+func (fs *MemFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Names returns the sorted paths of all files and directories.
+func (fs *MemFileSystem) Names() []string {
+	fs.mu.Lock()
+	r := make([]string, 0, len(fs.nodes))
+	for k := range fs.nodes {
+		r = append(r, k)
+	}
+	fs.mu.Unlock()
+	sort.Strings(r)
+	return r
+}
+
+func (n *memNode) info() os.FileInfo {
+	return &memFileInfo{ino: n.ino, mode: n.mode, modTime: n.modTime, name: n.name, size: int64(len(n.data))}
+}
+
+type memFileInfo struct {
+	ino     memIno
+	mode    os.FileMode
+	modTime tim.Time
+	name    string
+	size    int64
+}
+
+func (fi *memFileInfo) IsDir() bool       { return fi.mode.IsDir() }
+func (fi *memFileInfo) ModTime() tim.Time { return fi.modTime }
+func (fi *memFileInfo) Mode() os.FileMode { return fi.mode }
+func (fi *memFileInfo) Name() string      { return fi.name }
+func (fi *memFileInfo) Size() int64       { return fi.size }
+func (fi *memFileInfo) Sys() interface{}  { return fi.ino }
+
+type memFile struct {
+	closed bool
+	flag   int
+	fs     *MemFileSystem
+	n      *memNode
+	off    int64
+}
+
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return memError(op, f.n.name, syscall.EBADF)
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0, !write && f.flag&os.O_WRONLY != 0:
+		return memError(op, f.n.name, syscall.EBADF)
+	case f.n.mode.IsDir():
+		return memError(op, f.n.name, syscall.EISDIR)
+	}
+	return nil
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+
+	if f.off >= int64(len(f.n.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(b, f.n.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.n.data))
+	}
+	if end := f.off + int64(len(b)); end > int64(len(f.n.data)) {
+		f.n.data = append(f.n.data, make([]byte, end-int64(len(f.n.data)))...)
+	}
+	copy(f.n.data[f.off:], b)
+	f.off += int64(len(b))
+	f.n.modTime = tim.Now()
+	return len(b), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, memError("seek", f.n.name, syscall.EBADF)
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.n.data))
+	case io.SeekStart:
+		// nop
+	default:
+		return 0, memError("seek", f.n.name, syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, memError("seek", f.n.name, syscall.EINVAL)
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return memError("close", f.n.name, syscall.EBADF)
+	}
+
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return nil, memError("stat", f.n.name, syscall.EBADF)
+	}
+
+	return f.n.info(), nil
+}
+
+func (f *memFile) Sync() error { return nil }
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+
+	if size < 0 {
+		return memError("truncate", f.n.name, syscall.EINVAL)
+	}
+
+	if size <= int64(len(f.n.data)) {
+		f.n.data = f.n.data[:size]
+	} else {
+		f.n.data = append(f.n.data, make([]byte, size-int64(len(f.n.data)))...)
+	}
+	f.n.modTime = tim.Now()
+	return nil
+}
+
+// fdVirtual is the lowest descriptor of a file which is not an OS file. The OS
+// does not hand out descriptors that high (fs.nr_open), so they never collide
+// with the descriptors of sockets and other OS files bypassing fdmap.
+const fdVirtual = 1 << 20
+
+// fdmap is the table of file descriptors of a Machine, except the standard
+// ones. Descriptors of OS files are the OS descriptors, other files get the
+// lowest free descriptor starting at fdVirtual.
+type fdmap struct {
+	m  map[int32]File
+	mu sync.Mutex
+}
+
+func newFdmap() *fdmap { return &fdmap{m: map[int32]File{}} }
+
+// add registers f and returns its descriptor.
+func (m *fdmap) add(f File) int32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if x, ok := f.(interface {
+		Fd() uintptr
+	}); ok {
+		fd := int32(x.Fd())
+		m.m[fd] = f
+		return fd
+	}
+
+	fd := int32(fdVirtual)
+	for m.m[fd] != nil {
+		fd++
+	}
+	m.m[fd] = f
+	return fd
+}
+
+func (m *fdmap) get(fd int32) File {
+	m.mu.Lock()
+	f := m.m[fd]
+	m.mu.Unlock()
+	return f
+}
+
+// remove unregisters fd and returns its file, if any.
+func (m *fdmap) remove(fd int32) File {
+	m.mu.Lock()
+	f := m.m[fd]
+	delete(m.m, fd)
+	m.mu.Unlock()
+	return f
+}
+
+// closeAll closes all registered files.
+func (m *fdmap) closeAll() (err error) {
+	m.mu.Lock()
+	s := m.m
+	m.m = map[int32]File{}
+	m.mu.Unlock()
+	for _, f := range s {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// fsResult sets the int result of a file system function.
+func (c *cpu) fsResult(err error) {
+	if err != nil {
+		c.setErrno(err)
+		writeI32(c.rp, -1)
+		return
+	}
+
+	writeI32(c.rp, 0)
+}
+
+// hostFd returns EBADF if fd is a descriptor of a file of the FileSystem of
+// the machine, which is not an OS file. Such descriptors must not be passed
+// to the OS.
+func (c *cpu) hostFd(fd int32) error {
+	if f := c.m.fds.get(fd); f != nil && !osFile(f) {
+		return syscall.EBADF
+	}
+
+	return nil
+}
+
+// osFile reports whether f is an OS file.
+func osFile(f File) bool {
+	_, ok := f.(interface {
+		Fd() uintptr
+	})
+	return ok
+}
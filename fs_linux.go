@@ -0,0 +1,78 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// writeStat writes fi to the struct stat64 at buf.
+func writeStat(buf uintptr, fi os.FileInfo) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		st = &syscall.Stat_t{
+			Blksize: 4096,
+			Blocks:  (fi.Size() + 511) / 512,
+			Mode:    statMode(fi.Mode()),
+			Nlink:   1,
+			Size:    fi.Size(),
+		}
+		if ino, ok := fi.Sys().(memIno); ok {
+			st.Ino = uint64(ino)
+		}
+		st.Atim = syscall.NsecToTimespec(fi.ModTime().UnixNano())
+		st.Ctim = st.Atim
+		st.Mtim = st.Atim
+	}
+	*(*syscall.Stat_t)(memW(buf, int(unsafe.Sizeof(*st)))) = *st
+}
+
+// statMode returns the st_mode of a file having mode m.
+func statMode(m os.FileMode) uint32 {
+	r := uint32(m.Perm())
+	switch {
+	case m&os.ModeDir != 0:
+		r |= syscall.S_IFDIR
+	case m&os.ModeSymlink != 0:
+		r |= syscall.S_IFLNK
+	case m&os.ModeNamedPipe != 0:
+		r |= syscall.S_IFIFO
+	case m&os.ModeSocket != 0:
+		r |= syscall.S_IFSOCK
+	case m&os.ModeCharDevice != 0:
+		r |= syscall.S_IFCHR
+	case m&os.ModeDevice != 0:
+		r |= syscall.S_IFBLK
+	default:
+		r |= syscall.S_IFREG
+	}
+	if m&os.ModeSetuid != 0 {
+		r |= syscall.S_ISUID
+	}
+	if m&os.ModeSetgid != 0 {
+		r |= syscall.S_ISGID
+	}
+	if m&os.ModeSticky != 0 {
+		r |= syscall.S_ISVTX
+	}
+	return r
+}
+
+// statResult sets the result of a stat function.
+func (c *cpu) statResult(buf uintptr, fi os.FileInfo, err error) {
+	if err != nil {
+		c.setErrno(err)
+		writeI32(c.rp, -1)
+		return
+	}
+
+	writeStat(buf, fi)
+	writeI32(c.rp, 0)
+}
+
+// Access implements FileSystem.
+func (osFileSystem) Access(name string, mode uint32) error { return syscall.Access(name, mode) }
@@ -0,0 +1,25 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"os"
+	"syscall"
+)
+
+// Access implements FileSystem. Only the write permission can be
+// denied.
+func (osFileSystem) Access(name string, mode uint32) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	if mode&2 != 0 && fi.Mode().Perm()&0200 == 0 { // W_OK
+		return &os.PathError{Op: "access", Path: name, Err: syscall.EACCES}
+	}
+
+	return nil
+}
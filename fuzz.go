@@ -0,0 +1,266 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync"
+)
+
+// Fuzzer repeatedly calls the libFuzzer style entry point of a program
+//
+//	int LLVMFuzzerTestOneInput(const uint8_t *data, size_t size);
+//
+// Before the first call, the optional
+//
+//	int LLVMFuzzerInitialize(int *argc, char ***argv);
+//
+// is called once. The memory of the program, its data segment and heap, is
+// reset to the state after the initialization before every call, so the
+// results of calls do not depend on each other. After a crash the machine is
+// recreated from scratch.
+//
+// The reset restores the data segment, the heap blocks allocated by the
+// initialization, the program break and the atexit functions. Heap blocks
+// allocated later are freed, including the buffers of localtime and dlerror.
+// Files and streams opened by the program are closed, sockets are not. Other
+// state is kept across calls. That includes memory mapped by mmap, the state
+// of pthread mutexes and condition variables, errno and the stack of the
+// thread. It also includes the fuel and, in the deterministic mode, the clock
+// and the random generator. A call which leaves more threads or libraries
+// than the initialization, or frees a block allocated by it, causes the
+// machine to be recreated.
+//
+// A Fuzzer is safe for concurrent use, but the calls are serialized.
+type Fuzzer struct {
+	atExit    []uintptr // After initialization.
+	b         *Binary
+	brk       uintptr            // After initialization.
+	data      []byte             // Data segment after initialization.
+	fn        int                // LLVMFuzzerTestOneInput.
+	heap      map[uintptr][]byte // Heap blocks after initialization.
+	heapSize  int
+	libs      int // Number of libraries loaded by the initialization.
+	m         *Machine
+	mu        sync.Mutex
+	opts      []Option
+	stackSize int
+	stderr    io.Writer
+	stdout    io.Writer
+	t         *Thread
+}
+
+// NewFuzzer returns a Fuzzer of the program in b. The arguments have the same
+// meaning as in New.
+func NewFuzzer(b *Binary, stdout, stderr io.Writer, heapSize, stackSize int, opts ...Option) (*Fuzzer, error) {
+	fn, ok := b.Sym[idLLVMFuzzerTestOneInput]
+	if !ok {
+		return nil, fmt.Errorf("missing symbol: %s", idLLVMFuzzerTestOneInput)
+	}
+
+	f := &Fuzzer{
+		b:         b,
+		fn:        fn,
+		heapSize:  heapSize,
+		opts:      opts,
+		stackSize: stackSize,
+		stderr:    stderr,
+		stdout:    stdout,
+	}
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// init creates the machine of f and records its initial state.
+func (f *Fuzzer) init() (err error) {
+	o := options{fuel: -1}
+	for _, opt := range f.opts {
+		if err := opt(&o); err != nil {
+			return err
+		}
+	}
+
+	m, err := newMachine(f.b, f.heapSize, nil, f.stdout, f.stderr, "")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			m.Close()
+		}
+	}()
+
+	m.setOptions(&o)
+	t, err := m.NewThread(f.stackSize)
+	if err != nil {
+		return err
+	}
+
+	if fn, ok := f.b.Sym[idLLVMFuzzerInitialize]; ok {
+		argv := m.malloc(2 * ptrSize)
+		writePtr(argv, m.CString("fuzzer"))
+		writePtr(argv+ptrSize, 0)
+		pargc := m.malloc(i32Size)
+		writeI32(pargc, 1)
+		pargv := m.malloc(ptrSize)
+		writePtr(pargv, argv)
+		if _, err := f.call(t, fn, Ptr(pargc), Ptr(pargv)); err != nil {
+			return fmt.Errorf("LLVMFuzzerInitialize: %v", err)
+		}
+	}
+
+	f.data = append([]byte(nil), memBytes(m.ds, len(m.dsMem))...)
+	f.heap = map[uintptr][]byte{}
+	m.allocMu.Lock()
+	for k, v := range m.blocks {
+		f.heap[k] = append([]byte(nil), memBytes(k, v)...)
+	}
+	m.allocMu.Unlock()
+	m.atExitMu.Lock()
+	f.atExit = append([]uintptr(nil), m.atExit...)
+	m.atExitMu.Unlock()
+	m.libsMu.Lock()
+	f.libs = len(m.libs)
+	m.libsMu.Unlock()
+	f.brk = m.brk
+	f.m = m
+	f.t = t
+	return nil
+}
+
+// call calls fn in t and reports non zero exit statuses as errors.
+func (f *Fuzzer) call(t *Thread, fn int, in ...FFIArgument) (int32, error) {
+	var r int32
+	s, err := t.FFI1(fn, Int32Result{&r}, in...)
+	if err != nil {
+		return -1, err
+	}
+
+	if s != 0 {
+		return -1, fmt.Errorf("exit status %v", s)
+	}
+
+	return r, nil
+}
+
+// TestOneInput calls LLVMFuzzerTestOneInput with a copy of data and returns
+// an error if the program crashes. Crashes are the Panic instruction,
+// runtime errors like a division by zero, invalid memory accesses and exiting
+// the program with a non zero status. The error includes the stack trace of
+// the program, if available. Invalid memory accesses are detected reliably
+// only with the virtual.memcheck build tag.
+func (f *Fuzzer) TestOneInput(data []byte) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.m == nil {
+		if err := f.init(); err != nil {
+			return err
+		}
+	}
+
+	n := len(data)
+	if n == 0 {
+		n = 1
+	}
+	p := f.m.malloc(n)
+	if p == 0 {
+		return fmt.Errorf("out of memory")
+	}
+
+	copy(memBytes(p, len(data)), data)
+	size := FFIArgument(Int64(len(data)))
+	if ptrSize == 4 {
+		size = Int32(len(data))
+	}
+
+	old := debug.SetPanicOnFault(true)
+	_, err = f.call(f.t, f.fn, Ptr(p), size)
+	debug.SetPanicOnFault(old)
+	if err != nil || !f.reset() {
+		f.m.Close()
+		f.m = nil
+	}
+	return err
+}
+
+// reset restores the initial state of the memory of the machine of f. It
+// returns false if that is not possible.
+func (f *Fuzzer) reset() bool {
+	m := f.m
+	m.libsMu.Lock()
+	libs := len(m.libs)
+	m.libsMu.Unlock()
+	if len(m.Threads) != 1 || libs != f.libs {
+		return false
+	}
+
+	if m.files.closeAll(m) != nil || m.fds.closeAll() != nil {
+		return false
+	}
+
+	var free []uintptr
+	m.allocMu.Lock()
+	for k, v := range m.blocks {
+		if b, ok := f.heap[k]; !ok || len(b) != v {
+			free = append(free, k)
+		}
+	}
+	n := len(m.blocks) - len(free)
+	m.allocMu.Unlock()
+	if n != len(f.heap) {
+		return false // A block allocated by the initialization was freed.
+	}
+
+	for _, p := range free {
+		m.free(p)
+		m.libsMu.Lock()
+		if p == m.dlErrP {
+			m.dlErrP = 0
+		}
+		m.libsMu.Unlock()
+		if p == m.tm {
+			m.tm = 0
+			m.tmOnce = sync.Once{}
+		}
+	}
+	copy(memBytes(m.ds, len(f.data)), f.data)
+	m.brk = f.brk
+	for k, v := range f.heap {
+		copy(memBytes(k, len(v)), v)
+	}
+	m.atExitMu.Lock()
+	m.atExit = append(m.atExit[:0], f.atExit...)
+	m.atExitMu.Unlock()
+	if t := m.allocs; t != nil {
+		t.mu.Lock()
+		for _, p := range free {
+			delete(t.live, p)
+		}
+		t.resetFreed()
+		t.mu.Unlock()
+	}
+	return true
+}
+
+// Close frees the resources of f.
+func (f *Fuzzer) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.m == nil {
+		return nil
+	}
+
+	err := f.m.Close()
+	f.m = nil
+	return err
+}
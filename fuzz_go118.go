@@ -0,0 +1,36 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package virtual
+
+import (
+	"testing"
+)
+
+// Fuzz makes f call TestOneInput for every input generated by the Go fuzzing
+// engine, reporting crashes as test failures. For example
+//
+//	func FuzzParser(f *testing.F) {
+//		z, err := virtual.NewFuzzer(bin, nil, nil, 1<<20, 1<<20)
+//		if err != nil {
+//			f.Fatal(err)
+//		}
+//
+//		defer z.Close()
+//
+//		f.Add([]byte("seed"))
+//		z.Fuzz(f)
+//	}
+//
+// can be run using 'go test -fuzz FuzzParser'.
+func (z *Fuzzer) Fuzz(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := z.TestOneInput(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,272 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"encoding/binary"
+	"fmt"
+	"go/token"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const heapPoison = 0xdd // Fills freed blocks when tracking allocations.
+
+// StackFrame describes an active function call.
+type StackFrame struct {
+	Function string
+	PC       int
+	Position token.Position
+}
+
+func (f StackFrame) String() string {
+	return fmt.Sprintf("%s\t%#05x\t%v", f.Function, f.PC, f.Position)
+}
+
+// HeapBlock describes a heap allocation made by the program.
+type HeapBlock struct {
+	Addr  uintptr
+	Size  int
+	Stack []StackFrame // Where the block was allocated, innermost call first.
+}
+
+// HeapError describes an invalid free or realloc detected when tracking
+// allocations.
+type HeapError struct {
+	Addr       uintptr
+	DoubleFree bool
+	Freed      []StackFrame // DoubleFree: Where the block was freed before.
+}
+
+// Error implements error.
+func (e HeapError) Error() string {
+	if !e.DoubleFree {
+		return fmt.Sprintf("free of non-heap pointer %#x", e.Addr)
+	}
+
+	return fmt.Sprintf("double free of %#x, previously freed at\n%s", e.Addr, frames(e.Freed))
+}
+
+func frames(s []StackFrame) string {
+	var a []string
+	for _, v := range s {
+		a = append(a, "\t"+v.String())
+	}
+	return strings.Join(a, "\n")
+}
+
+const freedMax = 1 << 16 // Number of freed blocks remembered to detect double frees.
+
+type allocation struct {
+	size  int
+	stack string // See cpu.callers.
+	vm    bool   // Allocated by the virtual machine. Not reported as a leak.
+}
+
+type freedBlock struct {
+	seq   uint64
+	stack string // Of the free call.
+}
+
+type freedRef struct {
+	p   uintptr
+	seq uint64
+}
+
+// allocTracker tracks heap allocations made by the program. Blocks allocated
+// by the virtual machine, like the FILE objects of fopen or strings passed to
+// the program, are tracked as well, so the program may free them.
+type allocTracker struct {
+	freed  map[uintptr]freedBlock
+	freedQ []freedRef // Ring of the last freedMax entries of freed.
+	live   map[uintptr]allocation
+	mu     sync.Mutex
+	seq    uint64
+	w      io.Writer // Leak report destination.
+}
+
+func newAllocTracker(w io.Writer) *allocTracker {
+	return &allocTracker{
+		freed: map[uintptr]freedBlock{},
+		live:  map[uintptr]allocation{},
+		w:     w,
+	}
+}
+
+// free records that the block at p was freed at stack, forgetting the oldest
+// record when there are more than freedMax of them. Must be called with mu
+// locked.
+func (t *allocTracker) free(p uintptr, stack string) {
+	r := freedRef{p, t.seq}
+	switch i := int(t.seq % freedMax); {
+	case i < len(t.freedQ):
+		if old := t.freedQ[i]; t.freed[old.p].seq == old.seq {
+			delete(t.freed, old.p)
+		}
+		t.freedQ[i] = r
+	default:
+		t.freedQ = append(t.freedQ, r)
+	}
+	t.freed[p] = freedBlock{t.seq, stack}
+	t.seq++
+}
+
+// resetFreed forgets all freed blocks. Must be called with mu locked.
+func (t *allocTracker) resetFreed() {
+	t.freed = map[uintptr]freedBlock{}
+	t.freedQ = nil
+}
+
+// vmAlloc records a block of n bytes at p allocated by the virtual machine.
+func (t *allocTracker) vmAlloc(p uintptr, n int) {
+	if t == nil || p == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	t.live[p] = allocation{size: n, vm: true}
+	delete(t.freed, p)
+	t.mu.Unlock()
+}
+
+// vmFree forgets the block at p freed by the virtual machine.
+func (t *allocTracker) vmFree(p uintptr) {
+	if t == nil || p == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	delete(t.live, p)
+	t.mu.Unlock()
+}
+
+// trackAlloc records a block of n bytes at p allocated by c.
+func (c *cpu) trackAlloc(p uintptr, n int) {
+	t := c.m.allocs
+	if t == nil || p == 0 {
+		return
+	}
+
+	stack := c.callers()
+	t.mu.Lock()
+	t.live[p] = allocation{size: n, stack: stack}
+	delete(t.freed, p)
+	t.mu.Unlock()
+}
+
+// trackCheck panics with HeapError if p is not a block allocated by the
+// program.
+func (c *cpu) trackCheck(p uintptr) {
+	t := c.m.allocs
+	if t == nil || p == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	_, ok := t.live[p]
+	f, double := t.freed[p]
+	t.mu.Unlock()
+	if !ok {
+		panic(HeapError{Addr: p, DoubleFree: double, Freed: c.m.frames(f.stack)})
+	}
+}
+
+// trackFree validates that p can be freed by c and poisons its block.
+func (c *cpu) trackFree(p uintptr) {
+	t := c.m.allocs
+	if t == nil || p == 0 {
+		return
+	}
+
+	c.trackCheck(p)
+	t.mu.Lock()
+	a := t.live[p]
+	delete(t.live, p)
+	t.free(p, c.callers())
+	t.mu.Unlock()
+	for i := 0; i < a.size; i++ {
+		writeU8(p+uintptr(i), heapPoison)
+	}
+}
+
+// trackRealloc records that c reallocated the block at p to n bytes at q.
+func (c *cpu) trackRealloc(p, q uintptr, n int) {
+	t := c.m.allocs
+	if t == nil {
+		return
+	}
+
+	stack := c.callers()
+	t.mu.Lock()
+	if p != 0 && p != q {
+		delete(t.live, p)
+		t.free(p, stack)
+	}
+	if q != 0 {
+		t.live[q] = allocation{size: n, stack: stack}
+		delete(t.freed, q)
+	}
+	t.mu.Unlock()
+}
+
+// frames resolves a stack encoded by cpu.callers.
+func (m *Machine) frames(stack string) (r []StackFrame) {
+	for i := 0; i+8 <= len(stack); i += 8 {
+		pc := int(binary.LittleEndian.Uint64([]byte(stack[i : i+8])))
+		r = append(r, StackFrame{
+			Function: string(dict.S(int(m.pcInfo(pc, m.image().functions).Name))),
+			PC:       pc,
+			Position: m.pcInfo(pc, m.image().lines).Position(),
+		})
+	}
+	return r
+}
+
+// Leaks returns the heap blocks allocated by the program and not yet freed,
+// ordered by address. Leaks returns nil if the machine does not track
+// allocations. See the TrackAllocations option.
+func (m *Machine) Leaks() []HeapBlock {
+	t := m.allocs
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	r := make([]HeapBlock, 0, len(t.live))
+	for k, v := range t.live {
+		if !v.vm {
+			r = append(r, HeapBlock{Addr: k, Size: v.size, Stack: m.frames(v.stack)})
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(r, func(i, j int) bool { return r[i].Addr < r[j].Addr })
+	return r
+}
+
+// reportLeaks writes the leaked blocks to the writer passed to
+// TrackAllocations, if any.
+func (m *Machine) reportLeaks() error {
+	if m.allocs == nil || m.allocs.w == nil {
+		return nil
+	}
+
+	leaks := m.Leaks()
+	if len(leaks) == 0 {
+		return nil
+	}
+
+	w := m.allocs.w
+	n := 0
+	for _, v := range leaks {
+		n += v.Size
+		if _, err := fmt.Fprintf(w, "%v bytes at %#x leaked, allocated at\n%s\n", v.Size, v.Addr, frames(v.Stack)); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%v bytes in %v blocks leaked\n", n, len(leaks))
+	return err
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"fmt"
+
+	"github.com/cznic/ir"
+)
+
+// HostFunction is a Go implementation of an external C function. A non nil
+// error terminates the program.
+type HostFunction func(call *HostCall) error
+
+// HostCall provides access to the arguments and the result of a C call of a
+// host function. Arguments must be retrieved in the order of the C function
+// declaration, using methods matching the argument types. Variadic functions
+// are supported.
+type HostCall struct {
+	Thread *Thread
+	ap     uintptr // Next argument.
+	rp     uintptr // Result.
+}
+
+// Float64 returns the next argument, which must be a double.
+func (h *HostCall) Float64() float64 {
+	h.ap -= f64StackSz
+	return readF64(h.ap)
+}
+
+// Int32 returns the next argument, which must be a 32 bit integer.
+func (h *HostCall) Int32() int32 {
+	h.ap -= i32StackSz
+	return readI32(h.ap)
+}
+
+// Int64 returns the next argument, which must be a 64 bit integer.
+func (h *HostCall) Int64() int64 {
+	h.ap -= i64StackSz
+	return readI64(h.ap)
+}
+
+// Ptr returns the next argument, which must be a pointer.
+func (h *HostCall) Ptr() uintptr {
+	h.ap -= ptrStackSz
+	return readPtr(h.ap)
+}
+
+// SetFloat64 sets the double result of the call.
+func (h *HostCall) SetFloat64(v float64) { writeF64(h.rp, v) }
+
+// SetInt32 sets the 32 bit integer result of the call.
+func (h *HostCall) SetInt32(v int32) { writeI32(h.rp, v) }
+
+// SetInt64 sets the 64 bit integer result of the call.
+func (h *HostCall) SetInt64(v int64) { writeI64(h.rp, v) }
+
+// SetPtr sets the pointer result of the call.
+func (h *HostCall) SetPtr(v uintptr) { writePtr(h.rp, v) }
+
+// SetErrno sets the errno of the calling thread.
+func (h *HostCall) SetErrno(v int) { h.Thread.setErrno(v) }
+
+// Host binds the external C function name to f.
+func Host(name string, f HostFunction) Option {
+	return func(o *options) error {
+		if f == nil {
+			return fmt.Errorf("Host: nil function %s", name)
+		}
+
+		nm := ir.NameID(dict.SID(name))
+		if _, ok := builtins[nm]; ok {
+			return fmt.Errorf("Host: cannot override builtin %s", name)
+		}
+
+		if o.host == nil {
+			o.host = map[ir.NameID]HostFunction{}
+		}
+		o.host[nm] = f
+		return nil
+	}
+}
+
+func (c *cpu) hostFunction(nm ir.NameID) error {
+	f := c.m.host[nm]
+	if f == nil {
+		return fmt.Errorf("undefined external function %s\n%s", nm, c.stackTrace())
+	}
+
+	if err := f(&HostCall{Thread: c.thread, ap: c.rp, rp: c.rp}); err != nil {
+		return fmt.Errorf("%s: %v\n%s", nm, err, c.stackTrace())
+	}
+
+	n := len(c.rpStack)
+	c.sp = c.rp
+	c.rp = c.rpStack[n-1]
+	c.rpStack = c.rpStack[:n-1]
+	return nil
+}
@@ -5,10 +5,7 @@
 package virtual
 
 import (
-	"bufio"
 	"bytes"
-	"compress/gzip"
-	"encoding/gob"
 	"fmt"
 	"go/token"
 	"io"
@@ -16,9 +13,6 @@ import (
 	"runtime"
 	"runtime/debug"
 	"sort"
-	"strconv"
-	"strings"
-	tm "time"
 	"unicode/utf16"
 	"unsafe"
 
@@ -29,14 +23,13 @@ import (
 
 var (
 	_ io.ReaderFrom = (*Binary)(nil)
-	_ io.Writer     = (*counter)(nil)
 	_ io.WriterTo   = (*Binary)(nil)
 )
 
 const (
 	// binaryVersion must be incremented every time an instruction is added
 	// or removed or when any instruction op codes is changed.
-	binaryVersion = 19 // Compatibility version of Binary.
+	binaryVersion = 22 // Compatibility version of Binary.
 
 	ffiProlog = 2 // Call $+2, FFIReturn, Func, ...
 )
@@ -92,29 +85,40 @@ func (p *PCInfo) Position() token.Position {
 	return token.Position{Line: p.Line, Column: p.Column, Filename: string(dict.S(int(p.Name)))}
 }
 
-type counter int64
-
-func (c *counter) Write(b []byte) (int, error) {
-	*c += counter(len(b))
-	return len(b), nil
+// Global describes an external variable of a Binary.
+type Global struct {
+	Offset int // In the data segment, BSS follows the initialized data.
+	Size   int
+	Type   ir.TypeID
 }
 
 // Binary represents a loaded program image. It can be run via Exec.
 type Binary struct {
-	BSS        int
-	Code       []Operation
-	DSRelative []byte // Bit vector of data segment-relative pointers in Data.
-	Data       []byte
-	Functions  []PCInfo
-	Lines      []PCInfo
-	TSRelative []byte // Bit vector of text segment-relative pointers in Data.
-	Text       []byte
-	Sym        map[ir.NameID]int // External function: Code index.
+	BSS            int
+	CSRelative     []byte // Bit vector of code-relative pointers in Data.
+	Code           []Operation
+	CodeCSRelative []byte // Bit vector of Push32 and Push64 in Code having a code address.
+	DSRelative     []byte // Bit vector of data segment-relative pointers in Data.
+	Data           []byte
+	Functions      []PCInfo
+	GOARCH         string               // Target architecture. Empty: runtime.GOARCH.
+	GOOS           string               // Target operating system. Empty: runtime.GOOS.
+	Globals        map[ir.NameID]Global // External variables.
+	Lines          []PCInfo
+	Signatures     map[ir.NameID]ir.TypeID // External function: Type.
+	TSRelative     []byte                  // Bit vector of text segment-relative pointers in Data.
+	Text           []byte
+	TextCSRelative []byte            // Bit vector of code-relative pointers in Text.
+	Sym            map[ir.NameID]int // External function: Code index.
 }
 
 func newBinary() *Binary {
 	return &Binary{
-		Sym: map[ir.NameID]int{},
+		GOARCH:     runtime.GOARCH,
+		GOOS:       runtime.GOOS,
+		Globals:    map[ir.NameID]Global{},
+		Signatures: map[ir.NameID]ir.TypeID{},
+		Sym:        map[ir.NameID]int{},
 	}
 }
 
@@ -125,98 +129,6 @@ func (b *Binary) LookupFunction(f string) (int, bool) {
 	return pc, ok
 }
 
-// ReadFrom reads b from r.
-func (b *Binary) ReadFrom(r io.Reader) (n int64, err error) {
-	var br *bufio.Reader
-	var c counter
-	*b = Binary{}
-	b.Sym = map[ir.NameID]int{}
-
-	var ok bool
-	if br, ok = r.(*bufio.Reader); !ok {
-		br = bufio.NewReader(r)
-	}
-
-	if runtime.GOOS == "linux" {
-		s, err := br.ReadString('\n')
-		if err != nil {
-			return int64(c), err
-		}
-
-		if !strings.HasPrefix(s, "#!") {
-			return int64(c), fmt.Errorf("invalid file header: %q", s)
-		}
-		c = counter(len(s))
-	}
-
-	r = io.TeeReader(br, &c)
-	gr, err := gzip.NewReader(r)
-	if err != nil {
-		return 0, err
-	}
-
-	if len(gr.Header.Extra) < len(magic) || !bytes.Equal(gr.Header.Extra[:len(magic)], magic) {
-		return int64(c), fmt.Errorf("unrecognized file format")
-	}
-
-	buf := gr.Header.Extra[len(magic):]
-	a := bytes.Split(buf, []byte{'|'})
-	if len(a) != 3 {
-		return int64(c), fmt.Errorf("corrupted file")
-	}
-
-	if s := string(a[0]); s != runtime.GOOS {
-		return int64(c), fmt.Errorf("invalid platform %q", s)
-	}
-
-	if s := string(a[1]); s != runtime.GOARCH {
-		return int64(c), fmt.Errorf("invalid architecture %q", s)
-	}
-
-	v, err := strconv.ParseUint(string(a[2]), 10, 64)
-	if err != nil {
-		return int64(c), err
-	}
-
-	switch {
-	case v < 16:
-		if v != binaryVersion {
-			return int64(c), fmt.Errorf("%T.ReadFrom: invalid version number %v", b, v)
-		}
-	default:
-		if v > binaryVersion {
-			return int64(c), fmt.Errorf("%T.ReadFrom: incompatible version number %v", b, v)
-		}
-	}
-
-	err = gob.NewDecoder(gr).Decode(b)
-	return int64(c), err
-}
-
-// WriteTo writes b to w.
-func (b *Binary) WriteTo(w io.Writer) (n int64, err error) {
-	var c counter
-	gw := gzip.NewWriter(io.MultiWriter(w, &c))
-	gw.Header.Comment = "VM binary/executable"
-	var buf buffer.Bytes
-	buf.Write(magic)
-	fmt.Fprintf(&buf, fmt.Sprintf("%s|%s|%v", runtime.GOOS, runtime.GOARCH, binaryVersion))
-	gw.Header.Extra = buf.Bytes()
-	buf.Close()
-	gw.Header.ModTime = tm.Now()
-	gw.Header.OS = 255 // Unknown OS.
-	enc := gob.NewEncoder(gw)
-	if err := enc.Encode(b); err != nil {
-		return int64(c), err
-	}
-
-	if err := gw.Close(); err != nil {
-		return int64(c), err
-	}
-
-	return int64(c), nil
-}
-
 type nfo struct {
 	align int
 	off   int
@@ -272,6 +184,14 @@ func newLoader(objects []ir.Object) *loader {
 	}
 }
 
+// global records the external variable d allocated at off in the data
+// segment.
+func (l *loader) global(d *ir.DataDefinition, off, size int) {
+	if d.Linkage == ir.ExternalLinkage {
+		l.out.Globals[d.NameID] = Global{Offset: off, Size: size, Type: d.TypeID}
+	}
+}
+
 func (l *loader) loadDataDefinition(d *ir.DataDefinition, off int, v ir.Value) {
 	brk := off + l.sizeof(d.TypeID)
 
@@ -295,8 +215,11 @@ func (l *loader) loadDataDefinition(d *ir.DataDefinition, off int, v ir.Value) {
 			}
 
 			*(*uintptr)(unsafe.Pointer(&b[0])) = uintptr(l.m[x.Index]) + x.Offset
-			if _, ok := l.objects[x.Index].(*ir.DataDefinition); ok {
+			switch l.objects[x.Index].(type) {
+			case *ir.DataDefinition:
 				l.out.DSRelative[off>>3] |= 1 << uint(off&7)
+			case *ir.FunctionDefinition:
+				l.out.CSRelative = setBit(l.out.CSRelative, off)
 			}
 		case *ir.CompositeValue:
 			switch typ := l.tc.MustType(t); typ.Kind() {
@@ -467,6 +390,10 @@ func (l *loader) loadDataDefinition(d *ir.DataDefinition, off int, v ir.Value) {
 					case ir.Function:
 						*(*uintptr)(unsafe.Pointer(&b[0])) = uintptr(l.text(x.StringID, true, delta))
 						l.out.TSRelative[off>>3] |= 1 << uint(off&7)
+						p := l.text(x.StringID, true, 0)
+						for i := 0; i < len(dict.S(int(x.StringID))); i += l.ptrSize {
+							l.out.TextCSRelative = setBit(l.out.TextCSRelative, p+i)
+						}
 					default:
 						panic(fmt.Errorf("%s: TODO %v: %q", d.Position, typ, x.StringID))
 					}
@@ -569,6 +496,15 @@ func (l *loader) sizeof(tid ir.TypeID) int {
 
 func (l *loader) stackSize(tid ir.TypeID) int { return roundup(l.sizeof(tid), l.stackAlign) }
 
+// setBit sets bit i of the bit vector b, extending b as necessary.
+func setBit(b []byte, i int) []byte {
+	for i>>3 >= len(b) {
+		b = append(b, 0)
+	}
+	b[i>>3] |= 1 << uint(i&7)
+	return b
+}
+
 func (l *loader) text(s ir.StringID, null bool, off int) int {
 	if p, ok := l.strings[s]; ok {
 		return p + off
@@ -1037,14 +973,15 @@ func (l *loader) loadFunctionDefinition(index int, f *ir.FunctionDefinition) {
 				panic(fmt.Errorf("%s: TODO %v", x.Position, t.Kind()))
 			}
 		case *ir.Call:
-			if opcode, ok := builtins[l.objects[x.Index].(*ir.FunctionDefinition).NameID]; ok {
-				body := l.objects[x.Index].(*ir.FunctionDefinition).Body
-				if len(body) == 1 {
-					if _, ok := body[0].(*ir.Panic); ok {
-						l.emit(l.pos(x), Operation{Opcode: opcode})
-						break
-					}
+			f := l.objects[x.Index].(*ir.FunctionDefinition)
+			if isExtern(f) {
+				if opcode, ok := builtins[f.NameID]; ok {
+					l.emit(l.pos(x), Operation{Opcode: opcode})
+					break
 				}
+
+				l.emit(l.pos(x), Operation{Opcode: hostFunction, N: int(f.NameID)})
+				break
 			}
 
 			l.emit(l.pos(x), Operation{Opcode: Call, N: x.Index})
@@ -2303,6 +2240,12 @@ func (l *loader) loadBuiltin(op Opcode, f *ir.FunctionDefinition) {
 			Operation{Opcode: AddSP, N: ptrStackSz},
 			Operation{Opcode: op},
 		)
+	case hostFunction:
+		l.emit(fi,
+			Operation{Opcode: builtin},
+			Operation{Opcode: op, N: int(f.NameID)},
+			Operation{Opcode: FFIReturn},
+		)
 	default:
 		l.emit(fi,
 			Operation{Opcode: builtin},
@@ -2312,6 +2255,17 @@ func (l *loader) loadBuiltin(op Opcode, f *ir.FunctionDefinition) {
 	}
 }
 
+// isExtern reports whether f has no definition in the program, ie. whether
+// it's a builtin or a host function.
+func isExtern(f *ir.FunctionDefinition) bool {
+	if len(f.Body) != 1 {
+		return false
+	}
+
+	_, ok := f.Body[0].(*ir.Panic)
+	return ok
+}
+
 func (l *loader) vsize(v ir.Value, t ir.Type) (r int) {
 	switch t.Kind() {
 	case ir.Array:
@@ -2489,7 +2443,9 @@ func (l *loader) load() error {
 		case *ir.DataDefinition:
 			if x.Value != nil {
 				l.m[i] = ds
-				ds += roundup(l.size(x.Value, l.tc.MustType(x.TypeID)), mallocAlign)
+				sz := l.size(x.Value, l.tc.MustType(x.TypeID))
+				l.global(x, ds, sz)
+				ds += roundup(sz, mallocAlign)
 			}
 		}
 	}
@@ -2498,6 +2454,7 @@ func (l *loader) load() error {
 		case *ir.DataDefinition:
 			if x.Value == nil {
 				l.m[i] = ds
+				l.global(x, ds, l.sizeof(x.TypeID))
 				sz := roundup(l.sizeof(x.TypeID), mallocAlign)
 				ds += sz
 				l.out.BSS += sz
@@ -2509,13 +2466,16 @@ func (l *loader) load() error {
 		case *ir.FunctionDefinition:
 			if x.Linkage == ir.ExternalLinkage {
 				l.out.Sym[x.NameID] = len(l.out.Code) // FFI address.
+				l.out.Signatures[x.NameID] = x.TypeID
 			}
-			if op, ok := builtins[x.NameID]; ok && len(x.Body) == 1 {
-				if _, ok := x.Body[0].(*ir.Panic); ok {
-					l.m[i] = len(l.out.Code)
-					l.loadBuiltin(op, x)
-					break
+			if isExtern(x) {
+				op, ok := builtins[x.NameID]
+				if !ok {
+					op = hostFunction
 				}
+				l.m[i] = len(l.out.Code)
+				l.loadBuiltin(op, x)
+				break
 			}
 
 			l.out.Code = append(l.out.Code, Operation{Call, i}, Operation{FFIReturn, 0})
@@ -2552,6 +2512,7 @@ func (l *loader) load() error {
 			}
 
 			l.out.Code[i].N = ip
+			l.out.CodeCSRelative = setBit(l.out.CodeCSRelative, i)
 		}
 	}
 	l.out.Data = *buffer.CGet(ds - l.out.BSS)
@@ -2573,6 +2534,7 @@ func (l *loader) load() error {
 		}
 
 		*(*uintptr)(unsafe.Pointer(&l.out.Data[off])) = uintptr(ip)
+		l.out.CSRelative = setBit(l.out.CSRelative, off)
 	}
 	for off, v := range l.tsLabels {
 		nfo := labelNfo{index: v.Index, nm: v.Label}
@@ -2582,6 +2544,7 @@ func (l *loader) load() error {
 		}
 
 		*(*uintptr)(unsafe.Pointer(&l.out.Text[off])) = uintptr(ip)
+		l.out.TextCSRelative = setBit(l.out.TextCSRelative, off)
 	}
 	h := -1
 	for i, v := range l.out.TSRelative {
@@ -2603,6 +2566,9 @@ func (l *loader) load() error {
 // LoadMain translates program in objects into a Binary or an error, if any.
 // It's the caller responsibility to ensure the objects were produced for this
 // architecture and platform.
+//
+// External functions that are neither defined in objects nor builtins are
+// resolved at run time to the host functions bound by the Host option.
 func LoadMain(objects []ir.Object) (_ *Binary, err error) {
 	if !Testing {
 		defer func() {
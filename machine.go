@@ -16,6 +16,7 @@ import (
 
 	"github.com/cznic/ccir/libc/stdlib"
 	"github.com/cznic/internal/buffer"
+	"github.com/cznic/ir"
 	"github.com/cznic/mathutil"
 	"github.com/cznic/memory"
 	"github.com/edsrzf/mmap-go"
@@ -68,12 +69,13 @@ func (m *memWriter) Write(b []byte) (int, error) {
 		return 0, nil
 	}
 
-	*m += memWriter(movemem(uintptr(*m), uintptr((unsafe.Pointer)(&b[0])), len(b)))
+	CopyBytes(uintptr(*m), b, false)
+	*m += memWriter(len(b))
 	return len(b), nil
 }
 
 func movemem(dst, src uintptr, n int) int {
-	return copy((*[math.MaxInt32]byte)(unsafe.Pointer(dst))[:n], (*[math.MaxInt32]byte)(unsafe.Pointer(src))[:n])
+	return copy((*[math.MaxInt32]byte)(memW(dst, n))[:n], (*[math.MaxInt32]byte)(memR(src, n))[:n])
 }
 
 // GoBytes returns a []byte copied from a C char* null terminated string s.
@@ -138,7 +140,7 @@ func GoStringLen(s uintptr, len int) string {
 
 // CopyBytes copies src to dest, optionally adding a zero byte at the end.
 func CopyBytes(dst uintptr, src []byte, addNull bool) {
-	copy((*[math.MaxInt32]byte)(unsafe.Pointer(dst))[:len(src)], src)
+	copy((*[math.MaxInt32]byte)(memW(dst, len(src)))[:len(src)], src)
 	if addNull {
 		writeU8(dst+uintptr(len(src)), 0)
 	}
@@ -146,7 +148,7 @@ func CopyBytes(dst uintptr, src []byte, addNull bool) {
 
 // CopyString copies src to dest, optionally adding a zero byte at the end.
 func CopyString(dst uintptr, src string, addNull bool) {
-	copy((*[math.MaxInt32]byte)(unsafe.Pointer(dst))[:len(src)], src)
+	copy((*[math.MaxInt32]byte)(memW(dst, len(src)))[:len(src)], src)
 	if addNull {
 		writeU8(dst+uintptr(len(src)), 0)
 	}
@@ -161,26 +163,58 @@ type Machine struct {
 	Threads             []*Thread //TODO Unexport?
 	alloc               memory.Allocator
 	allocMu             sync.Mutex
+	allocs              *allocTracker // Non nil when tracking allocations.
+	atExit              []uintptr     // Functions registered by atexit.
+	atExitMu            sync.Mutex
+	blocks              map[uintptr]int // Heap blocks: size. Guarded by allocMu.
 	brk                 uintptr
 	bss                 uintptr
 	bssSize             int
-	code                []Operation
+	conds               *condMap
+	coverage            *Coverage
+	csRelative          []byte // Code-relative pointers in the initial data of the program, see Binary.
+	cycles              int64  // Deterministic mode: Instructions executed in blocks of 1024. Atomic.
+	debugger            *Debugger
+	det                 *determinism // Non nil in the deterministic mode.
+	dlErr               string       // Pending dlerror message. Guarded by libsMu.
+	dlErrP              uintptr      // Last result of dlerror. Guarded by libsMu.
+	dlHandle            uintptr      // Last dlopen handle. Guarded by libsMu.
+	dlMu                sync.Mutex   // Serializes dlopen.
 	ds                  uintptr
 	dsMem               mmap.MMap
-	functions           []PCInfo
-	lines               []PCInfo
+	dsRelative          []byte // Data segment-relative pointers in the initial data of the program.
+	fds                 *fdmap // Open files.
+	files               *fmap  // Open streams.
+	fs                  FileSystem
+	fuel                int64                // Remaining instructions. Negative: not metered. Atomic.
+	globals             map[ir.NameID]Global // External variables of the program.
+	host                map[ir.NameID]HostFunction
+	img                 atomic.Value // *image
+	libs                []*library   // Opened by dlopen. Guarded by libsMu.
+	libsMu              sync.Mutex
+	model               ir.MemoryModel // Guarded by libsMu.
+	mutexes             *mutexMap
+	profileMu           sync.Mutex        // Guards the profiles while threads run.
+	profileStacks       map[string]int    // Key: PCs of the call stack, see cpu.callers.
+	sandbox             *sandbox          // Nil: not sandboxed.
+	sigs                map[int]signature // FFI address: Signature. Guarded by libsMu.
 	stderr              io.Writer
 	stdin               io.Reader
 	stdout              io.Writer
 	stop                chan struct{}
 	stopMu              sync.Mutex
 	stopped             bool
+	syms                map[ir.NameID]int // Exported functions of the program.
+	tc                  ir.TypeCache      // Guarded by libsMu.
 	threadID            uintptr
 	threadsMu           sync.Mutex
+	tm                  uintptr // Result of localtime.
+	tmOnce              sync.Once
 	tracePath           string
 	ts                  uintptr
 	tsFile              *os.File
 	tsMem               mmap.MMap
+	tsRelative          []byte // Text segment-relative pointers in the initial data of the program.
 }
 
 func newMachine(b *Binary, heapSize int, stdin io.Reader, stdout, stderr io.Writer, tracePath string) (*Machine, error) {
@@ -193,6 +227,10 @@ func newMachine(b *Binary, heapSize int, stdin io.Reader, stdout, stderr io.Writ
 		tsMem, dsMem mmap.MMap
 	)
 	if b != nil {
+		if err := b.checkPlatform(); err != nil {
+			return nil, err
+		}
+
 		data = b.Data
 		text = b.Text
 		bssSize = b.BSS
@@ -225,63 +263,94 @@ func newMachine(b *Binary, heapSize int, stdin io.Reader, stdout, stderr io.Writ
 
 		copy(dsMem, data)
 		ds = uintptr(unsafe.Pointer(&dsMem[0]))
-		if b != nil {
-			for i, v := range b.TSRelative {
-				if v == 0 {
-					continue
-				}
-
-				mask := byte(1)
-				for bit := 0; bit < 8; bit++ {
-					if v&mask != 0 {
-						addPtr(ds+uintptr(8*i+bit), ts)
-					}
-					mask <<= 1
-				}
-			}
-			for i, v := range b.DSRelative {
-				if v == 0 {
-					continue
-				}
-
-				mask := byte(1)
-				for bit := 0; bit < 8; bit++ {
-					if v&mask != 0 {
-						addPtr(ds+uintptr(8*i+bit), ds)
-					}
-					mask <<= 1
-				}
-			}
-		}
 	}
 
-	var lines, functions []PCInfo
+	img := &image{}
+	var syms map[ir.NameID]int
+	var globals map[ir.NameID]Global
 	if b != nil {
-		lines = b.Lines
-		functions = b.Functions
+		img.code = b.Code
+		img.functions = b.Functions
+		img.lines = b.Lines
+		globals = b.Globals
+		syms = b.Sym
 	}
-	var code []Operation
-	if b != nil {
-		code = b.Code
-	}
-	return &Machine{
+	m := &Machine{
+		blocks:    map[uintptr]int{},
 		brk:       ds + uintptr(brk),
 		bss:       ds + uintptr(dsSize),
 		bssSize:   bssSize,
-		code:      code,
+		conds:     newCondMap(),
 		ds:        ds,
 		dsMem:     dsMem,
-		functions: functions,
-		lines:     lines,
+		fds:       newFdmap(),
+		files:     newFmap(),
+		fs:        OSFileSystem(),
+		fuel:      -1,
+		globals:   globals,
+		mutexes:   newMutexMap(),
 		stderr:    stderr,
 		stdin:     stdin,
 		stdout:    stdout,
 		stop:      make(chan struct{}),
+		syms:      syms,
 		tracePath: tracePath,
 		ts:        ts,
 		tsFile:    tsFile,
 		tsMem:     tsMem,
-	}, nil
+	}
+	m.img.Store(img)
+	if b != nil {
+		m.addSignatures(b, 0)
+		m.csRelative, m.dsRelative, m.tsRelative = b.CSRelative, b.DSRelative, b.TSRelative
+	}
+	if memcheck {
+		if ts != 0 {
+			memMapAdd(m, ts, len(tsMem), true)
+		}
+		if ds != 0 {
+			memMapAdd(m, ds, len(dsMem), false)
+		}
+	}
+	if b != nil && ds != 0 {
+		relocateData(b, ds, ts)
+	}
+	return m, nil
+}
+
+// image is the code of a machine and its tables. An image is immutable,
+// except for the execution counts, so threads can use it without locking.
+// Loading a library publishes a new image, see Machine.load.
+type image struct {
+	code      []Operation
+	cover     []*uint64 // Execution counts by PC. Atomic. Nil: coverage is off.
+	functions []PCInfo
+	lines     []PCInfo
+}
+
+// image returns the current image of m.
+func (m *Machine) image() *image { return m.img.Load().(*image) }
+
+// setCover turns coverage on, collecting the counts to cov, or off if cov is
+// nil. Must not be called when m is running.
+func (m *Machine) setCover(cov *Coverage) {
+	img := *m.image()
+	img.cover = nil
+	if cov != nil {
+		img.cover = newCover(len(img.code))
+	}
+	m.coverage = cov
+	m.img.Store(&img)
+}
+
+// newCover returns the execution counters of n instructions.
+func newCover(n int) []*uint64 {
+	a := make([]uint64, n)
+	r := make([]*uint64, n)
+	for i := range a {
+		r[i] = &a[i]
+	}
+	return r
 }
 
 // CString allocates a C string initialized from s.
@@ -297,9 +366,29 @@ func (m *Machine) CString(s string) uintptr {
 	return p
 }
 
-// Close frees resources acquired from the OS by m.
+// LookupGlobal returns the address of the external variable nm of the program
+// and whether it was found. The variable occupies Size bytes, see Global, and
+// it can be accessed by the host while no thread of the program modifies it.
+func (m *Machine) LookupGlobal(nm string) (uintptr, bool) {
+	g, ok := m.globals[ir.NameID(dict.SID(nm))]
+	if !ok {
+		return 0, false
+	}
+
+	return m.ds + uintptr(g.Offset), true
+}
+
+// Close frees resources acquired from the OS by m. If m collects code
+// coverage, see the Cover option, its counts are added to the Coverage.
 func (m *Machine) Close() (err error) {
 	m.Kill()
+	if img := m.image(); img.cover != nil {
+		m.coverage.record(img.cover, img.lines)
+		m.setCover(nil)
+	}
+	if e := m.reportLeaks(); e != nil && err == nil {
+		err = e
+	}
 	if m.dsMem != nil {
 		if e := m.dsMem.Unmap(); e != nil && err == nil {
 			err = e
@@ -319,6 +408,14 @@ func (m *Machine) Close() (err error) {
 			err = e
 		}
 	}
+	m.libsMu.Lock()
+	for _, v := range m.libs {
+		if e := v.unmap(); e != nil && err == nil {
+			err = e
+		}
+	}
+	m.libs = nil
+	m.libsMu.Unlock()
 	m.threadsMu.Lock()
 	for _, v := range m.Threads {
 		if e := v.close(); e != nil && err == nil {
@@ -329,6 +426,9 @@ func (m *Machine) Close() (err error) {
 	if e := m.alloc.Close(); e != nil && err == nil {
 		err = e
 	}
+	if memcheck {
+		memMapRemoveAll(m)
+	}
 	return err
 }
 
@@ -344,30 +444,106 @@ func (m *Machine) Kill() {
 	m.stopMu.Unlock()
 }
 
+// Fuel returns the remaining instruction budget of m or -1 if the execution of
+// m is not metered.
+func (m *Machine) Fuel() int64 {
+	if n := atomic.LoadInt64(&m.fuel); n >= 0 {
+		return n
+	}
+
+	return -1
+}
+
+// SetFuel sets the remaining instruction budget of m to n. Negative n turns
+// metering off. SetFuel can be used to refill a machine stopped by
+// OutOfFuelError before calling Thread.FFI.
+func (m *Machine) SetFuel(n int64) {
+	if n < 0 {
+		n = -1
+	}
+	atomic.StoreInt64(&m.fuel, n)
+}
+
+// burn charges n executed instructions to the budget of m and reports whether
+// any fuel remains.
+func (m *Machine) burn(n int64) bool {
+	for {
+		f := atomic.LoadInt64(&m.fuel)
+		if f < 0 {
+			return true
+		}
+
+		r := f - n
+		if r < 0 {
+			r = 0
+		}
+		if atomic.CompareAndSwapInt64(&m.fuel, f, r) {
+			return r != 0
+		}
+	}
+}
+
 func (m *Machine) free(p uintptr) {
 	m.allocMu.Lock()
 	m.alloc.UnsafeFree(unsafe.Pointer(p))
+	delete(m.blocks, p)
 	m.allocMu.Unlock()
+	m.allocs.vmFree(p)
+	if memcheck && p != 0 {
+		memMapRemove(p)
+	}
 }
 
 func (m *Machine) calloc(n int) uintptr {
 	m.allocMu.Lock()
 	p, _ := m.alloc.UnsafeCalloc(n)
+	if p != nil {
+		m.blocks[uintptr(p)] = n
+	}
 	m.allocMu.Unlock()
+	m.allocs.vmAlloc(uintptr(p), n)
+	if memcheck && p != nil {
+		memMapAdd(m, uintptr(p), n, false)
+	}
 	return uintptr(p)
 }
 
 func (m *Machine) malloc(n int) uintptr {
 	m.allocMu.Lock()
 	p, _ := m.alloc.UnsafeMalloc(n)
+	if p != nil {
+		m.blocks[uintptr(p)] = n
+	}
 	m.allocMu.Unlock()
+	m.allocs.vmAlloc(uintptr(p), n)
+	if memcheck && p != nil {
+		memMapAdd(m, uintptr(p), n, false)
+	}
 	return uintptr(p)
 }
 
 func (m *Machine) realloc(p uintptr, n int) uintptr {
 	m.allocMu.Lock()
 	q, _ := m.alloc.UnsafeRealloc(unsafe.Pointer(p), n)
+	if q != nil || n == 0 {
+		delete(m.blocks, p)
+		if q != nil {
+			m.blocks[uintptr(q)] = n
+		}
+	}
 	m.allocMu.Unlock()
+	if q != nil || n == 0 {
+		m.allocs.vmFree(p)
+		m.allocs.vmAlloc(uintptr(q), n)
+	}
+	if memcheck && (q != nil || n == 0) {
+		if p != 0 {
+			memMapRemove(p)
+		}
+		if q != nil {
+			memMapAdd(m, uintptr(q), n, false)
+		}
+	}
 	return uintptr(q)
 }
 
@@ -396,6 +572,9 @@ func (m *Machine) NewThread(stackSize int) (*Thread, error) {
 		ss:       ss,
 		stackMem: stackMem,
 	}
+	if memcheck {
+		memMapAdd(m, ss, stackSize, false)
+	}
 	t.tls = t.cpu.sp
 	t.tlsp = (*tls)(unsafe.Pointer(t.cpu.sp))
 	t.tlsp.threadID = atomic.AddUintptr(&m.threadID, 1)
@@ -407,6 +586,17 @@ func (m *Machine) NewThread(stackSize int) (*Thread, error) {
 	return t, nil
 }
 
+// thread returns the thread having threadID id or nil if there's no such
+// thread. The caller must hold m.threadsMu.
+func (m *Machine) thread(id uintptr) *Thread {
+	for _, v := range m.Threads {
+		if v.tlsp.threadID == id {
+			return v
+		}
+	}
+	return nil
+}
+
 func (m *Machine) sbrk(n int) uintptr {
 	m.brk += uintptr(roundup(n, mallocAlign))
 	return m.brk
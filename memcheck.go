@@ -0,0 +1,159 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+// Programs built with the virtual.memcheck tag validate every memory access
+// of the guest code. The valid memory is the data/BSS/heap segment, the stacks
+// of threads, the text segment (read only), blocks returned by malloc and
+// friends until freed and mmap'ed regions until unmapped. Invalid accesses
+// panic with MemoryFault, which the CPU turns into an error including a stack
+// trace.
+
+// MemoryFault describes an invalid memory access detected in the memcheck
+// mode.
+type MemoryFault struct {
+	Addr  uintptr
+	Size  int
+	Write bool
+}
+
+// Error implements error.
+func (e MemoryFault) Error() string {
+	s := "read"
+	if e.Write {
+		s = "write"
+	}
+	return fmt.Sprintf("memory fault: invalid %s of %v bytes at %#x", s, e.Size, e.Addr)
+}
+
+type memRange struct {
+	hi uintptr
+	lo uintptr
+	m  *Machine
+	ro bool // Read only.
+}
+
+// The memory map is indexed by pages. Every page overlapped by a range lists
+// the range, so registering or looking up a block costs time proportional to
+// its size in pages and to the number of blocks on a page, not to the number
+// of all blocks.
+const memPageShift = 12
+
+var (
+	memMapMu  sync.RWMutex
+	memPages  = map[uintptr][]*memRange{} // Page: ranges overlapping the page, sorted by lo.
+	memRanges = map[uintptr]*memRange{}   // lo: range.
+)
+
+func memPageRange(r *memRange) (uintptr, uintptr) {
+	last := r.hi - 1
+	if r.hi == r.lo {
+		last = r.lo
+	}
+	return r.lo >> memPageShift, last >> memPageShift
+}
+
+// memMapAdd registers n bytes at p as valid memory of m.
+func memMapAdd(m *Machine, p uintptr, n int, ro bool) {
+	r := &memRange{hi: p + uintptr(n), lo: p, m: m, ro: ro}
+	memMapMu.Lock()
+	if old := memRanges[p]; old != nil {
+		memMapDel(old)
+	}
+	memRanges[p] = r
+	first, last := memPageRange(r)
+	for pg := first; ; pg++ {
+		s := memPages[pg]
+		i := sort.Search(len(s), func(i int) bool { return s[i].lo >= p })
+		s = append(s, nil)
+		copy(s[i+1:], s[i:])
+		s[i] = r
+		memPages[pg] = s
+		if pg == last {
+			break
+		}
+	}
+	memMapMu.Unlock()
+}
+
+// memMapDel unregisters r. Must be called with memMapMu locked.
+func memMapDel(r *memRange) {
+	delete(memRanges, r.lo)
+	first, last := memPageRange(r)
+	for pg := first; ; pg++ {
+		s := memPages[pg]
+		for i, v := range s {
+			if v == r {
+				s = append(s[:i], s[i+1:]...)
+				break
+			}
+		}
+		switch {
+		case len(s) == 0:
+			delete(memPages, pg)
+		default:
+			memPages[pg] = s
+		}
+		if pg == last {
+			break
+		}
+	}
+}
+
+// memMapRemove unregisters the memory registered at p.
+func memMapRemove(p uintptr) {
+	memMapMu.Lock()
+	if r := memRanges[p]; r != nil {
+		memMapDel(r)
+	}
+	memMapMu.Unlock()
+}
+
+// memMapRemoveAll unregisters all memory of m.
+func memMapRemoveAll(m *Machine) {
+	memMapMu.Lock()
+	for _, v := range memRanges {
+		if v.m == m {
+			memMapDel(v)
+		}
+	}
+	memMapMu.Unlock()
+}
+
+func memCheck(p uintptr, n int, write bool) {
+	memMapMu.RLock()
+	s := memPages[p>>memPageShift]
+	i := sort.Search(len(s), func(i int) bool { return s[i].lo > p }) - 1
+	ok := i >= 0 && p+uintptr(n) <= s[i].hi && p+uintptr(n) >= p && !(write && s[i].ro)
+	memMapMu.RUnlock()
+	if !ok {
+		panic(MemoryFault{Addr: p, Size: n, Write: write})
+	}
+}
+
+// memR returns p as an unsafe.Pointer after checking, in the memcheck mode,
+// that n bytes at p can be read.
+func memR(p uintptr, n int) unsafe.Pointer {
+	if memcheck && n != 0 {
+		memCheck(p, n, false)
+	}
+	return unsafe.Pointer(p)
+}
+
+// memW returns p as an unsafe.Pointer after checking, in the memcheck mode,
+// that n bytes at p can be written.
+func memW(p uintptr, n int) unsafe.Pointer {
+	if memcheck && n != 0 {
+		memCheck(p, n, true)
+	}
+	return unsafe.Pointer(p)
+}
@@ -0,0 +1,9 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build virtual.memcheck
+
+package virtual
+
+const memcheck = true
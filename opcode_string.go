@@ -4,9 +4,9 @@ package virtual
 
 import "fmt"
 
-const _Opcode_name = "NopAPAddF32AddF64AddC64AddC128AddI32AddI64AddPtrAddPtrsAddSPAnd16And32And64And8ArgumentArgument16Argument32Argument64Argument8ArgumentsArgumentsFPBPBitfieldI8BitfieldI16BitfieldI32BitfieldI64BitfieldU8BitfieldU16BitfieldU32BitfieldU64BoolC128BoolF32BoolF64BoolI16BoolI32BoolI64BoolI8CallCallFPConvC64C128ConvF32C128ConvF32C64ConvF32F64ConvF32I32ConvF32I64ConvF32U32ConvF64C128ConvF64F32ConvF64I32ConvF64I64ConvF64I8ConvF64U16ConvF64U32ConvF64U64ConvI16I32ConvI16I64ConvI16U32ConvI32C128ConvI32C64ConvI32F32ConvI32F64ConvI32I16ConvI32I64ConvI32I8ConvI64ConvI64F64ConvI64I16ConvI64I32ConvI64I8ConvI64U16ConvI8I16ConvI8I32ConvI8I64ConvI8F64ConvI8U32ConvU16I32ConvU16I64ConvU16U32ConvU16U64ConvU32F32ConvU32F64ConvU32I16ConvU32I64ConvU32U8ConvU8I16ConvU8I32ConvU8U32ConvU8U64CopyCpl32Cpl64Cpl8DSDSC128DSI16DSI32DSI64DSI8DSNDivC128DivC64DivF32DivF64DivI32DivI64DivU32DivU64Dup32Dup64Dup8EqF32EqF64EqI32EqI64EqI8ExtFFIReturnFPField16Field64Field8FuncGeqF32GeqF64GeqI32GeqI64GeqI8GeqU32GeqU64GtF32GtF64GtI32GtI64GtU32GtU64IndexIndexI16IndexU16IndexI32IndexI64IndexI8IndexU32IndexU64IndexU8JmpJmpPJnzJzLabelLeqF32LeqF64LeqI32LeqI64LeqI8LeqU32LeqU64LoadLoad16Load32Load64Load8LshI16LshI32LshI64LshI8LtF32LtF64LtI32LtI64LtU32LtU64MulC128MulC64MulF32MulF64MulI32MulI64NegF32NegF64NegI16NegI32NegI64NegI8NegIndexI32NegIndexI64NegIndexU16NegIndexU32NegIndexU64NeqC128NeqC64NeqF32NeqF64NeqI32NeqI64NeqI8NotOr32Or64PanicPostIncF64PostIncI16PostIncI32PostIncI64PostIncI8PostIncPtrPostIncU32BitsPostIncU64BitsPreIncI16PreIncI32PreIncI64PreIncI8PreIncPtrPreIncU32BitsPreIncU64BitsPtrDiffPush16Push32Push64Push8PushC128RemI32RemI64RemU32RemU64ReturnRshI16RshI32RshI64RshI8RshU16RshU32RshU64RshU8StoreStore16Store32Store64Store8StoreBits16StoreBits32StoreBits64StoreBits8StoreC128StrNCopySubF32SubF64SubI32SubI64SubPtrsSwitchI32SwitchI64TextVariableVariable16Variable32Variable64Variable8Xor32Xor64Zero8Zero16Zero32Zero64__assert_fail__signbit__signbitfabortabsaccessacosallocaasinatanatexitatoibswap32bswap64builtinbzerocallocceilcimagfclose_clrsbclrsblclrsbllclzclzlclzllconnectcopysigncoscoshcrealfctzctzlctzlldlclosedlerrordlopendlsymerrno_locationexitexpfabsfchmodfchownfclosefcntlferrorfflushffsffslffsllfgetcfgetsfloorfopen64fprintfframeAddressfreadfreefseekfstat64fsyncftellftruncate64fwritegetcwdgetenvgeteuidgethostbynamegethostnamegetpeernamegetpidgetsocknamegetsockoptgettimeofdayhtonlhtonsisinfisinffisinflisprintlocaltimeloglog10longjmplseek64lstat64mallocmalloc_usable_sizememcmpmemcpymemmovemempcpymemsetmkdirmmap64munmapopen64parityparitylparityllpopcountpopcountlpopcountllpowprintfpthread_cond_broadcastpthread_cond_destroypthread_cond_initpthread_cond_signalpthread_cond_waitpthread_createpthread_detachpthread_equalpthread_joinpthread_mutex_destroypthread_mutex_initpthread_mutex_lockpthread_mutex_trylockpthread_mutex_unlockpthread_mutexattr_destroypthread_mutexattr_initpthread_mutexattr_settypepthread_selfputsqsortreadreadlinkreallocrecvregister_stdfilesreturnAddressrewindrmdirroundsched_yieldselect_setjmpsetsockoptshutdownsinsinhsleepsnprintfsocketsprintfsqrtstat64strcatstrchrstrcmpstrcpystrerror_rstrlenstrncmpstrncpystrrchrstrtoulsysconfsystemtantanhtimetolowerunlinkusleeputimesvfprintfvprintfwritewritev_beginthreadex_endthreadex_msizeAreFileApisANSICloseHandleCreateFileMappingACreateFileMappingWCreateMutexWCreateFileACreateFileWDeleteCriticalSectionDeleteFileADeleteFileWEnterCriticalSectionFlushFileBuffersFlushViewOfFileFormatMessageAFormatMessageWFreeLibraryGetCurrentProcessIdGetCurrentThreadIdGetDiskFreeSpaceAGetDiskFreeSpaceWGetFileAttributesAGetFileAttributesWGetFileAttributesExWGetFileSizeGetFullPathNameAGetFullPathNameWGetLastErrorGetProcAddressGetProcessHeapGetSystemInfoGetSystemTimeGetSystemTimeAsFileTimeGetTempPathAGetTempPathWGetTickCountGetVersionExAGetVersionExWHeapAllocHeapCreateHeapCompactHeapDestroyHeapFreeHeapReAllocHeapSizeHeapValidateInitializeCriticalSectionInterlockedCompareExchangeLoadLibraryALoadLibraryWLocalFreeLockFileLockFileExLeaveCriticalSectionMapViewOfFileMultiByteToWideCharOutputDebugStringAOutputDebugStringWQueryPerformanceCounterReadFileSetEndOfFileSetFilePointerSleepSystemTimeToFileTimeUnlockFileUnlockFileExUnmapViewOfFileWaitForSingleObjectWaitForSingleObjectExWideCharToMultiByteWriteFilepauseputcharsignal_isattystrdup__sysv_signalgetcharrandomfilenoungetcmemchrperror"
+const _Opcode_name = "NopAPAddF32AddF64AddC64AddC128AddI32AddI64AddPtrAddPtrsAddSPAnd16And32And64And8ArgumentArgument16Argument32Argument64Argument8ArgumentsArgumentsFPBPBitfieldI8BitfieldI16BitfieldI32BitfieldI64BitfieldU8BitfieldU16BitfieldU32BitfieldU64BoolC128BoolF32BoolF64BoolI16BoolI32BoolI64BoolI8CallCallFPConvC64C128ConvF32C128ConvF32C64ConvF32F64ConvF32I32ConvF32I64ConvF32U32ConvF64C128ConvF64F32ConvF64I32ConvF64I64ConvF64I8ConvF64U16ConvF64U32ConvF64U64ConvI16I32ConvI16I64ConvI16U32ConvI32C128ConvI32C64ConvI32F32ConvI32F64ConvI32I16ConvI32I64ConvI32I8ConvI64ConvI64F64ConvI64I16ConvI64I32ConvI64I8ConvI64U16ConvI8I16ConvI8I32ConvI8I64ConvI8F64ConvI8U32ConvU16I32ConvU16I64ConvU16U32ConvU16U64ConvU32F32ConvU32F64ConvU32I16ConvU32I64ConvU32U8ConvU8I16ConvU8I32ConvU8U32ConvU8U64CopyCpl32Cpl64Cpl8DSDSC128DSI16DSI32DSI64DSI8DSNDivC128DivC64DivF32DivF64DivI32DivI64DivU32DivU64Dup32Dup64Dup8EqF32EqF64EqI32EqI64EqI8ExtFFIReturnFPField16Field64Field8FuncGeqF32GeqF64GeqI32GeqI64GeqI8GeqU32GeqU64GtF32GtF64GtI32GtI64GtU32GtU64IndexIndexI16IndexU16IndexI32IndexI64IndexI8IndexU32IndexU64IndexU8JmpJmpPJnzJzLabelLeqF32LeqF64LeqI32LeqI64LeqI8LeqU32LeqU64LoadLoad16Load32Load64Load8LshI16LshI32LshI64LshI8LtF32LtF64LtI32LtI64LtU32LtU64MulC128MulC64MulF32MulF64MulI32MulI64NegF32NegF64NegI16NegI32NegI64NegI8NegIndexI32NegIndexI64NegIndexU16NegIndexU32NegIndexU64NeqC128NeqC64NeqF32NeqF64NeqI32NeqI64NeqI8NotOr32Or64PanicPostIncF64PostIncI16PostIncI32PostIncI64PostIncI8PostIncPtrPostIncU32BitsPostIncU64BitsPreIncI16PreIncI32PreIncI64PreIncI8PreIncPtrPreIncU32BitsPreIncU64BitsPtrDiffPush16Push32Push64Push8PushC128RemI32RemI64RemU32RemU64ReturnRshI16RshI32RshI64RshI8RshU16RshU32RshU64RshU8StoreStore16Store32Store64Store8StoreBits16StoreBits32StoreBits64StoreBits8StoreC128StrNCopySubF32SubF64SubI32SubI64SubPtrsSwitchI32SwitchI64TextVariableVariable16Variable32Variable64Variable8Xor32Xor64Zero8Zero16Zero32Zero64__assert_fail__signbit__signbitfabortabsaccessacosallocaasinatanatexitatoibswap32bswap64builtinbzerocallocceilcimagfclose_clrsbclrsblclrsbllclzclzlclzllconnectcopysigncoscoshcrealfctzctzlctzlldlclosedlerrordlopendlsymerrno_locationexitexpfabsfchmodfchownfclosefcntlferrorfflushffsffslffsllfgetcfgetsfloorfopen64fprintfframeAddressfreadfreefseekfstat64fsyncftellftruncate64fwritegetcwdgetenvgeteuidgethostbynamegethostnamegetpeernamegetpidgetsocknamegetsockoptgettimeofdayhtonlhtonsisinfisinffisinflisprintlocaltimeloglog10longjmplseek64lstat64mallocmalloc_usable_sizememcmpmemcpymemmovemempcpymemsetmkdirmmap64munmapopen64parityparitylparityllpopcountpopcountlpopcountllpowprintfpthread_cond_broadcastpthread_cond_destroypthread_cond_initpthread_cond_signalpthread_cond_waitpthread_createpthread_detachpthread_equalpthread_joinpthread_mutex_destroypthread_mutex_initpthread_mutex_lockpthread_mutex_trylockpthread_mutex_unlockpthread_mutexattr_destroypthread_mutexattr_initpthread_mutexattr_settypepthread_selfputsqsortreadreadlinkreallocrecvregister_stdfilesreturnAddressrewindrmdirroundsched_yieldselect_setjmpsetsockoptshutdownsinsinhsleepsnprintfsocketsprintfsqrtstat64strcatstrchrstrcmpstrcpystrerror_rstrlenstrncmpstrncpystrrchrstrtoulsysconfsystemtantanhtimetolowerunlinkusleeputimesvfprintfvprintfwritewritev_beginthreadex_endthreadex_msizeAreFileApisANSICloseHandleCreateFileMappingACreateFileMappingWCreateMutexWCreateFileACreateFileWDeleteCriticalSectionDeleteFileADeleteFileWEnterCriticalSectionFlushFileBuffersFlushViewOfFileFormatMessageAFormatMessageWFreeLibraryGetCurrentProcessIdGetCurrentThreadIdGetDiskFreeSpaceAGetDiskFreeSpaceWGetFileAttributesAGetFileAttributesWGetFileAttributesExWGetFileSizeGetFullPathNameAGetFullPathNameWGetLastErrorGetProcAddressGetProcessHeapGetSystemInfoGetSystemTimeGetSystemTimeAsFileTimeGetTempPathAGetTempPathWGetTickCountGetVersionExAGetVersionExWHeapAllocHeapCreateHeapCompactHeapDestroyHeapFreeHeapReAllocHeapSizeHeapValidateInitializeCriticalSectionInterlockedCompareExchangeLoadLibraryALoadLibraryWLocalFreeLockFileLockFileExLeaveCriticalSectionMapViewOfFileMultiByteToWideCharOutputDebugStringAOutputDebugStringWQueryPerformanceCounterReadFileSetEndOfFileSetFilePointerSleepSystemTimeToFileTimeUnlockFileUnlockFileExUnmapViewOfFileWaitForSingleObjectWaitForSingleObjectExWideCharToMultiByteWriteFilepauseputcharsignal_isattystrdup__sysv_signalgetcharrandomfilenoungetcmemchrperrorhostFunctionfscanfscanfsscanfvfscanfvscanfvsscanf"
 
-var _Opcode_index = [...]uint16{0, 3, 5, 11, 17, 23, 30, 36, 42, 48, 55, 60, 65, 70, 75, 79, 87, 97, 107, 117, 126, 135, 146, 148, 158, 169, 180, 191, 201, 212, 223, 234, 242, 249, 256, 263, 270, 277, 283, 287, 293, 304, 315, 325, 335, 345, 355, 365, 376, 386, 396, 406, 415, 425, 435, 445, 455, 465, 475, 486, 496, 506, 516, 526, 536, 545, 552, 562, 572, 582, 591, 601, 610, 619, 628, 637, 646, 656, 666, 676, 686, 696, 706, 716, 726, 735, 744, 753, 762, 771, 775, 780, 785, 789, 791, 797, 802, 807, 812, 816, 819, 826, 832, 838, 844, 850, 856, 862, 868, 873, 878, 882, 887, 892, 897, 902, 906, 909, 918, 920, 927, 934, 940, 944, 950, 956, 962, 968, 973, 979, 985, 990, 995, 1000, 1005, 1010, 1015, 1020, 1028, 1036, 1044, 1052, 1059, 1067, 1075, 1082, 1085, 1089, 1092, 1094, 1099, 1105, 1111, 1117, 1123, 1128, 1134, 1140, 1144, 1150, 1156, 1162, 1167, 1173, 1179, 1185, 1190, 1195, 1200, 1205, 1210, 1215, 1220, 1227, 1233, 1239, 1245, 1251, 1257, 1263, 1269, 1275, 1281, 1287, 1292, 1303, 1314, 1325, 1336, 1347, 1354, 1360, 1366, 1372, 1378, 1384, 1389, 1392, 1396, 1400, 1405, 1415, 1425, 1435, 1445, 1454, 1464, 1478, 1492, 1501, 1510, 1519, 1527, 1536, 1549, 1562, 1569, 1575, 1581, 1587, 1592, 1600, 1606, 1612, 1618, 1624, 1630, 1636, 1642, 1648, 1653, 1659, 1665, 1671, 1676, 1681, 1688, 1695, 1702, 1708, 1719, 1730, 1741, 1751, 1760, 1768, 1774, 1780, 1786, 1792, 1799, 1808, 1817, 1821, 1829, 1839, 1849, 1859, 1868, 1873, 1878, 1883, 1889, 1895, 1901, 1914, 1923, 1933, 1938, 1941, 1947, 1951, 1957, 1961, 1965, 1971, 1975, 1982, 1989, 1996, 2001, 2007, 2011, 2017, 2023, 2028, 2034, 2041, 2044, 2048, 2053, 2060, 2068, 2071, 2075, 2081, 2084, 2088, 2093, 2100, 2107, 2113, 2118, 2132, 2136, 2139, 2143, 2149, 2155, 2161, 2166, 2172, 2178, 2181, 2185, 2190, 2195, 2200, 2205, 2212, 2219, 2231, 2236, 2240, 2245, 2252, 2257, 2262, 2273, 2279, 2285, 2291, 2298, 2311, 2322, 2333, 2339, 2350, 2360, 2372, 2377, 2382, 2387, 2393, 2399, 2406, 2415, 2418, 2423, 2430, 2437, 2444, 2450, 2468, 2474, 2480, 2487, 2494, 2500, 2505, 2511, 2517, 2523, 2529, 2536, 2544, 2552, 2561, 2571, 2574, 2580, 2602, 2622, 2639, 2658, 2675, 2689, 2703, 2716, 2728, 2749, 2767, 2785, 2806, 2826, 2851, 2873, 2898, 2910, 2914, 2919, 2923, 2931, 2938, 2942, 2959, 2972, 2978, 2983, 2988, 2999, 3006, 3012, 3022, 3030, 3033, 3037, 3042, 3050, 3056, 3063, 3067, 3073, 3079, 3085, 3091, 3097, 3107, 3113, 3120, 3127, 3134, 3141, 3148, 3154, 3157, 3161, 3165, 3172, 3178, 3184, 3190, 3198, 3205, 3210, 3216, 3230, 3242, 3248, 3263, 3274, 3292, 3310, 3322, 3333, 3344, 3365, 3376, 3387, 3407, 3423, 3438, 3452, 3466, 3477, 3496, 3514, 3531, 3548, 3566, 3584, 3604, 3615, 3631, 3647, 3659, 3673, 3687, 3700, 3713, 3736, 3748, 3760, 3772, 3785, 3798, 3807, 3817, 3828, 3839, 3847, 3858, 3866, 3878, 3903, 3929, 3941, 3953, 3962, 3970, 3980, 4000, 4013, 4032, 4050, 4068, 4091, 4099, 4111, 4125, 4130, 4150, 4160, 4172, 4187, 4206, 4227, 4246, 4255, 4260, 4267, 4274, 4280, 4286, 4299, 4306, 4312, 4318, 4324, 4330, 4336}
+var _Opcode_index = [...]uint16{0, 3, 5, 11, 17, 23, 30, 36, 42, 48, 55, 60, 65, 70, 75, 79, 87, 97, 107, 117, 126, 135, 146, 148, 158, 169, 180, 191, 201, 212, 223, 234, 242, 249, 256, 263, 270, 277, 283, 287, 293, 304, 315, 325, 335, 345, 355, 365, 376, 386, 396, 406, 415, 425, 435, 445, 455, 465, 475, 486, 496, 506, 516, 526, 536, 545, 552, 562, 572, 582, 591, 601, 610, 619, 628, 637, 646, 656, 666, 676, 686, 696, 706, 716, 726, 735, 744, 753, 762, 771, 775, 780, 785, 789, 791, 797, 802, 807, 812, 816, 819, 826, 832, 838, 844, 850, 856, 862, 868, 873, 878, 882, 887, 892, 897, 902, 906, 909, 918, 920, 927, 934, 940, 944, 950, 956, 962, 968, 973, 979, 985, 990, 995, 1000, 1005, 1010, 1015, 1020, 1028, 1036, 1044, 1052, 1059, 1067, 1075, 1082, 1085, 1089, 1092, 1094, 1099, 1105, 1111, 1117, 1123, 1128, 1134, 1140, 1144, 1150, 1156, 1162, 1167, 1173, 1179, 1185, 1190, 1195, 1200, 1205, 1210, 1215, 1220, 1227, 1233, 1239, 1245, 1251, 1257, 1263, 1269, 1275, 1281, 1287, 1292, 1303, 1314, 1325, 1336, 1347, 1354, 1360, 1366, 1372, 1378, 1384, 1389, 1392, 1396, 1400, 1405, 1415, 1425, 1435, 1445, 1454, 1464, 1478, 1492, 1501, 1510, 1519, 1527, 1536, 1549, 1562, 1569, 1575, 1581, 1587, 1592, 1600, 1606, 1612, 1618, 1624, 1630, 1636, 1642, 1648, 1653, 1659, 1665, 1671, 1676, 1681, 1688, 1695, 1702, 1708, 1719, 1730, 1741, 1751, 1760, 1768, 1774, 1780, 1786, 1792, 1799, 1808, 1817, 1821, 1829, 1839, 1849, 1859, 1868, 1873, 1878, 1883, 1889, 1895, 1901, 1914, 1923, 1933, 1938, 1941, 1947, 1951, 1957, 1961, 1965, 1971, 1975, 1982, 1989, 1996, 2001, 2007, 2011, 2017, 2023, 2028, 2034, 2041, 2044, 2048, 2053, 2060, 2068, 2071, 2075, 2081, 2084, 2088, 2093, 2100, 2107, 2113, 2118, 2132, 2136, 2139, 2143, 2149, 2155, 2161, 2166, 2172, 2178, 2181, 2185, 2190, 2195, 2200, 2205, 2212, 2219, 2231, 2236, 2240, 2245, 2252, 2257, 2262, 2273, 2279, 2285, 2291, 2298, 2311, 2322, 2333, 2339, 2350, 2360, 2372, 2377, 2382, 2387, 2393, 2399, 2406, 2415, 2418, 2423, 2430, 2437, 2444, 2450, 2468, 2474, 2480, 2487, 2494, 2500, 2505, 2511, 2517, 2523, 2529, 2536, 2544, 2552, 2561, 2571, 2574, 2580, 2602, 2622, 2639, 2658, 2675, 2689, 2703, 2716, 2728, 2749, 2767, 2785, 2806, 2826, 2851, 2873, 2898, 2910, 2914, 2919, 2923, 2931, 2938, 2942, 2959, 2972, 2978, 2983, 2988, 2999, 3006, 3012, 3022, 3030, 3033, 3037, 3042, 3050, 3056, 3063, 3067, 3073, 3079, 3085, 3091, 3097, 3107, 3113, 3120, 3127, 3134, 3141, 3148, 3154, 3157, 3161, 3165, 3172, 3178, 3184, 3190, 3198, 3205, 3210, 3216, 3230, 3242, 3248, 3263, 3274, 3292, 3310, 3322, 3333, 3344, 3365, 3376, 3387, 3407, 3423, 3438, 3452, 3466, 3477, 3496, 3514, 3531, 3548, 3566, 3584, 3604, 3615, 3631, 3647, 3659, 3673, 3687, 3700, 3713, 3736, 3748, 3760, 3772, 3785, 3798, 3807, 3817, 3828, 3839, 3847, 3858, 3866, 3878, 3903, 3929, 3941, 3953, 3962, 3970, 3980, 4000, 4013, 4032, 4050, 4068, 4091, 4099, 4111, 4125, 4130, 4150, 4160, 4172, 4187, 4206, 4227, 4246, 4255, 4260, 4267, 4274, 4280, 4286, 4299, 4306, 4312, 4318, 4324, 4330, 4336, 4348, 4354, 4359, 4365, 4372, 4378, 4385}
 
 func (i Opcode) String() string {
 	if i < 0 || i >= Opcode(len(_Opcode_index)-1) {
@@ -0,0 +1,199 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/cznic/ir"
+)
+
+// callers returns the PCs of the active function calls of c, innermost first,
+// encoded as a map key.
+func (c *cpu) callers() string {
+	var b []byte
+	var a [8]byte
+	top := c.thread.ss + uintptr(len(c.thread.stackMem)) - tlsStackSize
+	bp := c.bp
+	ip := c.ip
+	for ip < uintptr(len(c.code)) {
+		binary.LittleEndian.PutUint64(a[:], uint64(ip))
+		b = append(b, a[:]...)
+		// bp -> saved bp, saved ap, return address.
+		if bp < c.thread.ss || bp+3*ptrStackSz > top {
+			break
+		}
+
+		ip = readPtr(bp+2*ptrStackSz) - 1
+		bp = readPtr(bp)
+	}
+	return string(b)
+}
+
+// pbuf is a minimal protocol buffers encoder.
+type pbuf []byte
+
+func (p *pbuf) varint(n uint64) {
+	for n >= 0x80 {
+		*p = append(*p, byte(n)|0x80)
+		n >>= 7
+	}
+	*p = append(*p, byte(n))
+}
+
+func (p *pbuf) int(field int, n int64) {
+	if n == 0 {
+		return
+	}
+
+	p.varint(uint64(field) << 3)
+	p.varint(uint64(n))
+}
+
+func (p *pbuf) bytes(field int, b []byte) {
+	p.varint(uint64(field)<<3 | 2)
+	p.varint(uint64(len(b)))
+	*p = append(*p, b...)
+}
+
+func (p *pbuf) ints(field int, n []int64) {
+	var b pbuf
+	for _, v := range n {
+		b.varint(uint64(v))
+	}
+	p.bytes(field, b)
+}
+
+type pprofFunc struct {
+	name ir.NameID
+	file ir.NameID
+}
+
+// WritePprof writes the call stack samples collected using the ProfileStacks
+// option to w in the gzipped profile.proto format understood by 'go tool
+// pprof'. Samples are collected only by programs built with the
+// virtual.profile tag.
+func (m *Machine) WritePprof(w io.Writer) error {
+	if m.profileStacks == nil {
+		return fmt.Errorf("WritePprof: call stack profiling not enabled")
+	}
+
+	var (
+		p       pbuf
+		strings = map[string]int64{"": 0}
+		strtab  = []string{""}
+	)
+	str := func(s string) int64 {
+		if id, ok := strings[s]; ok {
+			return id
+		}
+
+		id := int64(len(strtab))
+		strings[s] = id
+		strtab = append(strtab, s)
+		return id
+	}
+
+	valueType := func(field int, typ, unit string) {
+		var b pbuf
+		b.int(1, str(typ))
+		b.int(2, str(unit))
+		p.bytes(field, b)
+	}
+
+	period := int64(m.ProfileRate)
+	if period <= 0 {
+		period = 1
+	}
+	valueType(1, "samples", "count")
+	valueType(1, "instructions", "count")
+
+	m.profileMu.Lock()
+	stacks := make(map[string]int, len(m.profileStacks))
+	for k, v := range m.profileStacks {
+		stacks[k] = v
+	}
+	m.profileMu.Unlock()
+	keys := make([]string, 0, len(stacks))
+	for k := range stacks {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	locs := map[uint64]int64{}
+	var pcs []uint64
+	for _, k := range keys {
+		var ids []int64
+		for i := 0; i < len(k); i += 8 {
+			pc := binary.LittleEndian.Uint64([]byte(k[i : i+8]))
+			id, ok := locs[pc]
+			if !ok {
+				id = int64(len(pcs) + 1)
+				locs[pc] = id
+				pcs = append(pcs, pc)
+			}
+			ids = append(ids, id)
+		}
+		var b pbuf
+		b.ints(1, ids)
+		n := int64(stacks[k])
+		b.ints(2, []int64{n, n * period})
+		p.bytes(2, b)
+	}
+
+	funcs := map[pprofFunc]int64{}
+	var funcList []pprofFunc
+	for i, pc := range pcs {
+		fi := m.pcInfo(int(pc), m.image().functions)
+		li := m.pcInfo(int(pc), m.image().lines)
+		f := pprofFunc{fi.Name, li.Name}
+		id, ok := funcs[f]
+		if !ok {
+			id = int64(len(funcList) + 1)
+			funcs[f] = id
+			funcList = append(funcList, f)
+		}
+		var line pbuf
+		line.int(1, id)
+		line.int(2, int64(li.Line))
+		var b pbuf
+		b.int(1, int64(i+1))
+		b.int(3, int64(pc))
+		b.bytes(4, line)
+		p.bytes(4, b)
+	}
+
+	for i, f := range funcList {
+		name := string(dict.S(int(f.name)))
+		if name == "" {
+			name = "?"
+		}
+		var b pbuf
+		b.int(1, int64(i+1))
+		b.int(2, str(name))
+		b.int(3, str(name))
+		b.int(4, str(string(dict.S(int(f.file)))))
+		p.bytes(5, b)
+	}
+
+	var pt pbuf
+	pt.int(1, str("instructions"))
+	pt.int(2, str("count"))
+	for _, s := range strtab {
+		p.bytes(6, []byte(s))
+	}
+	p.bytes(11, pt)
+	p.int(12, period)
+
+	z := gzip.NewWriter(w)
+	if _, err := z.Write(p); err != nil {
+		return err
+	}
+
+	return z.Close()
+}
@@ -15,13 +15,13 @@ import (
 
 func init() {
 	registerBuiltins(map[int]Opcode{
-		dict.SID("pthread_cond_broadcast"): pthread_cond_broadcast,
-		dict.SID("pthread_cond_destroy"):   pthread_cond_destroy,
-		dict.SID("pthread_cond_init"):      pthread_cond_init,
-		dict.SID("pthread_cond_signal"):    pthread_cond_signal,
-		dict.SID("pthread_cond_wait"):      pthread_cond_wait,
-		dict.SID("pthread_create"):         pthread_create,
-		/// 		dict.SID("pthread_detach"):            pthread_detach,
+		dict.SID("pthread_cond_broadcast"):    pthread_cond_broadcast,
+		dict.SID("pthread_cond_destroy"):      pthread_cond_destroy,
+		dict.SID("pthread_cond_init"):         pthread_cond_init,
+		dict.SID("pthread_cond_signal"):       pthread_cond_signal,
+		dict.SID("pthread_cond_wait"):         pthread_cond_wait,
+		dict.SID("pthread_create"):            pthread_create,
+		dict.SID("pthread_detach"):            pthread_detach,
 		dict.SID("pthread_equal"):             pthread_equal,
 		dict.SID("pthread_join"):              pthread_join,
 		dict.SID("pthread_mutex_destroy"):     pthread_mutex_destroy,
@@ -77,16 +77,15 @@ func (m *condMap) cond(p uintptr, mu *mu) *sync.Cond {
 	return r
 }
 
-var (
-	conds   = &condMap{m: map[uintptr]*sync.Cond{}}
-	mutexes = &mutexMap{m: map[uintptr]*mu{}}
-)
+func newCondMap() *condMap { return &condMap{m: map[uintptr]*sync.Cond{}} }
+
+func newMutexMap() *mutexMap { return &mutexMap{m: map[uintptr]*mu{}} }
 
 // int pthread_cond_broadcast(pthread_cond_t *cond);
 func (c *cpu) pthreadCondBroadcast() {
 	cond := readPtr(c.sp)
 	mu := &mu{}
-	conds.cond(cond, mu).Broadcast()
+	c.m.conds.cond(cond, mu).Broadcast()
 	var r int32
 	if ptrace {
 		fmt.Fprintf(os.Stderr, "pthread_cond_broadcast(%#x) %v\n", cond, r)
@@ -97,9 +96,9 @@ func (c *cpu) pthreadCondBroadcast() {
 // int pthread_cond_destroy(pthread_cond_t *cond);
 func (c *cpu) pthreadCondDestroy() {
 	cond := readPtr(c.sp)
-	conds.Lock()
-	delete(conds.m, cond)
-	conds.Unlock()
+	c.m.conds.Lock()
+	delete(c.m.conds.m, cond)
+	c.m.conds.Unlock()
 	var r int32
 	if ptrace {
 		fmt.Fprintf(os.Stderr, "pthread_cond_destroy(%#x) %v\n", cond, r)
@@ -125,7 +124,7 @@ func (c *cpu) pthreadCondInit() {
 func (c *cpu) pthreadCondSignal() {
 	cond := readPtr(c.sp)
 	mu := &mu{}
-	conds.cond(cond, mu).Signal()
+	c.m.conds.cond(cond, mu).Signal()
 	var r int32
 	if ptrace {
 		fmt.Fprintf(os.Stderr, "pthread_cond_signal(%#x) %v\n", cond, r)
@@ -133,6 +132,63 @@ func (c *cpu) pthreadCondSignal() {
 	writeI32(c.rp, r)
 }
 
+// int pthread_create(pthread_t *thread, const pthread_attr_t *attr, void *(*start_routine) (void *), void *arg);
+func (c *cpu) pthreadCreate() {
+	sp, arg := popPtr(c.sp)
+	sp, startRoutine := popPtr(sp)
+	sp, attr := popPtr(sp)
+	thread := readPtr(sp)
+	// Thread attributes are not supported and attr is ignored. The thread
+	// is created joinable with a stack of the size of the stack of the
+	// calling thread.
+	var r int32
+	t, err := c.m.NewThread(len(c.thread.stackMem))
+	switch {
+	case err != nil:
+		r = errno.XEAGAIN
+	default:
+		threadID := t.tlsp.threadID
+		writeULong(thread, uint64(threadID))
+		// The new thread stops when the context of its creator is done.
+		t.ctx, t.ctxDone = c.ctx, c.ctxDone
+		t.start(startRoutine, arg)
+	}
+	if ptrace {
+		fmt.Fprintf(os.Stderr, "pthread_create(%#x, %#x, %#x, %#x) %v\n", thread, attr, startRoutine, arg, r)
+	}
+	writeI32(c.rp, r)
+}
+
+// int pthread_detach(pthread_t thread);
+func (c *cpu) pthreadDetach() {
+	thread := uintptr(readULong(c.sp))
+	var r int32
+	var exited bool
+	c.m.threadsMu.Lock()
+	t := c.m.thread(thread)
+	switch {
+	case t == nil || t.done == nil:
+		r = errno.XESRCH
+	case t.detached:
+		r = errno.XEINVAL
+	default:
+		t.detached = true
+		select {
+		case <-t.done:
+			exited = true
+		default:
+		}
+	}
+	c.m.threadsMu.Unlock()
+	if exited {
+		t.Close()
+	}
+	if ptrace {
+		fmt.Fprintf(os.Stderr, "pthread_detach(%v) %v\n", thread, r)
+	}
+	writeI32(c.rp, r)
+}
+
 // extern int pthread_equal(pthread_t __thread1, pthread_t __thread2);
 func (c *cpu) pthreadEqual() {
 	sp, thread2 := popLong(c.sp)
@@ -147,12 +203,47 @@ func (c *cpu) pthreadEqual() {
 	writeI32(c.rp, r)
 }
 
+// int pthread_join(pthread_t thread, void **value_ptr);
+func (c *cpu) pthreadJoin() {
+	sp, valuePtr := popPtr(c.sp)
+	thread := uintptr(readULong(sp))
+	var r int32
+	c.m.threadsMu.Lock()
+	t := c.m.thread(thread)
+	switch {
+	case t == nil || t.done == nil:
+		r = errno.XESRCH
+	case t == c.thread:
+		r = errno.XEDEADLK
+	case t.detached:
+		r = errno.XEINVAL
+	}
+	c.m.threadsMu.Unlock()
+	if r == 0 {
+		select {
+		case <-t.done:
+			if valuePtr != 0 {
+				writePtr(valuePtr, t.result)
+			}
+			t.Close()
+		case <-c.m.stop:
+			r = errno.XEINTR
+		case <-c.ctxDone:
+			r = errno.XEINTR
+		}
+	}
+	if ptrace {
+		fmt.Fprintf(os.Stderr, "pthread_join(%v, %#x) %v\n", thread, valuePtr, r)
+	}
+	writeI32(c.rp, r)
+}
+
 // extern int pthread_mutex_destroy(pthread_mutex_t * __mutex);
 func (c *cpu) pthreadMutexDestroy() {
 	mutex := readPtr(c.sp)
-	mutexes.Lock()
-	delete(mutexes.m, mutex)
-	mutexes.Unlock()
+	c.m.mutexes.Lock()
+	delete(c.m.mutexes.m, mutex)
+	c.m.mutexes.Unlock()
 	var r int32
 	if ptrace {
 		fmt.Fprintf(os.Stderr, "pthread_mutex_destroy(%#x) %v\n", mutex, r)
@@ -168,7 +259,7 @@ func (c *cpu) pthreadMutexInit() {
 		attr = readI32(mutexattr)
 	}
 	mutex := readPtr(sp)
-	mutexes.mu(mutex).attr = attr
+	c.m.mutexes.mu(mutex).attr = attr
 	var r int32
 	if ptrace {
 		fmt.Fprintf(os.Stderr, "pthread_mutex_init(%#x, %#x) %v\n", mutex, mutexattr, r)
@@ -180,7 +271,7 @@ func (c *cpu) pthreadMutexInit() {
 func (c *cpu) pthreadMutexLock() {
 	threadID := c.tlsp.threadID
 	mutex := readPtr(c.sp)
-	mu := mutexes.mu(mutex)
+	mu := c.m.mutexes.mu(mutex)
 	var r int32
 	mu.Lock()
 	switch mu.attr {
@@ -223,7 +314,7 @@ func (c *cpu) pthreadMutexLock() {
 func (c *cpu) pthreadMutexTryLock() {
 	threadID := c.tlsp.threadID
 	mutex := readPtr(c.sp)
-	mu := mutexes.mu(mutex)
+	mu := c.m.mutexes.mu(mutex)
 	var r int32
 	mu.Lock()
 	switch mu.attr {
@@ -249,7 +340,7 @@ func (c *cpu) pthreadMutexTryLock() {
 func (c *cpu) pthreadMutexUnlock() {
 	threadID := c.tlsp.threadID
 	mutex := readPtr(c.sp)
-	mu := mutexes.mu(mutex)
+	mu := c.m.mutexes.mu(mutex)
 	var r int32
 	mu.Lock()
 	switch mu.attr {
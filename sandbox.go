@@ -0,0 +1,239 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// SyscallCategory is a group of library functions accessing resources of the
+// host.
+type SyscallCategory int
+
+// Values of SyscallCategory.
+const (
+	FileSystemCalls SyscallCategory = iota // Files, directories and file descriptors.
+	NetworkCalls                           // Sockets, select and name resolution.
+	ProcessCalls                           // Environment, signals, process and user IDs, system.
+	TimeCalls                              // Clocks and sleeping.
+	MemoryMapCalls                         // mmap and munmap.
+)
+
+func (c SyscallCategory) String() string {
+	switch c {
+	case FileSystemCalls:
+		return "filesystem"
+	case NetworkCalls:
+		return "network"
+	case ProcessCalls:
+		return "process"
+	case TimeCalls:
+		return "time"
+	case MemoryMapCalls:
+		return "mmap"
+	}
+	return fmt.Sprintf("SyscallCategory(%d)", int(c))
+}
+
+// SyscallAction determines how a sandboxed machine handles a call.
+type SyscallAction int
+
+// Values of SyscallAction.
+const (
+	SyscallAllow SyscallAction = iota // Perform the call.
+	SyscallDeny                       // Fail the call.
+	SyscallAudit                      // Log the call, then perform it.
+)
+
+func (a SyscallAction) String() string {
+	switch a {
+	case SyscallAllow:
+		return "allow"
+	case SyscallDeny:
+		return "deny"
+	case SyscallAudit:
+		return "audit"
+	}
+	return fmt.Sprintf("SyscallAction(%d)", int(a))
+}
+
+// SyscallRule is the handling of the calls of a category.
+type SyscallRule struct {
+	Action SyscallAction
+	Errno  syscall.Errno // SyscallDeny: The errno of failed calls. Zero means EPERM.
+}
+
+// SandboxPolicy maps categories to rules. Categories not in the map are
+// allowed.
+type SandboxPolicy map[SyscallCategory]SyscallRule
+
+// Sandbox makes a machine handle library functions accessing resources of the
+// host according to policy. Denied calls return their error value, like -1
+// or NULL, and set errno. Audited and denied calls are logged to audit, if not
+// nil, one line per call.
+//
+// Calls of the FileSystemCalls category are not restricted when they are
+// served by a FileSystem other than OSFileSystem, see the FS option. Calls
+// using a file descriptor are not restricted for the standard descriptors.
+func Sandbox(policy SandboxPolicy, audit io.Writer) Option {
+	return func(o *options) error {
+		s := &sandbox{audit: audit, policy: SandboxPolicy{}}
+		for k, v := range policy {
+			switch v.Action {
+			case SyscallAllow, SyscallDeny, SyscallAudit:
+				// ok
+			default:
+				return fmt.Errorf("Sandbox: invalid action for %v: %v", k, v.Action)
+			}
+
+			if v.Action == SyscallDeny && v.Errno == 0 {
+				v.Errno = syscall.EPERM
+			}
+			s.policy[k] = v
+		}
+		o.sandbox = s
+		return nil
+	}
+}
+
+type sandbox struct {
+	audit  io.Writer
+	mu     sync.Mutex // Serializes audit writes.
+	policy SandboxPolicy
+}
+
+// Results of denied calls.
+const (
+	sysInt   = iota // int -1
+	sysLong         // long -1
+	sysNull         // NULL
+	sysError        // (void*)-1, eg. MAP_FAILED, SIG_ERR.
+)
+
+type sysCall struct {
+	category SyscallCategory
+	fd       bool // The first argument is an int file descriptor.
+	path     bool // Served by the file system of the machine.
+	result   int
+}
+
+// syscalls are the sandboxed builtins, indexed by opcode.
+var syscalls = [...]*sysCall{
+	access:      {category: FileSystemCalls, path: true, result: sysInt},
+	close_:      {category: FileSystemCalls, fd: true, result: sysInt},
+	dlopen:      {category: FileSystemCalls, path: true, result: sysNull},
+	fchmod:      {category: FileSystemCalls, fd: true, result: sysInt},
+	fchown:      {category: FileSystemCalls, fd: true, result: sysInt},
+	fcntl:       {category: FileSystemCalls, fd: true, result: sysInt},
+	fopen64:     {category: FileSystemCalls, path: true, result: sysNull},
+	fstat64:     {category: FileSystemCalls, fd: true, result: sysInt},
+	fsync:       {category: FileSystemCalls, fd: true, result: sysInt},
+	ftruncate64: {category: FileSystemCalls, fd: true, result: sysInt},
+	getcwd:      {category: FileSystemCalls, path: true, result: sysNull},
+	lseek64:     {category: FileSystemCalls, fd: true, result: sysLong},
+	lstat64:     {category: FileSystemCalls, path: true, result: sysInt},
+	mkdir:       {category: FileSystemCalls, path: true, result: sysInt},
+	open64:      {category: FileSystemCalls, path: true, result: sysInt},
+	read:        {category: FileSystemCalls, fd: true, result: sysLong},
+	readlink:    {category: FileSystemCalls, path: true, result: sysLong},
+	rmdir:       {category: FileSystemCalls, path: true, result: sysInt},
+	stat64:      {category: FileSystemCalls, path: true, result: sysInt},
+	unlink:      {category: FileSystemCalls, path: true, result: sysInt},
+	utimes:      {category: FileSystemCalls, path: true, result: sysInt},
+	write:       {category: FileSystemCalls, fd: true, result: sysLong},
+	writev:      {category: FileSystemCalls, fd: true, result: sysLong},
+
+	connect:       {category: NetworkCalls, result: sysInt},
+	gethostbyname: {category: NetworkCalls, result: sysNull},
+	getpeername:   {category: NetworkCalls, result: sysInt},
+	getsockname:   {category: NetworkCalls, result: sysInt},
+	getsockopt:    {category: NetworkCalls, result: sysInt},
+	recv:          {category: NetworkCalls, result: sysLong},
+	select_:       {category: NetworkCalls, result: sysInt},
+	setsockopt:    {category: NetworkCalls, result: sysInt},
+	shutdown:      {category: NetworkCalls, result: sysInt},
+	socket:        {category: NetworkCalls, result: sysInt},
+
+	__sysv_signal: {category: ProcessCalls, result: sysError},
+	getenv:        {category: ProcessCalls, result: sysNull},
+	geteuid:       {category: ProcessCalls, result: sysInt},
+	gethostname:   {category: ProcessCalls, result: sysInt},
+	getpid:        {category: ProcessCalls, result: sysInt},
+	pause:         {category: ProcessCalls, result: sysInt},
+	signal_:       {category: ProcessCalls, result: sysError},
+	system:        {category: ProcessCalls, result: sysInt},
+
+	gettimeofday: {category: TimeCalls, result: sysInt},
+	localtime:    {category: TimeCalls, result: sysNull},
+	sleep:        {category: TimeCalls, result: sysInt},
+	time:         {category: TimeCalls, result: sysLong},
+	usleep:       {category: TimeCalls, result: sysInt},
+
+	mmap64: {category: MemoryMapCalls, result: sysError},
+	munmap: {category: MemoryMapCalls, result: sysInt},
+}
+
+// sandboxed applies the sandbox policy to the builtin op implemented by f,
+// which is about to be executed. It returns f if the call is allowed or a
+// function failing the call otherwise.
+func (c *cpu) sandboxed(op Opcode, f func()) func() {
+	if uint(op) >= uint(len(syscalls)) || syscalls[op] == nil {
+		return f
+	}
+
+	sc := syscalls[op]
+	s := c.sandbox
+	rule := s.policy[sc.category]
+	if rule.Action == SyscallAllow {
+		return f
+	}
+
+	switch {
+	case sc.fd:
+		fd := readI32(c.rp - i32StackSz)
+		if fd >= 0 && fd <= 2 {
+			return f
+		}
+
+		if file := c.m.fds.get(fd); file != nil && !osFile(file) {
+			return f
+		}
+	case sc.path:
+		if _, ok := c.m.fs.(osFileSystem); !ok {
+			return f
+		}
+	}
+
+	if s.audit != nil {
+		s.mu.Lock()
+		fmt.Fprintf(s.audit, "%v %v %s\t; %s\n", rule.Action, sc.category, strings.TrimRight(op.String(), "_"), c.pos())
+		s.mu.Unlock()
+	}
+	if rule.Action != SyscallDeny {
+		return f
+	}
+
+	if strace {
+		fmt.Fprintf(os.Stderr, "%v denied %v\t; %s\n", op, rule.Errno, c.pos())
+	}
+	return func() {
+		c.setErrno(rule.Errno)
+		switch sc.result {
+		case sysInt:
+			writeI32(c.rp, -1)
+		case sysLong:
+			writeLong(c.rp, -1)
+		case sysNull:
+			writePtr(c.rp, 0)
+		case sysError:
+			writePtr(c.rp, ^uintptr(0))
+		}
+	}
+}
@@ -18,7 +18,7 @@ func init() {
 // void longjmp(jmp_buf env, int val);
 func (c *cpu) longjmp() {
 	sp, val := popI32(c.sp)
-	c.jmpBuf = *(*jmpBuf)(unsafe.Pointer(readPtr(sp)))
+	c.jmpBuf = *(*jmpBuf)(memR(readPtr(sp), int(unsafe.Sizeof(jmpBuf{}))))
 	c.fpStack = c.fpStack[:c.fpStackP]
 	c.rpStack = c.rpStack[:c.rpStackP]
 	if val == 0 {
@@ -31,6 +31,6 @@ func (c *cpu) longjmp() {
 func (c *cpu) setjmp() {
 	c.fpStackP = uintptr(len(c.fpStack))
 	c.rpStackP = uintptr(len(c.rpStack))
-	*(*jmpBuf)(unsafe.Pointer(readPtr(c.sp))) = c.jmpBuf
+	*(*jmpBuf)(memW(readPtr(c.sp), int(unsafe.Sizeof(jmpBuf{})))) = c.jmpBuf
 	writeI32(c.rp, 0)
 }
@@ -0,0 +1,541 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/cznic/ir"
+)
+
+const snapshotVersion = 2 // Compatibility version of snapshots.
+
+type snapshotBlock struct {
+	Addr uintptr
+	Data []byte
+}
+
+type snapshotGlobal struct {
+	Offset int
+	Size   int
+	Type   string
+}
+
+type snapshotMutex struct {
+	Addr  uintptr
+	Attr  int32
+	Count int
+	Owner uintptr
+}
+
+type snapshotThread struct {
+	AP       uintptr
+	BP       uintptr
+	Detached bool
+	Done     bool // Thread created by pthread_create has finished.
+	FPStack  []uintptr
+	FPStackP uintptr
+	IP       uintptr
+	RP       uintptr
+	RPStack  []uintptr
+	RPStackP uintptr
+	Result   uintptr
+	Rtdsc    uint64
+	SP       uintptr
+	SS       uintptr
+	Stack    []byte
+	TLS      uintptr
+}
+
+type machineSnapshot struct {
+	Arch       string
+	AtExit     []uintptr
+	BSS        uintptr // Offset in Data.
+	BSSSize    int
+	Brk        uintptr // Offset in Data.
+	CSRelative []byte
+	Code       []Operation
+	Cycles     int64
+	DS         uintptr
+	DSRelative []byte
+	Data       []byte // Data, BSS and sbrk heap.
+	Functions  []PCInfo
+	Globals    map[string]snapshotGlobal
+	Heap       []snapshotBlock
+	Lines      []PCInfo
+	Mutexes    []snapshotMutex
+	Pushback   map[uintptr]byte
+	Signatures map[string]string
+	Stderr     uintptr
+	Stdin      uintptr
+	Stdout     uintptr
+	Sym        map[string]int
+	TM         uintptr
+	TS         uintptr
+	TSRelative []byte
+	Text       []byte
+	ThreadID   uintptr
+	Threads    []snapshotThread
+	Version    int
+}
+
+// idString and stringID convert the dictionary IDs of names and types, which
+// are valid only in the current process, to strings and back.
+func idString(id int) string {
+	if id == 0 {
+		return ""
+	}
+
+	return string(dict.S(id))
+}
+
+func stringID(s string) int {
+	if s == "" {
+		return 0
+	}
+
+	return dict.SID(s)
+}
+
+func memBytes(p uintptr, n int) []byte {
+	if n == 0 {
+		return nil
+	}
+
+	return (*[math.MaxInt32]byte)(unsafe.Pointer(p))[:n:n]
+}
+
+// Snapshot writes the state of m to w: its memory, threads and the code it
+// executes. Restore creates an equivalent machine from the snapshot.
+//
+// No thread of m may execute code while Snapshot is called. Machines having
+// open files, except the standard streams, cannot be snapshotted. Memory
+// mapped by the program using mmap is not part of the snapshot.
+func (m *Machine) Snapshot(w io.Writer) error {
+	s, err := m.snapshot()
+	if err != nil {
+		return fmt.Errorf("Snapshot: %v", err)
+	}
+
+	gw := gzip.NewWriter(w)
+	gw.Header.Comment = "VM snapshot"
+	if err := gob.NewEncoder(gw).Encode(s); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+// snapshot returns the state of m. The memory of the result is shared with m.
+func (m *Machine) snapshot() (*machineSnapshot, error) {
+	img := m.image()
+	s := &machineSnapshot{
+		Arch:       runtime.GOOS + "/" + runtime.GOARCH,
+		BSS:        m.bss - m.ds,
+		BSSSize:    m.bssSize,
+		Brk:        m.brk - m.ds,
+		CSRelative: m.csRelative,
+		Code:       img.code,
+		Cycles:     atomic.LoadInt64(&m.cycles),
+		DS:         m.ds,
+		DSRelative: m.dsRelative,
+		Data:       memBytes(m.ds, len(m.dsMem)),
+		Functions:  img.functions,
+		Lines:      img.lines,
+		TM:         m.tm,
+		TS:         m.ts,
+		TSRelative: m.tsRelative,
+		Text:       memBytes(m.ts, len(m.tsMem)),
+		ThreadID:   m.threadID,
+		Version:    snapshotVersion,
+	}
+
+	s.Globals = map[string]snapshotGlobal{}
+	for k, v := range m.globals {
+		s.Globals[idString(int(k))] = snapshotGlobal{v.Offset, v.Size, idString(int(v.Type))}
+	}
+	s.Signatures = map[string]string{}
+	s.Sym = map[string]int{}
+	m.libsMu.Lock()
+	for k, v := range m.syms {
+		nm := idString(int(k))
+		s.Sym[nm] = v
+		if sig, ok := m.sigs[v]; ok {
+			s.Signatures[nm] = idString(int(sig.typ))
+		}
+	}
+	m.libsMu.Unlock()
+
+	m.atExitMu.Lock()
+	s.AtExit = append(s.AtExit, m.atExit...)
+	m.atExitMu.Unlock()
+
+	files := m.files
+	files.mu.Lock()
+	n := len(files.m)
+	s.Stderr, s.Stdin, s.Stdout = files.stderr, files.stdin, files.stdout
+	s.Pushback = map[uintptr]byte{}
+	for k, v := range files.pushback {
+		s.Pushback[k] = v
+	}
+	files.mu.Unlock()
+	m.fds.mu.Lock()
+	n += len(m.fds.m)
+	m.fds.mu.Unlock()
+	if n != 0 {
+		return nil, fmt.Errorf("%v open files", n)
+	}
+
+	m.libsMu.Lock()
+	n = len(m.libs)
+	m.libsMu.Unlock()
+	if n != 0 {
+		return nil, fmt.Errorf("%v loaded libraries", n)
+	}
+
+	m.allocMu.Lock()
+	for k, v := range m.blocks {
+		s.Heap = append(s.Heap, snapshotBlock{k, memBytes(k, v)})
+	}
+	m.allocMu.Unlock()
+	sort.Slice(s.Heap, func(i, j int) bool { return s.Heap[i].Addr < s.Heap[j].Addr })
+
+	m.mutexes.Lock()
+	for k, v := range m.mutexes.m {
+		s.Mutexes = append(s.Mutexes, snapshotMutex{k, v.attr, v.count, v.owner})
+	}
+	m.mutexes.Unlock()
+
+	m.threadsMu.Lock()
+	defer m.threadsMu.Unlock()
+
+	for _, t := range m.Threads {
+		var done bool
+		if t.done != nil {
+			select {
+			case <-t.done:
+				done = true
+			default:
+				return nil, fmt.Errorf("thread %v is running", t.tlsp.threadID)
+			}
+		}
+
+		s.Threads = append(s.Threads, snapshotThread{
+			AP:       t.ap,
+			BP:       t.bp,
+			Detached: t.detached,
+			Done:     done,
+			FPStack:  t.fpStack,
+			FPStackP: t.fpStackP,
+			IP:       t.ip,
+			RP:       t.rp,
+			RPStack:  t.rpStack,
+			RPStackP: t.rpStackP,
+			Result:   t.result,
+			Rtdsc:    t.rtdsc,
+			SP:       t.sp,
+			SS:       t.ss,
+			Stack:    memBytes(t.ss, len(t.stackMem)),
+			TLS:      t.tls,
+		})
+	}
+	return s, nil
+}
+
+// relocation maps the memory region [lo, hi] of a snapshotted machine to the
+// region at to of the restored one.
+type relocation struct {
+	hi uintptr
+	lo uintptr
+	to uintptr
+}
+
+// relocator relocates pointers of a snapshotted machine. Any value falling in
+// a snapshotted region is considered a pointer.
+type relocator []relocation // Sorted by lo.
+
+func (r *relocator) add(lo uintptr, n int, to uintptr) {
+	if lo != 0 && n != 0 {
+		*r = append(*r, relocation{hi: lo + uintptr(n), lo: lo, to: to})
+	}
+}
+
+// ptr returns the relocated p. A pointer just past the end of a region is
+// relocated with the region, unless it is the start of another region.
+func (r relocator) ptr(p uintptr) uintptr {
+	i := sort.Search(len(r), func(i int) bool { return r[i].lo > p }) - 1
+	if i < 0 {
+		return p
+	}
+
+	switch v := r[i]; {
+	case p < v.hi:
+		return p - v.lo + v.to
+	case p == v.hi && (i+1 == len(r) || r[i+1].lo != p):
+		return v.to + (v.hi - v.lo)
+	}
+	return p
+}
+
+func (r relocator) ptrs(s []uintptr) []uintptr {
+	s = append([]uintptr(nil), s...)
+	for i, v := range s {
+		s[i] = r.ptr(v)
+	}
+	return s
+}
+
+// mem relocates the pointers in n bytes at p.
+func (r relocator) mem(p uintptr, n int) {
+	for q := p; q+ptrSize <= p+uintptr(n); q += ptrSize {
+		writePtr(q, r.ptr(readPtr(q)))
+	}
+}
+
+// data relocates the pointers in the data segment at p of n bytes. Pointers
+// marked in the bit vectors ds and ts are relocated regardless of their
+// alignment, code addresses marked in cs are kept. The other words are
+// relocated like in mem.
+func (r relocator) data(p uintptr, n int, cs, ds, ts []byte) {
+	for off := 0; off+ptrSize <= n; {
+		q := p + uintptr(off)
+		switch {
+		case bit(cs, off):
+			// Code addresses do not change.
+		case bit(ds, off) || bit(ts, off):
+			writePtr(q, r.ptr(readPtr(q)))
+		case off%ptrSize != 0:
+			off++
+			continue
+		default:
+			marked := false
+			for i := off + 1; i < off+ptrSize; i++ {
+				marked = marked || bit(cs, i) || bit(ds, i) || bit(ts, i)
+			}
+			if marked {
+				off++
+				continue
+			}
+
+			writePtr(q, r.ptr(readPtr(q)))
+		}
+		off += ptrSize
+	}
+}
+
+// bit reports whether bit i of the bit vector b is set.
+func bit(b []byte, i int) bool { return i>>3 < len(b) && b[i>>3]&(1<<uint(i&7)) != 0 }
+
+// Restore returns a new Machine having the state written by Snapshot to r.
+// The memory of the restored machine is at different addresses. Pointers in
+// the initial data of the program are known from its relocation tables and
+// are adjusted exactly. Other pointers, in particular those stored by the
+// program in the data segment, in the heap and on stacks, are relocated on a
+// best-effort basis: Any pointer sized, aligned value in memory or a register
+// falling into a region of the snapshotted memory, or just past its end, is
+// adjusted. An integer having such a value by accident is corrupted. The
+// options apply as in New, they are not part of the snapshot.
+func Restore(r io.Reader, stdin io.Reader, stdout, stderr io.Writer, opts ...Option) (m *Machine, err error) {
+	o := options{fuel: -1}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var s machineSnapshot
+	if err := gob.NewDecoder(gr).Decode(&s); err != nil {
+		return nil, err
+	}
+
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("Restore: invalid version number %v", s.Version)
+	}
+
+	if g, e := s.Arch, runtime.GOOS+"/"+runtime.GOARCH; g != e {
+		return nil, fmt.Errorf("Restore: invalid platform %q", g)
+	}
+
+	if m, _, err = restore(&s, stdin, stdout, stderr, true); err != nil {
+		return nil, fmt.Errorf("Restore: %v", err)
+	}
+
+	m.setOptions(&o)
+	return m, nil
+}
+
+// restore returns a new Machine having the state s and the relocation of the
+// memory of s. Threads are restored only if threads is true.
+func restore(s *machineSnapshot, stdin io.Reader, stdout, stderr io.Writer, threads bool) (m *Machine, rel relocator, err error) {
+	b := newBinary()
+	b.Code = s.Code
+	b.Data = s.Data
+	b.Functions = s.Functions
+	b.Lines = s.Lines
+	b.Text = s.Text
+	for k, v := range s.Globals {
+		b.Globals[ir.NameID(stringID(k))] = Global{v.Offset, v.Size, ir.TypeID(stringID(v.Type))}
+	}
+	for k, v := range s.Signatures {
+		b.Signatures[ir.NameID(stringID(k))] = ir.TypeID(stringID(v))
+	}
+	for k, v := range s.Sym {
+		b.Sym[ir.NameID(stringID(k))] = v
+	}
+	if m, err = newMachine(b, 0, stdin, stdout, stderr, ""); err != nil {
+		return nil, nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			m.Close()
+			m = nil
+		}
+	}()
+
+	if !threads {
+		s.Threads = nil
+	}
+	m.csRelative, m.dsRelative, m.tsRelative = s.CSRelative, s.DSRelative, s.TSRelative
+	rel.add(s.DS, len(s.Data), m.ds)
+	rel.add(s.TS, len(s.Text), m.ts)
+	heap := make([]uintptr, len(s.Heap))
+	for i, v := range s.Heap {
+		p := m.malloc(len(v.Data))
+		if p == 0 {
+			return nil, nil, fmt.Errorf("out of memory")
+		}
+
+		copy(memBytes(p, len(v.Data)), v.Data)
+		rel.add(v.Addr, len(v.Data), p)
+		heap[i] = p
+	}
+	for _, v := range s.Threads {
+		t, err := m.NewThread(len(v.Stack))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		copy(memBytes(t.ss, len(v.Stack)), v.Stack)
+		rel.add(v.SS, len(v.Stack), t.ss)
+	}
+	sort.Slice(rel, func(i, j int) bool { return rel[i].lo < rel[j].lo })
+
+	rel.data(m.ds, len(s.Data), s.CSRelative, s.DSRelative, s.TSRelative)
+	for i, v := range s.Heap {
+		rel.mem(heap[i], len(v.Data))
+	}
+	for i, v := range s.Threads {
+		t := m.Threads[i]
+		rel.mem(t.ss, len(v.Stack))
+		t.ap = rel.ptr(v.AP)
+		t.bp = rel.ptr(v.BP)
+		t.detached = v.Detached
+		t.fpStack = rel.ptrs(v.FPStack)
+		t.fpStackP = v.FPStackP
+		t.ip = v.IP
+		t.result = rel.ptr(v.Result)
+		t.rp = rel.ptr(v.RP)
+		t.rpStack = rel.ptrs(v.RPStack)
+		t.rpStackP = v.RPStackP
+		t.rtdsc = v.Rtdsc
+		t.fueled = v.Rtdsc
+		t.sp = rel.ptr(v.SP)
+		t.tls = rel.ptr(v.TLS)
+		t.tlsp = (*tls)(unsafe.Pointer(t.tls))
+		if v.Done {
+			t.done = make(chan struct{})
+			close(t.done)
+		}
+	}
+
+	m.atExit = s.AtExit
+	m.brk = m.ds + s.Brk
+	m.bss = m.ds + s.BSS
+	m.bssSize = s.BSSSize
+	m.cycles = s.Cycles
+	m.files.stderr = rel.ptr(s.Stderr)
+	m.files.stdin = rel.ptr(s.Stdin)
+	m.files.stdout = rel.ptr(s.Stdout)
+	for k, v := range s.Pushback {
+		m.files.pushback[rel.ptr(k)] = v
+	}
+	for _, v := range s.Mutexes {
+		mu := m.mutexes.mu(rel.ptr(v.Addr))
+		mu.attr, mu.count, mu.owner = v.Attr, v.Count, v.Owner
+	}
+	m.threadID = s.ThreadID
+	if m.tm = rel.ptr(s.TM); m.tm != 0 {
+		m.tmOnce.Do(func() {})
+	}
+	return m, rel, nil
+}
+
+// Clone returns an independent copy of m, like fork does. The copy has the
+// memory of m, but no threads; use NewThread to execute its code. Clone has
+// the same restrictions as Snapshot. The copy shares the options of m, except
+// the profiles, which start empty, and the deterministic mode, whose random
+// generator restarts from the seed.
+func (m *Machine) Clone() (*Machine, error) {
+	s, err := m.snapshot()
+	if err != nil {
+		return nil, fmt.Errorf("Clone: %v", err)
+	}
+
+	r, rel, err := restore(s, m.stdin, m.stdout, m.stderr, false)
+	if err != nil {
+		return nil, fmt.Errorf("Clone: %v", err)
+	}
+
+	if m.ProfileFunctions != nil {
+		r.ProfileFunctions = map[PCInfo]int{}
+	}
+	if m.ProfileLines != nil {
+		r.ProfileLines = map[PCInfo]int{}
+	}
+	if m.ProfileInstructions != nil {
+		r.ProfileInstructions = map[Opcode]int{}
+	}
+	if m.profileStacks != nil {
+		r.profileStacks = map[string]int{}
+	}
+	r.ProfileRate = m.ProfileRate
+	if t := m.allocs; t != nil {
+		r.allocs = newAllocTracker(t.w)
+		t.mu.Lock()
+		for k, v := range t.live {
+			r.allocs.live[rel.ptr(k)] = v
+		}
+		t.mu.Unlock()
+	}
+	if d := m.det; d != nil {
+		if r.det, err = d.clone(); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	if m.image().cover != nil {
+		r.setCover(m.coverage)
+	}
+	r.debugger = m.debugger
+	r.fs = m.fs
+	r.fuel = m.Fuel()
+	r.host = m.host
+	r.sandbox = m.sandbox
+	return r, nil
+}
@@ -11,7 +11,12 @@ import (
 	"io/ioutil"
 	"math"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"unicode/utf8"
 	"unsafe"
 
 	"github.com/cznic/ccir/libc/errno"
@@ -33,6 +38,7 @@ func init() {
 		dict.SID("fopen64"):             fopen64,
 		dict.SID("fprintf"):             fprintf,
 		dict.SID("fread"):               fread,
+		dict.SID("fscanf"):              fscanf,
 		dict.SID("fseek"):               fseek,
 		dict.SID("ftell"):               ftell,
 		dict.SID("fwrite"):              fwrite,
@@ -42,47 +48,69 @@ func init() {
 		dict.SID("putchar"):             putchar,
 		dict.SID("puts"):                puts,
 		dict.SID("rewind"):              rewind,
+		dict.SID("scanf"):               scanf,
 		dict.SID("snprintf"):            snprintf,
 		dict.SID("sprintf"):             sprintf,
+		dict.SID("sscanf"):              sscanf,
 		dict.SID("ungetc"):              ungetc,
 		dict.SID("vfprintf"):            vfprintf,
+		dict.SID("vfscanf"):             vfscanf,
 		dict.SID("vprintf"):             vprintf,
+		dict.SID("vscanf"):              vscanf,
+		dict.SID("vsscanf"):             vsscanf,
 	})
 }
 
-var (
-	stdin, stdout, stderr uintptr
-)
-
 // void __register_stdfiles(void *, void *, void *);
 func (c *cpu) register_stdfiles() {
 	var sp uintptr
-	sp, stderr = popPtr(c.sp)
-	sp, stdout = popPtr(sp)
-	stdin = readPtr(sp)
+	files := c.m.files
+	sp, files.stderr = popPtr(c.sp)
+	sp, files.stdout = popPtr(sp)
+	files.stdin = readPtr(sp)
 }
 
 type stream struct {
-	*os.File
+	File
 	eof bool
 	err error
+	fd  int32
 }
 
 var (
-	files = &fmap{
-		m: map[uintptr]*stream{},
-	}
-	nullReader = bytes.NewBuffer(nil)
+	nullReader io.Reader = eofReader{}
 )
 
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// badStream is the reader and writer of invalid streams.
+type badStream struct{}
+
+func (badStream) Read([]byte) (int, error)  { return 0, syscall.EBADF }
+func (badStream) Write([]byte) (int, error) { return 0, syscall.EBADF }
+
+// fmap is the table of open streams of a Machine.
 type fmap struct {
-	m  map[uintptr]*stream
-	mu sync.Mutex
+	m        map[uintptr]*stream
+	mu       sync.Mutex
+	pushback map[uintptr]byte // Input read ahead by the scanf family.
+	stderr   uintptr          // FILE *stderr
+	stdin    uintptr          // FILE *stdin
+	stdout   uintptr          // FILE *stdout
+}
+
+func newFmap() *fmap {
+	return &fmap{
+		m:        map[uintptr]*stream{},
+		pushback: map[uintptr]byte{},
+	}
 }
 
-func (m *fmap) add(f *os.File, u uintptr) {
+func (m *fmap) add(f File, fd int32, u uintptr) {
 	m.mu.Lock()
-	m.m[u] = &stream{File: f}
+	m.m[u] = &stream{File: f, fd: fd}
 	m.mu.Unlock()
 }
 
@@ -94,28 +122,65 @@ func (m *fmap) get(u uintptr) *stream {
 }
 
 func (m *fmap) reader(u uintptr, c *cpu) io.Reader {
+	m.mu.Lock()
+	b, ok := m.pushback[u]
+	delete(m.pushback, u)
+	m.mu.Unlock()
+	if ok {
+		return io.MultiReader(bytes.NewReader([]byte{b}), m.reader(u, c))
+	}
+
 	switch u {
-	case stdin:
+	case m.stdin:
 		return c.m.stdin
-	case stdout, stderr:
+	case m.stdout, m.stderr:
 		return nullReader
 	}
 
 	m.mu.Lock()
 	f := m.m[u]
 	m.mu.Unlock()
+	if f == nil {
+		return badStream{}
+	}
+
 	return f
 }
 
+// unread arranges for b to be the next byte read from stream u.
+func (m *fmap) unread(u uintptr, b byte) {
+	m.mu.Lock()
+	m.pushback[u] = b
+	m.mu.Unlock()
+}
+
+// pushed reports whether a byte read ahead from stream u is pending.
+func (m *fmap) pushed(u uintptr) bool {
+	m.mu.Lock()
+	_, ok := m.pushback[u]
+	m.mu.Unlock()
+	return ok
+}
+
+// drop discards the byte read ahead from stream u, if any, and reports
+// whether there was one.
+func (m *fmap) drop(u uintptr) bool {
+	m.mu.Lock()
+	_, ok := m.pushback[u]
+	delete(m.pushback, u)
+	m.mu.Unlock()
+	return ok
+}
+
 func (m *fmap) seeker(u uintptr, c *cpu) io.Seeker {
 	switch u {
-	case stdin:
+	case m.stdin:
 		s, _ := c.m.stdin.(io.Seeker)
 		return s
-	case stdout:
+	case m.stdout:
 		s, _ := c.m.stdout.(io.Seeker)
 		return s
-	case stderr:
+	case m.stderr:
 		s, _ := c.m.stderr.(io.Seeker)
 		return s
 	}
@@ -123,31 +188,57 @@ func (m *fmap) seeker(u uintptr, c *cpu) io.Seeker {
 	m.mu.Lock()
 	f := m.m[u]
 	m.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+
 	return f
 }
 
 func (m *fmap) writer(u uintptr, c *cpu) io.Writer {
 	switch u {
-	case stdin:
+	case m.stdin:
 		return ioutil.Discard
-	case stdout:
+	case m.stdout:
 		return c.m.stdout
-	case stderr:
+	case m.stderr:
 		return c.m.stderr
 	}
 
 	m.mu.Lock()
 	f := m.m[u]
 	m.mu.Unlock()
+	if f == nil {
+		return badStream{}
+	}
+
 	return f
 }
 
-func (m *fmap) extract(u uintptr) *os.File {
+func (m *fmap) extract(u uintptr) *stream {
 	m.mu.Lock()
 	f := m.m[u]
 	delete(m.m, u)
+	delete(m.pushback, u)
 	m.mu.Unlock()
-	return f.File
+	return f
+}
+
+// closeAll closes all open streams, except the standard ones, and releases
+// their FILE objects.
+func (m *fmap) closeAll(mach *Machine) (err error) {
+	m.mu.Lock()
+	s := m.m
+	m.m = map[uintptr]*stream{}
+	m.mu.Unlock()
+	for u, f := range s {
+		mach.free(u)
+		mach.fds.remove(f.fd)
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
 type file struct{ _ int32 }
@@ -155,8 +246,9 @@ type file struct{ _ int32 }
 // int fclose(FILE *stream);
 func (c *cpu) fclose() {
 	u := readPtr(c.sp)
+	files := c.m.files
 	switch u {
-	case stdin, stdout, stderr:
+	case files.stdin, files.stdout, files.stderr:
 		c.setErrno(errno.XEIO)
 		writeI32(c.rp, stdio.XEOF)
 		return
@@ -170,6 +262,7 @@ func (c *cpu) fclose() {
 	}
 
 	c.m.free(u)
+	c.m.fds.remove(f.fd)
 	if err := f.Close(); err != nil {
 		c.setErrno(errno.XEIO)
 		writeI32(c.rp, stdio.XEOF)
@@ -182,7 +275,7 @@ func (c *cpu) fclose() {
 // int ferror(FILE *stream);
 func (c *cpu) ferror() {
 	u := readPtr(c.sp)
-	s := files.get(u)
+	s := c.m.files.get(u)
 	var r int32
 	switch {
 	case s == nil:
@@ -199,7 +292,7 @@ func (c *cpu) ferror() {
 // int fflush(FILE *stream);
 func (c *cpu) fflush() {
 	stream := readPtr(c.sp)
-	s := files.get(stream)
+	s := c.m.files.get(stream)
 	if s == nil {
 		c.setErrno(errno.XEBADF)
 		writeI32(c.rp, stdio.XEOF)
@@ -223,7 +316,7 @@ func (c *cpu) fflush() {
 // int fgetc(FILE *stream);
 func (c *cpu) fgetc() {
 	p := buffer.Get(1)
-	if _, err := files.reader(readPtr(c.sp), c).Read(*p); err != nil {
+	if _, err := c.m.files.reader(readPtr(c.sp), c).Read(*p); err != nil {
 		writeI32(c.rp, stdio.XEOF)
 		buffer.Put(p)
 		return
@@ -238,7 +331,7 @@ func (c *cpu) fgets() {
 	sp, stream := popPtr(c.sp)
 	sp, size := popI32(sp)
 	s := readPtr(sp)
-	f := files.reader(stream, c)
+	f := c.m.files.reader(stream, c)
 	p := buffer.Get(1)
 	b := *p
 	w := memWriter(s)
@@ -270,13 +363,14 @@ func (c *cpu) fgets() {
 // int fileno(FILE *stream);
 func (c *cpu) fileno() {
 	stream := readPtr(c.sp)
+	files := c.m.files
 	var r int32
 	switch stream {
-	case stdin:
+	case files.stdin:
 		r = 0
-	case stdout:
+	case files.stdout:
 		r = 1
-	case stderr:
+	case files.stderr:
 		r = 2
 	default:
 		s := files.get(stream)
@@ -286,7 +380,7 @@ func (c *cpu) fileno() {
 			break
 		}
 
-		r = int32(s.Fd())
+		r = s.fd
 	}
 	writeI32(c.rp, r)
 }
@@ -296,45 +390,43 @@ func (c *cpu) fopen64() {
 	sp, mode := popPtr(c.sp)
 	path := readPtr(sp)
 	p := GoString(path)
+	files := c.m.files
 	var u uintptr
 	switch p {
 	case os.Stderr.Name():
-		u = stderr
+		u = files.stderr
 	case os.Stdin.Name():
-		u = stdin
+		u = files.stdin
 	case os.Stdout.Name():
-		u = stdout
+		u = files.stdout
 	default:
-		var f *os.File
-		var err error
-		switch mode := GoString(mode); mode {
-		case "r", "rb":
-			if f, err = os.OpenFile(p, os.O_RDONLY, 0666); err != nil {
-				switch {
-				case os.IsNotExist(err):
-					c.setErrno(errno.XENOENT)
-				case os.IsPermission(err):
-					c.setErrno(errno.XEPERM)
-				default:
-					c.setErrno(errno.XEACCES)
-				}
-			}
-		case "w", "wb":
-			if f, err = os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666); err != nil {
-				switch {
-				case os.IsPermission(err):
-					c.setErrno(errno.XEPERM)
-				default:
-					c.setErrno(errno.XEACCES)
-				}
-			}
+		var flag int
+		switch mode := strings.Replace(GoString(mode), "b", "", -1); mode {
+		case "r":
+			flag = os.O_RDONLY
+		case "r+":
+			flag = os.O_RDWR
+		case "w":
+			flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		case "w+":
+			flag = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+		case "a":
+			flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		case "a+":
+			flag = os.O_RDWR | os.O_CREATE | os.O_APPEND
 		default:
-			panic(mode)
+			c.setErrno(errno.XEINVAL)
+			writePtr(c.rp, 0)
+			return
 		}
-		if f != nil {
-			u = c.m.malloc(int(unsafe.Sizeof(file{})))
-			files.add(f, u)
+		f, err := c.m.fs.OpenFile(p, flag, 0666)
+		if err != nil {
+			c.setErrno(err)
+			break
 		}
+
+		u = c.m.malloc(int(unsafe.Sizeof(file{})))
+		files.add(f, c.m.fds.add(f), u)
 	}
 	writePtr(c.rp, u)
 }
@@ -344,7 +436,7 @@ func (c *cpu) fprintf() {
 	ap := c.rp - ptrStackSz
 	stream := readPtr(ap)
 	ap -= ptrStackSz
-	writeI32(c.rp, goFprintf(files.writer(stream, c), readPtr(ap), ap, -1))
+	writeI32(c.rp, goFprintf(c.m.files.writer(stream, c), readPtr(ap), ap, -1))
 }
 
 // size_t fread(void *ptr, size_t size, size_t nmemb, FILE *stream);
@@ -360,25 +452,45 @@ func (c *cpu) fread() {
 		return
 	}
 
-	n, err := files.reader(stream, c).Read((*[math.MaxInt32]byte)(unsafe.Pointer(ptr))[:lo])
-	if err != nil {
+	if lo == 0 {
+		writeLong(c.rp, 0)
+		return
+	}
+
+	// A single Read may return only the byte read ahead by scanf.
+	n, err := io.ReadFull(c.m.files.reader(stream, c), (*[math.MaxInt32]byte)(memW(ptr, int(lo)))[:lo])
+	switch err {
+	case nil, io.EOF, io.ErrUnexpectedEOF:
+		// ok
+	default:
 		c.setErrno(errno.XEIO)
 	}
 	writeLong(c.rp, int64(n)/size)
 }
 
+// int fscanf(FILE *stream, const char *format, ...);
+func (c *cpu) fscanf() {
+	ap := c.rp - ptrStackSz
+	stream := readPtr(ap)
+	ap -= ptrStackSz
+	writeI32(c.rp, c.scanStream(stream, readPtr(ap), ap))
+}
+
 // int fseek(FILE *stream, long offset, int whence);
 func (c *cpu) fseek() {
 	sp, whence := popI32(c.sp)
 	sp, offset := popLong(sp)
 	stream := readPtr(sp)
-	s := files.seeker(stream, c)
+	s := c.m.files.seeker(stream, c)
 	if s == nil {
 		c.setErrno(errno.XEBADF)
 		writeI32(c.rp, -1)
 		return
 	}
 
+	if c.m.files.drop(stream) && whence == stdio.XSEEK_CUR {
+		offset-- // The byte read ahead is not consumed by the program.
+	}
 	var err error
 	switch whence {
 	case stdio.XSEEK_CUR:
@@ -405,7 +517,7 @@ func (c *cpu) fseek() {
 // long ftell(FILE *stream);
 func (c *cpu) ftell() {
 	stream := readPtr(c.sp)
-	s := files.seeker(stream, c)
+	s := c.m.files.seeker(stream, c)
 	if s == nil {
 		c.setErrno(errno.XEBADF)
 		writeLong(c.rp, -1)
@@ -419,6 +531,9 @@ func (c *cpu) ftell() {
 		return
 	}
 
+	if c.m.files.pushed(stream) {
+		off--
+	}
 	writeLong(c.rp, off)
 }
 
@@ -435,156 +550,897 @@ func (c *cpu) fwrite() {
 		return
 	}
 
-	n, err := files.writer(stream, c).Write((*[math.MaxInt32]byte)(unsafe.Pointer(ptr))[:lo])
+	n, err := c.m.files.writer(stream, c).Write((*[math.MaxInt32]byte)(memR(ptr, int(lo)))[:lo])
 	if err != nil {
 		c.setErrno(errno.XEIO)
 	}
 	writeLong(c.rp, int64(n)/size)
 }
 
+// goFprintf implements the printf family. It writes at most limit bytes to w,
+// if limit is not negative, and returns the number of bytes the complete
+// output has.
 func goFprintf(w io.Writer, format, argp uintptr, limit int64) int32 {
 	var b buffer.Bytes
 	written := 0
+	flush := func() bool {
+		bts := b.Bytes()
+		if limit >= 0 {
+			if int64(len(bts)) > limit {
+				bts = bts[:limit]
+			}
+			limit -= int64(len(bts))
+		}
+		_, err := w.Write(bts)
+		b.Reset()
+		return err == nil
+	}
+
 	for {
-		ch := readI8(format)
+		ch := readU8(format)
 		format++
 		switch ch {
 		case 0:
-			bts := b.Bytes()
-			if limit >= 0 && int64(len(bts)) > limit {
-				bts = bts[:limit]
-			}
-			_, err := w.Write(bts)
+			ok := flush()
 			b.Close()
-			if err != nil {
+			if !ok {
 				return -1
 			}
 
 			return int32(written)
 		case '%':
-			modifiers := ""
-			long := 0
-			var w []interface{}
-		more:
-			ch := readI8(format)
-			format++
-			switch ch {
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '.':
-				modifiers += string(ch)
-				goto more
-			case '*':
-				argp -= i32StackSz
-				w = append(w, readI32(argp))
-				modifiers += string(ch)
-				goto more
-			case 'c':
-				argp -= i32StackSz
-				arg := readI32(argp)
-				n, _ := fmt.Fprintf(&b, fmt.Sprintf("%%%sc", modifiers), append(w, arg)...)
-				written += n
-			case 'd', 'i':
-				var arg interface{}
-				switch long {
-				case 0:
-					argp -= i32StackSz
-					arg = readI32(argp)
-				case 1:
-					argp -= longStackSz
-					arg = readLong(argp)
-				default:
-					argp -= i64StackSz
-					arg = readI64(argp)
-				}
-				n, _ := fmt.Fprintf(&b, fmt.Sprintf("%%%sd", modifiers), append(w, arg)...)
-				written += n
-			case 'u':
-				var arg interface{}
-				switch long {
-				case 0:
-					argp -= i32StackSz
-					arg = readU32(argp)
-				case 1:
-					argp -= longStackSz
-					arg = readULong(argp)
-				default:
-					argp -= i64StackSz
-					arg = readU64(argp)
+			n := len(b.Bytes())
+			spec := format
+			var s printfSpec
+			format, argp = s.parse(format, argp)
+			if argp = s.format(&b, argp, written); s.verb == 0 {
+				// Invalid conversion specification, copy it to the output.
+				b.WriteByte('%')
+				for ; spec != format; spec++ {
+					b.WriteByte(readU8(spec))
 				}
-				n, _ := fmt.Fprintf(&b, fmt.Sprintf("%%%sd", modifiers), append(w, arg)...)
-				written += n
-			case 'x':
-				var arg interface{}
-				switch long {
-				case 0:
-					argp -= i32StackSz
-					arg = readU32(argp)
-				case 1:
-					argp -= longStackSz
-					arg = readULong(argp)
-				default:
-					argp -= i64StackSz
-					arg = readU64(argp)
+			}
+			written += len(b.Bytes()) - n
+		default:
+			b.WriteByte(ch)
+			written++
+			if ch == '\n' && !flush() {
+				b.Close()
+				return -1
+			}
+		}
+	}
+}
+
+// printfSpec is a printf conversion specification.
+type printfSpec struct {
+	hash  bool
+	minus bool
+	mod   string // Length modifier.
+	plus  bool
+	prec  int // -1 if not specified.
+	space bool
+	verb  byte
+	width int
+	zero  bool
+}
+
+// parse parses the conversion specification following '%' at format and
+// returns format and argp updated past the specification and the '*'
+// arguments, if any.
+func (s *printfSpec) parse(format, argp uintptr) (uintptr, uintptr) {
+	num := func() (n int) {
+		for ch := readU8(format); ch >= '0' && ch <= '9'; ch = readU8(format) {
+			if n = 10*n + int(ch-'0'); n > math.MaxInt32 {
+				n = math.MaxInt32
+			}
+			format++
+		}
+		return n
+	}
+
+	s.prec = -1
+flags:
+	for ; ; format++ {
+		switch readU8(format) {
+		case '#':
+			s.hash = true
+		case '-':
+			s.minus = true
+		case '+':
+			s.plus = true
+		case ' ':
+			s.space = true
+		case '0':
+			s.zero = true
+		default:
+			break flags
+		}
+	}
+	switch readU8(format) {
+	case '*':
+		format++
+		argp -= i32StackSz
+		if s.width = int(readI32(argp)); s.width < 0 {
+			s.minus = true
+			s.width = -s.width
+		}
+	default:
+		s.width = num()
+	}
+	if readU8(format) == '.' {
+		format++
+		switch readU8(format) {
+		case '*':
+			format++
+			argp -= i32StackSz
+			if s.prec = int(readI32(argp)); s.prec < 0 {
+				s.prec = -1
+			}
+		default:
+			s.prec = num()
+		}
+	}
+	switch ch := readU8(format); ch {
+	case 'h', 'l':
+		format++
+		s.mod = string(ch)
+		if readU8(format) == ch {
+			format++
+			s.mod += s.mod
+		}
+	case 'j', 'q', 't', 'z', 'L':
+		format++
+		s.mod = string(ch)
+	}
+	switch ch := readU8(format); ch {
+	case 'a', 'A', 'c', 'd', 'e', 'E', 'f', 'F', 'g', 'G', 'i', 'n', 'o', 'p', 's', 'u', 'x', 'X', '%':
+		s.verb = ch
+		format++
+	}
+	return format, argp
+}
+
+// intArg returns the next integer argument, truncated to the size selected by
+// the length modifier, and the updated argp.
+func (s *printfSpec) intArg(argp uintptr, signed bool) (uintptr, uint64) {
+	var v uint64
+	bits := uint(32)
+	switch s.mod {
+	case "l":
+		argp -= longStackSz
+		v = uint64(readLong(argp))
+		bits = longBits
+	case "ll", "j", "q", "L":
+		argp -= i64StackSz
+		v = readU64(argp)
+		bits = 64
+	case "z", "t":
+		argp -= ptrStackSz
+		v = uint64(readPtr(argp))
+		bits = 8 * ptrSize
+	default:
+		argp -= i32StackSz
+		v = uint64(readI32(argp))
+		switch s.mod {
+		case "hh":
+			bits = 8
+		case "h":
+			bits = 16
+		}
+	}
+	v <<= 64 - bits
+	if signed {
+		return argp, uint64(int64(v) >> (64 - bits))
+	}
+
+	return argp, v >> (64 - bits)
+}
+
+// format appends the conversion of the argument at argp to b and returns the
+// updated argp. n is the number of bytes written so far.
+func (s *printfSpec) format(b *buffer.Bytes, argp uintptr, n int) uintptr {
+	switch s.verb {
+	case 'd', 'i':
+		var v uint64
+		argp, v = s.intArg(argp, true)
+		sign := s.sign(int64(v) < 0)
+		if int64(v) < 0 {
+			v = -v
+		}
+		s.formatInt(b, sign, v, 10)
+	case 'o', 'u', 'x', 'X':
+		var v uint64
+		argp, v = s.intArg(argp, false)
+		base := 10
+		switch s.verb {
+		case 'o':
+			base = 8
+		case 'x', 'X':
+			base = 16
+		}
+		s.formatInt(b, "", v, base)
+	case 'p':
+		argp -= ptrStackSz
+		v := readPtr(argp)
+		if v == 0 {
+			s.pad(b, "", "(nil)", false)
+			break
+		}
+
+		s.hash = true
+		s.formatInt(b, s.sign(false), uint64(v), 16)
+	case 'c':
+		argp -= i32StackSz
+		v := readI32(argp)
+		if s.mod == "l" {
+			s.pad(b, "", string(rune(v)), false)
+			break
+		}
+
+		s.pad(b, "", string(byte(v)), false)
+	case 's':
+		argp -= ptrStackSz
+		s.pad(b, "", s.str(readPtr(argp)), false)
+	case 'a', 'A', 'e', 'E', 'f', 'F', 'g', 'G':
+		argp -= f64StackSz
+		s.formatFloat(b, readF64(argp))
+	case 'n':
+		argp -= ptrStackSz
+		if p := readPtr(argp); p != 0 {
+			scanStoreInt(p, uint64(n), s.mod)
+		}
+	case '%':
+		b.WriteByte('%')
+	}
+	return argp
+}
+
+// sign returns the sign prefix of a signed conversion.
+func (s *printfSpec) sign(neg bool) string {
+	switch {
+	case neg:
+		return "-"
+	case s.plus:
+		return "+"
+	case s.space:
+		return " "
+	}
+	return ""
+}
+
+// pad appends prefix and body to b, padded to the field width. Zero padding is
+// inserted between prefix and body.
+func (s *printfSpec) pad(b *buffer.Bytes, prefix, body string, zero bool) {
+	fill := s.width - len(prefix) - len(body)
+	if fill <= 0 {
+		b.WriteString(prefix)
+		b.WriteString(body)
+		return
+	}
+
+	switch {
+	case s.minus:
+		b.WriteString(prefix)
+		b.WriteString(body)
+		b.WriteString(strings.Repeat(" ", fill))
+	case zero:
+		b.WriteString(prefix)
+		b.WriteString(strings.Repeat("0", fill))
+		b.WriteString(body)
+	default:
+		b.WriteString(strings.Repeat(" ", fill))
+		b.WriteString(prefix)
+		b.WriteString(body)
+	}
+}
+
+func (s *printfSpec) formatInt(b *buffer.Bytes, prefix string, v uint64, base int) {
+	digits := strconv.FormatUint(v, base)
+	if s.prec == 0 && v == 0 {
+		digits = ""
+	}
+	if len(digits) < s.prec {
+		digits = strings.Repeat("0", s.prec-len(digits)) + digits
+	}
+	if s.hash {
+		switch {
+		case base == 8 && !strings.HasPrefix(digits, "0"):
+			digits = "0" + digits
+		case base == 16 && v != 0:
+			prefix += "0x"
+		}
+	}
+	if s.verb == 'X' {
+		prefix = strings.ToUpper(prefix)
+		digits = strings.ToUpper(digits)
+	}
+	s.pad(b, prefix, digits, s.zero && !s.minus && s.prec < 0)
+}
+
+// str returns the C string at p limited to the precision. Wide strings are
+// converted to UTF-8.
+func (s *printfSpec) str(p uintptr) string {
+	if p == 0 {
+		if s.prec >= 0 && s.prec < len("(null)") {
+			return ""
+		}
+
+		return "(null)"
+	}
+
+	var b []byte
+	for s.prec < 0 || len(b) < s.prec {
+		if s.mod != "l" {
+			ch := readU8(p)
+			if ch == 0 {
+				break
+			}
+
+			b = append(b, ch)
+			p++
+			continue
+		}
+
+		var r rune
+		switch runtime.GOOS {
+		case "windows":
+			r = rune(readU16(p))
+			p += 2
+		default:
+			r = rune(readI32(p))
+			p += 4
+		}
+		if r == 0 {
+			break
+		}
+
+		var a [utf8.UTFMax]byte
+		n := utf8.EncodeRune(a[:], r)
+		if s.prec >= 0 && len(b)+n > s.prec {
+			break
+		}
+
+		b = append(b, a[:n]...)
+	}
+	return string(b)
+}
+
+func (s *printfSpec) formatFloat(b *buffer.Bytes, v float64) {
+	prefix := s.sign(math.Signbit(v))
+	v = math.Abs(v)
+	zero := s.zero && !s.minus
+	prec := s.prec
+	var body string
+	switch {
+	case math.IsInf(v, 0):
+		body = "inf"
+		zero = false
+	case math.IsNaN(v):
+		body = "nan"
+		zero = false
+	case s.verb == 'a' || s.verb == 'A':
+		prefix += "0x"
+		body = s.hexFloat(v)
+	case s.verb == 'g' || s.verb == 'G':
+		switch prec {
+		case -1:
+			prec = 6
+		case 0:
+			prec = 1
+		}
+		body = strconv.FormatFloat(v, 'e', prec-1, 64)
+		if x, _ := strconv.Atoi(body[strings.IndexByte(body, 'e')+1:]); x >= -4 && x < prec {
+			body = strconv.FormatFloat(v, 'f', prec-1-x, 64)
+		}
+		mant, exp := body, ""
+		if i := strings.IndexByte(body, 'e'); i >= 0 {
+			mant, exp = body[:i], body[i:]
+		}
+		switch {
+		case s.hash:
+			if !strings.Contains(mant, ".") {
+				mant += "."
+			}
+		case strings.Contains(mant, "."):
+			mant = strings.TrimSuffix(strings.TrimRight(mant, "0"), ".")
+		}
+		body = mant + exp
+	default:
+		if prec < 0 {
+			prec = 6
+		}
+		verb := byte('e')
+		if s.verb == 'f' || s.verb == 'F' {
+			verb = 'f'
+		}
+		body = strconv.FormatFloat(v, verb, prec, 64)
+		if s.hash && prec == 0 {
+			if i := strings.IndexByte(body, 'e'); i >= 0 {
+				body = body[:i] + "." + body[i:]
+				break
+			}
+
+			body += "."
+		}
+	}
+	if s.verb >= 'A' && s.verb <= 'Z' {
+		prefix = strings.ToUpper(prefix)
+		body = strings.ToUpper(body)
+	}
+	s.pad(b, prefix, body, zero)
+}
+
+// hexFloat returns the %a conversion of a finite, non negative v without the
+// 0x prefix. Like glibc, subnormals are not normalized.
+func (s *printfSpec) hexFloat(v float64) string {
+	const fracDigits = 13
+
+	bits := math.Float64bits(v)
+	exp := int(bits>>52) - 1023
+	lead := uint64(1)
+	frac := bits & (1<<52 - 1)
+	if bits>>52 == 0 {
+		lead = 0
+		exp = -1022
+		if frac == 0 {
+			exp = 0
+		}
+	}
+	digits := fracDigits
+	if s.prec >= 0 && s.prec < fracDigits {
+		// Round half to even.
+		shift := uint(4 * (fracDigits - s.prec))
+		m := lead<<52 | frac
+		rem := m & (1<<shift - 1)
+		m >>= shift
+		if half := uint64(1) << (shift - 1); rem > half || rem == half && m&1 != 0 {
+			m++
+		}
+		digits = s.prec
+		lead = m >> uint(4*digits)
+		frac = m & (1<<uint(4*digits) - 1)
+	}
+	var d string
+	if digits != 0 {
+		d = fmt.Sprintf("%0*x", digits, frac)
+	}
+	switch {
+	case s.prec < 0:
+		d = strings.TrimRight(d, "0")
+	case s.prec > fracDigits:
+		d += strings.Repeat("0", s.prec-fracDigits)
+	}
+	r := strconv.FormatUint(lead, 16)
+	if d != "" || s.hash {
+		r += "." + d
+	}
+	return fmt.Sprintf("%sp%+d", r, exp)
+}
+
+// scanInput is the input of goFscanf with one byte of look ahead.
+type scanInput struct {
+	b      [1]byte
+	ch     int   // Look ahead byte, -1 at EOF. Valid if peeked.
+	n      int32 // Bytes consumed.
+	peeked bool
+	r      io.Reader
+}
+
+func (s *scanInput) peek() int {
+	if !s.peeked {
+		s.ch = -1
+		if _, err := io.ReadFull(s.r, s.b[:]); err == nil {
+			s.ch = int(s.b[0])
+		}
+		s.peeked = true
+	}
+	return s.ch
+}
+
+func (s *scanInput) next() int {
+	ch := s.peek()
+	if ch >= 0 {
+		s.peeked = false
+		s.n++
+	}
+	return ch
+}
+
+// unread returns the byte read ahead but not consumed, if any.
+func (s *scanInput) unread() (byte, bool) { return byte(s.ch), s.peeked && s.ch >= 0 }
+
+func (s *scanInput) skipSpace() {
+	for isSpace(s.peek()) {
+		s.next()
+	}
+}
+
+// scanInt consumes an integer in base (0 means C literal syntax) of at most
+// width bytes. Overflow wraps around.
+func (s *scanInput) scanInt(width, base int) (v uint64, ok bool) {
+	n := 0
+	neg := false
+	if ch := s.peek(); ch == '+' || ch == '-' {
+		neg = ch == '-'
+		s.next()
+		n++
+	}
+	if (base == 0 || base == 16) && n < width && s.peek() == '0' {
+		s.next()
+		n++
+		ok = true
+		switch {
+		case n < width && s.peek()|0x20 == 'x':
+			s.next()
+			n++
+			base = 16
+		case base == 0:
+			base = 8
+		}
+	}
+	if base == 0 {
+		base = 10
+	}
+	for ; n < width; n++ {
+		d := digitValue(s.peek())
+		if d >= base {
+			break
+		}
+
+		v = v*uint64(base) + uint64(d)
+		s.next()
+		ok = true
+	}
+	if neg {
+		v = -v
+	}
+	return v, ok
+}
+
+// scanFloat consumes a floating point number, infinity or NaN of at most width
+// bytes.
+func (s *scanInput) scanFloat(width int) (float64, bool) {
+	var b []byte
+	accept := func(set string) bool {
+		if len(b) < width {
+			if ch := s.peek(); ch >= 0 && strings.IndexByte(set, byte(ch)) >= 0 {
+				b = append(b, byte(s.next()))
+				return true
+			}
+		}
+		return false
+	}
+	word := func(pairs string) bool { // "aAbB" accepts "ab" ignoring case.
+		for i := 0; i < len(pairs); i += 2 {
+			if !accept(pairs[i : i+2]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	accept("+-")
+	switch {
+	case accept("iI"):
+		if word("nNfF") {
+			word("iInNiItTyY")
+		}
+	case accept("nN"):
+		word("aAnN")
+	default:
+		digits := "0123456789"
+		exp := "eE"
+		ok := accept("0")
+		hex := ok && accept("xX")
+		if hex {
+			digits += "abcdefABCDEF"
+			exp = "pP"
+		}
+		for accept(digits) {
+			ok = true
+		}
+		if accept(".") {
+			for accept(digits) {
+				ok = true
+			}
+		}
+		if !ok {
+			return 0, false
+		}
+
+		if !accept(exp) {
+			if hex {
+				b = append(b, 'p', '0')
+			}
+			break
+		}
+
+		accept("+-")
+		for accept("0123456789") {
+		}
+	}
+	v, err := strconv.ParseFloat(string(b), 64)
+	if err != nil && err.(*strconv.NumError).Err != strconv.ErrRange {
+		return 0, false
+	}
+
+	return v, true
+}
+
+// scanChars consumes at most width bytes accepted by f.
+func (s *scanInput) scanChars(width int, f func(byte) bool) (b []byte) {
+	for len(b) < width {
+		ch := s.peek()
+		if ch < 0 || !f(byte(ch)) {
+			break
+		}
+
+		b = append(b, byte(s.next()))
+	}
+	return b
+}
+
+func isSpace(ch int) bool {
+	switch ch {
+	case ' ', '\f', '\n', '\r', '\t', '\v':
+		return true
+	}
+	return false
+}
+
+func digitValue(ch int) int {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return ch - '0'
+	case ch >= 'a' && ch <= 'z':
+		return ch - 'a' + 10
+	case ch >= 'A' && ch <= 'Z':
+		return ch - 'A' + 10
+	}
+	return math.MaxInt32
+}
+
+// scanStore writes the characters in b to p, zero terminated if z. Wide
+// characters are stored as wchar_t.
+func scanStore(p uintptr, b []byte, wide, z bool) {
+	if z {
+		b = append(b, 0)
+	}
+	for _, v := range b {
+		switch {
+		case !wide:
+			writeU8(p, v)
+			p++
+		case runtime.GOOS == "windows":
+			writeU16(p, uint16(v))
+			p += 2
+		default:
+			writeI32(p, int32(v))
+			p += 4
+		}
+	}
+}
+
+// scanStoreInt writes v to p using the size selected by the length modifier
+// mod. Like in glibc, L selects long long.
+func scanStoreInt(p uintptr, v uint64, mod string) {
+	switch mod {
+	case "hh":
+		writeU8(p, uint8(v))
+	case "h":
+		writeU16(p, uint16(v))
+	case "":
+		writeU32(p, uint32(v))
+	case "l":
+		writeLong(p, int64(v))
+	case "ll", "j", "q", "L":
+		writeU64(p, v)
+	case "z", "t":
+		writePtr(p, uintptr(v))
+	}
+}
+
+// goFscanf implements the scanf family. It returns the number of assigned
+// conversions or EOF if the input ends before the first conversion.
+func goFscanf(in *scanInput, format, argp uintptr) int32 {
+	var r int32
+	conv := false
+	eof := func() int32 {
+		if r == 0 && !conv {
+			return stdio.XEOF
+		}
+
+		return r
+	}
+
+	for {
+		ch := readU8(format)
+		format++
+		switch {
+		case ch == 0:
+			return r
+		case isSpace(int(ch)):
+			in.skipSpace()
+			continue
+		case ch != '%':
+			switch in.peek() {
+			case -1:
+				return eof()
+			case int(ch):
+				in.next()
+				continue
+			default:
+				return r
+			}
+		}
+
+		suppress := readU8(format) == '*'
+		if suppress {
+			format++
+		}
+		width := 0
+		for ch = readU8(format); ch >= '0' && ch <= '9'; ch = readU8(format) {
+			width = 10*width + int(ch-'0')
+			format++
+		}
+		var mod string
+		switch ch {
+		case 'h', 'l':
+			format++
+			mod = string(ch)
+			if readU8(format) == ch {
+				format++
+				mod += mod
+			}
+		case 'j', 'q', 't', 'z', 'L':
+			format++
+			mod = string(ch)
+		}
+		verb := readU8(format)
+		format++
+		var arg uintptr
+		if !suppress && verb != '%' {
+			argp -= ptrStackSz
+			arg = readPtr(argp)
+		}
+		switch verb {
+		case 'c', 'n', '[':
+			// Leading white space is significant.
+		default:
+			in.skipSpace()
+		}
+		if width == 0 {
+			width = math.MaxInt32
+		}
+
+		switch verb {
+		case '%':
+			switch in.peek() {
+			case -1:
+				return eof()
+			case '%':
+				in.next()
+				continue
+			default:
+				return r
+			}
+		case 'n':
+			if !suppress {
+				scanStoreInt(arg, uint64(in.n), mod)
+			}
+			continue
+		case 'c':
+			if width == math.MaxInt32 {
+				width = 1
+			}
+			b := in.scanChars(width, func(byte) bool { return true })
+			if len(b) < width {
+				return eof()
+			}
+
+			if !suppress {
+				scanStore(arg, b, mod == "l", false)
+			}
+		case 's':
+			b := in.scanChars(width, func(c byte) bool { return !isSpace(int(c)) })
+			if len(b) == 0 {
+				return eof()
+			}
+
+			if !suppress {
+				scanStore(arg, b, mod == "l", true)
+			}
+		case '[':
+			var set [256]bool
+			neg := readU8(format) == '^'
+			if neg {
+				format++
+			}
+			for first := true; ; first = false {
+				ch := readU8(format)
+				if ch == 0 {
+					return r
 				}
-				n, _ := fmt.Fprintf(&b, fmt.Sprintf("%%%sx", modifiers), append(w, arg)...)
-				written += n
-			case 'l':
-				long++
-				goto more
-			case 'f':
-				argp -= f64StackSz
-				arg := readF64(argp)
-				n, _ := fmt.Fprintf(&b, fmt.Sprintf("%%%sf", modifiers), append(w, arg)...)
-				written += n
-			case 'p':
-				argp -= ptrStackSz
-				arg := readPtr(argp)
-				n, _ := fmt.Fprintf(&b, fmt.Sprintf("%%%sp", modifiers), append(w, unsafe.Pointer(arg))...)
-				written += n
-			case 'g':
-				argp -= f64StackSz
-				arg := readF64(argp)
-				n, _ := fmt.Fprintf(&b, fmt.Sprintf("%%%sg", modifiers), append(w, arg)...)
-				written += n
-			case 's':
-				argp -= ptrStackSz
-				arg := readPtr(argp)
-				if arg == 0 {
+
+				format++
+				if ch == ']' && !first {
 					break
 				}
 
-				var b2 buffer.Bytes
-				for {
-					c := readI8(arg)
-					arg++
-					if c == 0 {
-						n, _ := fmt.Fprintf(&b, fmt.Sprintf("%%%ss", modifiers), append(w, b2.Bytes())...)
-						b2.Close()
-						written += n
-						break
+				if hi := readU8(format + 1); readU8(format) == '-' && hi != ']' && hi != 0 {
+					for c := int(ch); c <= int(hi); c++ {
+						set[c] = true
 					}
+					format += 2
+					continue
+				}
 
-					b2.WriteByte(byte(c))
+				set[ch] = true
+			}
+			b := in.scanChars(width, func(c byte) bool { return set[c] != neg })
+			if len(b) == 0 {
+				if in.peek() < 0 {
+					return eof()
 				}
-			case '%':
-				b.WriteByte('%')
-				written++
-			default:
-				panic(fmt.Errorf("TODO %q", "%"+string(ch)))
+
+				return r
 			}
-		default:
-			b.WriteByte(byte(ch))
-			written++
-			if ch == '\n' {
-				bts := b.Bytes()
-				if limit >= 0 && int64(len(bts)) > limit {
-					bts = bts[:limit]
+
+			if !suppress {
+				scanStore(arg, b, mod == "l", true)
+			}
+		case 'd', 'i', 'o', 'u', 'x', 'X', 'p':
+			base := 10
+			switch verb {
+			case 'i':
+				base = 0
+			case 'o':
+				base = 8
+			case 'x', 'X', 'p':
+				base = 16
+			}
+			v, ok := in.scanInt(width, base)
+			if !ok {
+				if in.peek() < 0 {
+					return eof()
 				}
-				if _, err := w.Write(bts); err != nil {
-					b.Close()
-					return -1
+
+				return r
+			}
+
+			switch {
+			case suppress:
+				// nop
+			case verb == 'p':
+				writePtr(arg, uintptr(v))
+			default:
+				scanStoreInt(arg, v, mod)
+			}
+		case 'a', 'A', 'e', 'E', 'f', 'F', 'g', 'G':
+			v, ok := in.scanFloat(width)
+			if !ok {
+				if in.peek() < 0 {
+					return eof()
 				}
-				b.Reset()
+
+				return r
+			}
+
+			switch {
+			case suppress:
+				// nop
+			case mod == "l" || mod == "L":
+				writeF64(arg, v)
+			default:
+				writeF32(arg, float32(v))
 			}
+		default:
+			return r
+		}
+		conv = true
+		if !suppress {
+			r++
 		}
 	}
 }
@@ -592,7 +1448,7 @@ func goFprintf(w io.Writer, format, argp uintptr, limit int64) int32 {
 // int getchar(void);
 func (c *cpu) getchar() {
 	p := buffer.Get(1)
-	if _, err := files.reader(stdin, c).Read(*p); err != nil {
+	if _, err := c.m.files.reader(c.m.files.stdin, c).Read(*p); err != nil {
 		writeI32(c.rp, stdio.XEOF)
 		buffer.Put(p)
 		return
@@ -611,7 +1467,7 @@ func (c *cpu) printf() {
 // int putchar(int c);
 func (c *cpu) putchar() {
 	ch := readI32(c.sp)
-	w := files.writer(stdout, c)
+	w := c.m.files.writer(c.m.files.stdout, c)
 	p := buffer.Get(1)
 	b := *p
 	b[0] = byte(ch)
@@ -627,7 +1483,7 @@ func (c *cpu) putchar() {
 func (c *cpu) puts() {
 	p := readPtr(c.sp)
 	s := GoString(p)
-	w := files.writer(stdout, c)
+	w := c.m.files.writer(c.m.files.stdout, c)
 	var r int32
 	if _, err := fmt.Fprintf(w, "%s\n", s); err != nil {
 		r = stdio.XEOF
@@ -638,17 +1494,34 @@ func (c *cpu) puts() {
 // void rewind(FILE *stream);
 func (c *cpu) rewind() {
 	stream := readPtr(c.sp)
-	s := files.seeker(stream, c)
+	s := c.m.files.seeker(stream, c)
 	if s == nil {
 		c.setErrno(errno.XEBADF)
 		return
 	}
 
+	c.m.files.drop(stream)
 	if _, err := s.Seek(0, os.SEEK_SET); err != nil {
 		c.setErrno(err)
 	}
 }
 
+// int scanf(const char *format, ...);
+func (c *cpu) scanf() {
+	ap := c.rp - ptrStackSz
+	writeI32(c.rp, c.scanStream(c.m.files.stdin, readPtr(ap), ap))
+}
+
+// scanStream implements the scanf family reading from stream.
+func (c *cpu) scanStream(stream, format, argp uintptr) int32 {
+	in := &scanInput{r: c.m.files.reader(stream, c)}
+	r := goFscanf(in, format, argp)
+	if b, ok := in.unread(); ok {
+		c.m.files.unread(stream, b)
+	}
+	return r
+}
+
 // int snprintf(char *str, size_t size, const char *format, ...);
 func (c *cpu) snprintf() {
 	ap := c.rp - ptrStackSz
@@ -656,7 +1529,12 @@ func (c *cpu) snprintf() {
 	ap -= ptrStackSz
 	size := readLong(ap)
 	ap -= longStackSz
-	writeI32(c.rp, goFprintf(&w, readPtr(ap), ap, size))
+	if size == 0 {
+		writeI32(c.rp, goFprintf(ioutil.Discard, readPtr(ap), ap, -1))
+		return
+	}
+
+	writeI32(c.rp, goFprintf(&w, readPtr(ap), ap, size-1))
 	writeI8(uintptr(w), 0)
 }
 
@@ -669,12 +1547,52 @@ func (c *cpu) sprintf() {
 	writeI8(uintptr(w), 0)
 }
 
+// int sscanf(const char *str, const char *format, ...);
+func (c *cpu) sscanf() {
+	ap := c.rp - ptrStackSz
+	str := readPtr(ap)
+	ap -= ptrStackSz
+	r := strReader(str)
+	writeI32(c.rp, goFscanf(&scanInput{r: &r}, readPtr(ap), ap))
+}
+
+// strReader reads a C string.
+type strReader uintptr
+
+func (s *strReader) Read(b []byte) (int, error) {
+	p := uintptr(*s)
+	n := 0
+	for ; n < len(b); n++ {
+		ch := readU8(p)
+		if ch == 0 {
+			break
+		}
+
+		b[n] = ch
+		p++
+	}
+	*s = strReader(p)
+	if n == 0 && len(b) != 0 {
+		return 0, io.EOF
+	}
+
+	return n, nil
+}
+
 // int vfprintf(FILE *stream, const char *format, va_list ap);
 func (c *cpu) vfprintf() {
 	sp, ap := popPtr(c.sp)
 	sp, format := popPtr(sp)
 	stream := readPtr(sp)
-	writeI32(c.rp, goFprintf(files.writer(stream, c), format, ap, -1))
+	writeI32(c.rp, goFprintf(c.m.files.writer(stream, c), format, ap, -1))
+}
+
+// int vfscanf(FILE *stream, const char *format, va_list ap);
+func (c *cpu) vfscanf() {
+	sp, ap := popPtr(c.sp)
+	sp, format := popPtr(sp)
+	stream := readPtr(sp)
+	writeI32(c.rp, c.scanStream(stream, format, ap))
 }
 
 // int vprintf(const char *format, va_list ap);
@@ -683,3 +1601,18 @@ func (c *cpu) vprintf() {
 	format := readPtr(sp)
 	writeI32(c.rp, goFprintf(c.m.stdout, format, ap, -1))
 }
+
+// int vscanf(const char *format, va_list ap);
+func (c *cpu) vscanf() {
+	sp, ap := popPtr(c.sp)
+	format := readPtr(sp)
+	writeI32(c.rp, c.scanStream(c.m.files.stdin, format, ap))
+}
+
+// int vsscanf(const char *str, const char *format, va_list ap);
+func (c *cpu) vsscanf() {
+	sp, ap := popPtr(c.sp)
+	sp, format := popPtr(sp)
+	r := strReader(readPtr(sp))
+	writeI32(c.rp, goFscanf(&scanInput{r: &r}, format, ap))
+}
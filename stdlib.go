@@ -6,6 +6,7 @@ package virtual
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"sort"
 
@@ -68,6 +69,7 @@ func (c *cpu) calloc() {
 			lo = 1
 		}
 		p = c.m.calloc(int(lo))
+		c.trackAlloc(p, int(lo))
 	}
 	if strace {
 		fmt.Fprintf(os.Stderr, "calloc(%#x) %#x\t; %s\n", size, p, c.pos())
@@ -84,6 +86,7 @@ func (c *cpu) free() {
 	if strace {
 		fmt.Fprintf(os.Stderr, "freep(%#x)\t; %s\n", ptr, c.pos())
 	}
+	c.trackFree(ptr)
 	c.m.free(ptr)
 }
 
@@ -96,6 +99,7 @@ func (c *cpu) malloc() {
 			size = 1
 		}
 		p = c.m.malloc(int(size))
+		c.trackAlloc(p, int(size))
 	}
 	if strace {
 		fmt.Fprintf(os.Stderr, "malloc(%#x) %#x\t; %s\n", size, p, c.pos())
@@ -182,6 +186,59 @@ func (c *cpu) getenv() {
 	writePtr(c.rp, p)
 }
 
+// int atexit(void (*function)(void));
+func (c *cpu) atexit() {
+	function := readPtr(c.sp)
+	if ptrace {
+		fmt.Fprintf(os.Stderr, "atexit(%#x)\t; %s\n", function, c.pos())
+	}
+	c.m.atExitMu.Lock()
+	c.m.atExit = append(c.m.atExit, function)
+	c.m.atExitMu.Unlock()
+	writeI32(c.rp, 0)
+}
+
+// exit performs the normal process termination: it calls the functions
+// registered by atexit in the reverse order of their registration and then
+// flushes and closes all open streams.
+func (c *cpu) exit(status int) (int, error) {
+	m := c.m
+	for {
+		m.atExitMu.Lock()
+		n := len(m.atExit)
+		if n == 0 {
+			m.atExitMu.Unlock()
+			break
+		}
+
+		function := m.atExit[n-1]
+		m.atExit = m.atExit[:n-1]
+		m.atExitMu.Unlock()
+		// Arguments
+		c.rpStack = append(c.rpStack, c.rp)
+		c.rp = c.sp
+		// C callout
+		if _, err := c.run(function - ffiProlog); err != nil {
+			return -1, err
+		}
+	}
+
+	err := m.files.closeAll(m)
+	if e := m.fds.closeAll(); e != nil && err == nil {
+		err = e
+	}
+	for _, w := range []io.Writer{m.stdout, m.stderr} {
+		if f, ok := w.(interface {
+			Flush() error
+		}); ok {
+			if e := f.Flush(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return status, err
+}
+
 // void qsort(void *base, size_t nmemb, size_t size, int (*compar)(const void *, const void *));
 func (c *cpu) qsort() {
 	sp, compar := popPtr(c.sp)
@@ -202,11 +259,18 @@ func (c *cpu) qsort() {
 	c.ip = ip
 }
 
+// long random(void);
+func (c *cpu) random() { writeLong(c.rp, int64(c.rand())) }
+
 // void *realloc(void *ptr, size_t size);
 func (c *cpu) realloc() {
 	sp, size := popLong(c.sp)
 	ptr := readPtr(sp)
+	c.trackCheck(ptr)
 	r := c.m.realloc(ptr, int(size))
+	if r != 0 || size == 0 {
+		c.trackRealloc(ptr, r, int(size))
+	}
 	if strace {
 		fmt.Fprintf(os.Stderr, "realloc(%#x, %#x) %#x\t; %s\n", ptr, size, r, c.pos())
 	}
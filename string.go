@@ -174,7 +174,8 @@ func (c *cpu) strdup() {
 	for s := s0; readI8(s) != 0; s++ {
 		n++
 	}
-	d := c.m.malloc(n)
+	d := c.m.malloc(n + 1)
+	c.trackAlloc(d, n+1)
 	if d == 0 {
 		c.setErrno(errno.XENOMEM)
 		writePtr(c.rp, 0)
@@ -0,0 +1,140 @@
+// Copyright 2017 The Virtual Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package virtual
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cznic/ir"
+)
+
+// Symbol describes an external function or an external variable of a Binary.
+type Symbol struct {
+	Function bool // Function or variable.
+	Name     string
+	Type     ir.TypeID
+}
+
+// Symbols returns the external functions and variables of b ordered by name.
+func (b *Binary) Symbols() []Symbol {
+	r := make([]Symbol, 0, len(b.Signatures)+len(b.Globals))
+	for k, v := range b.Signatures {
+		r = append(r, Symbol{Function: true, Name: string(dict.S(int(k))), Type: v})
+	}
+	for k, v := range b.Globals {
+		r = append(r, Symbol{Name: string(dict.S(int(k))), Type: v.Type})
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Name != r[j].Name {
+			return r[i].Name < r[j].Name
+		}
+
+		return r[i].Function && !r[j].Function
+	})
+	return r
+}
+
+// signature is the type of a function callable by FFI.
+type signature struct {
+	name ir.NameID
+	typ  ir.TypeID
+}
+
+// addSignatures records the signatures of the external functions of b having
+// their code at base. Must be called with libsMu locked.
+func (m *Machine) addSignatures(b *Binary, base int) {
+	for k, v := range b.Signatures {
+		if pc, ok := b.Sym[k]; ok {
+			if m.sigs == nil {
+				m.sigs = map[int]signature{}
+			}
+			m.sigs[pc+base] = signature{k, v}
+		}
+	}
+}
+
+// checkFFI reports whether out and in match the signature of fn. Functions
+// without a known signature are not checked. Integers match integer types of
+// the same size regardless of signedness. The variadic part of the arguments
+// is not checked.
+func (m *Machine) checkFFI(fn int, out []FFIResult, in []FFIArgument) error {
+	m.libsMu.Lock()
+	defer m.libsMu.Unlock()
+
+	sig, ok := m.sigs[fn]
+	if !ok {
+		return nil
+	}
+
+	if m.model == nil {
+		model, err := ir.NewMemoryModel()
+		if err != nil {
+			return err
+		}
+
+		m.model = model
+		m.tc = ir.TypeCache{}
+	}
+	ft, err := m.tc.Type(sig.typ)
+	if err != nil {
+		return fmt.Errorf("FFI %s: %v", sig.name, err)
+	}
+
+	t, ok := ft.(*ir.FunctionType)
+	if !ok {
+		return fmt.Errorf("FFI %s: not a function type: %s", sig.name, sig.typ)
+	}
+
+	switch {
+	case len(in) < len(t.Arguments), len(in) > len(t.Arguments) && !t.Variadic:
+		return fmt.Errorf("FFI %s: have %v arguments, want %v (%s)", sig.name, len(in), len(t.Arguments), sig.typ)
+	case len(out) != len(t.Results):
+		return fmt.Errorf("FFI %s: have %v results, want %v (%s)", sig.name, len(out), len(t.Results), sig.typ)
+	}
+
+	for i, v := range t.Arguments {
+		if !m.ffiMatch(v, in[i]) {
+			return fmt.Errorf("FFI %s: argument #%v: cannot use %T as %s", sig.name, i+1, in[i], v.ID())
+		}
+	}
+	for i, v := range t.Results {
+		if !m.ffiMatch(v, out[i]) {
+			return fmt.Errorf("FFI %s: result #%v: cannot use %T as %s", sig.name, i+1, out[i], v.ID())
+		}
+	}
+	return nil
+}
+
+// ffiMatch reports whether the FFIArgument or FFIResult v can be used as t.
+func (m *Machine) ffiMatch(t ir.Type, v interface{}) bool {
+	k := t.Kind()
+	switch x := v.(type) {
+	case Int8, Uint8, Int8Result, Uint8Result:
+		return k == ir.Int8 || k == ir.Uint8
+	case Int16, Uint16, Int16Result, Uint16Result:
+		return k == ir.Int16 || k == ir.Uint16
+	case Int32, Uint32, Int32Result, Uint32Result:
+		return k == ir.Int32 || k == ir.Uint32
+	case Int64, Uint64, Int64Result, Uint64Result:
+		return k == ir.Int64 || k == ir.Uint64
+	case Float32, Float32Result:
+		return k == ir.Float32
+	case Float64, Float64Result:
+		return k == ir.Float64
+	case Complex64, Complex64Result:
+		return k == ir.Complex64
+	case Complex128, Complex128Result:
+		return k == ir.Complex128
+	case Bytes, Ptr, PtrResult, String:
+		return k == ir.Pointer || k == ir.Array
+	case Struct:
+		return (k == ir.Struct || k == ir.Union) && m.model.Sizeof(t) == int64(len(x))
+	case StructResult:
+		return (k == ir.Struct || k == ir.Union) && m.model.Sizeof(t) == int64(len(x.Value))
+	default:
+		return false
+	}
+}
@@ -25,6 +25,17 @@ func (c *cpu) mmap64() {
 	sp, prot := popI32(sp)
 	sp, len := popLong(sp)
 	addr := readPtr(sp)
+	if flags&syscall.MAP_ANONYMOUS == 0 {
+		if err := c.hostFd(fildes); err != nil {
+			if strace {
+				fmt.Fprintf(os.Stderr, "mmap(%#x, %#x, %#x, %#x, %#x, %#x) %v\t; %s\n", addr, len, prot, flags, fildes, off, err, c.pos())
+			}
+			c.setErrno(err)
+			writePtr(c.rp, ^uintptr(0))
+			return
+		}
+	}
+
 	r, _, err := syscall.Syscall6(syscall.SYS_MMAP, addr, uintptr(len), uintptr(prot), uintptr(flags), uintptr(fildes), uintptr(off))
 	if strace {
 		fmt.Fprintf(os.Stderr, "mmap(%#x, %#x, %#x, %#x, %#x, %#x) (%#x, %v)\t; %s\n", addr, len, prot, flags, fildes, off, r, err, c.pos())
@@ -32,6 +43,9 @@ func (c *cpu) mmap64() {
 	if err != 0 {
 		c.setErrno(err)
 	}
+	if memcheck && err == 0 {
+		memMapAdd(c.m, r, int(len), prot&syscall.PROT_WRITE == 0)
+	}
 	writePtr(c.rp, r)
 }
 
@@ -46,5 +60,8 @@ func (c *cpu) munmap() {
 	if err != 0 {
 		c.setErrno(err)
 	}
+	if memcheck && err == 0 {
+		memMapRemove(addr)
+	}
 	writeI32(c.rp, int32(r))
 }
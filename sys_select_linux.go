@@ -22,6 +22,25 @@ func (c *cpu) select_() {
 	sp, writefds := popPtr(sp)
 	sp, readfds := popPtr(sp)
 	nfds := readI32(sp)
+	for _, set := range []uintptr{readfds, writefds, exceptfds} {
+		if set == 0 {
+			continue
+		}
+
+		fds := (*syscall.FdSet)(memR(set, int(unsafe.Sizeof(syscall.FdSet{}))))
+		w := 8 * int32(unsafe.Sizeof(fds.Bits[0]))
+		for fd := int32(0); fd < nfds && fd/w < int32(len(fds.Bits)); fd++ {
+			if fds.Bits[fd/w]&(1<<uint(fd%w)) == 0 {
+				continue
+			}
+
+			if err := c.hostFd(fd); err != nil {
+				c.setErrno(err)
+				writeI32(c.rp, -1)
+				return
+			}
+		}
+	}
 	n, err := syscall.Select(
 		int(nfds),
 		(*syscall.FdSet)(unsafe.Pointer(readfds)),
@@ -8,6 +8,8 @@ package virtual
 
 import (
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"reflect"
 	"sort"
@@ -16,6 +18,7 @@ import (
 	"unsafe"
 
 	sockconst "github.com/cznic/ccir/libc/sys/socket"
+	"github.com/cznic/ccir/libc/unistd"
 	"golang.org/x/sys/unix"
 )
 
@@ -97,6 +100,12 @@ func (c *cpu) connect() {
 	sp, addrlen := popU32(c.sp)
 	sp, addr := popPtr(sp)
 	fd := readI32(sp)
+	if err := c.hostFd(fd); err != nil {
+		c.setErrno(err)
+		writeI32(c.rp, -1)
+		return
+	}
+
 	_, _, err := syscall.Syscall(unix.SYS_CONNECT, uintptr(fd), addr, uintptr(addrlen))
 	if strace {
 		fmt.Fprintf(os.Stderr, "connext(%#x, %#x, %#x) %v\t; %s\n", fd, addr, addrlen, err, c.pos())
@@ -115,6 +124,12 @@ func (c *cpu) getpeername() {
 	sp, addrlen := popPtr(c.sp)
 	sp, addr := popPtr(sp)
 	fd := readI32(sp)
+	if err := c.hostFd(fd); err != nil {
+		c.setErrno(err)
+		writeI32(c.rp, -1)
+		return
+	}
+
 	_, _, err := syscall.Syscall(unix.SYS_GETPEERNAME, uintptr(fd), addr, addrlen)
 	if strace {
 		fmt.Fprintf(os.Stderr, "getpeername(%#x, %#x, %#x) %v\t; %s\n", fd, addr, addrlen, err, c.pos())
@@ -133,6 +148,12 @@ func (c *cpu) getsockname() {
 	sp, addrlen := popPtr(c.sp)
 	sp, addr := popPtr(sp)
 	fd := readI32(sp)
+	if err := c.hostFd(fd); err != nil {
+		c.setErrno(err)
+		writeI32(c.rp, -1)
+		return
+	}
+
 	_, _, err := syscall.Syscall(unix.SYS_GETSOCKNAME, uintptr(fd), addr, addrlen)
 	if strace {
 		fmt.Fprintf(os.Stderr, "getsockname(%#x, %#x, %#x) %v\t; %s\n", fd, addr, addrlen, err, c.pos())
@@ -152,6 +173,12 @@ func (c *cpu) recv() {
 	sp, len := popLong(sp)
 	sp, buf := popPtr(sp)
 	fd := readI32(sp)
+	if err := c.hostFd(fd); err != nil {
+		c.setErrno(err)
+		writeLong(c.rp, -1)
+		return
+	}
+
 	var b []byte
 	h := (*reflect.SliceHeader)(unsafe.Pointer(&b))
 	h.Cap = int(len)
@@ -174,6 +201,12 @@ func (c *cpu) recv() {
 func (c *cpu) shutdown() {
 	sp, how := popI32(c.sp)
 	fd := readI32(sp)
+	if err := c.hostFd(fd); err != nil {
+		c.setErrno(err)
+		writeI32(c.rp, -1)
+		return
+	}
+
 	err := syscall.Shutdown(int(fd), int(how))
 	if strace {
 		fmt.Fprintf(os.Stderr, "shutdown(%#x, %#x) %v\t; %s\n", fd, how, err, c.pos())
@@ -210,6 +243,38 @@ func (c *cpu) writev() {
 	sp, iovcnt := popI32(c.sp)
 	sp, iov := popPtr(sp)
 	fd := readI32(sp)
+	var w io.Writer
+	switch f := c.m.fds.get(fd); {
+	case f != nil:
+		w = f
+	case fd == unistd.XSTDOUT_FILENO:
+		w = c.m.stdout
+	case fd == unistd.XSTDERR_FILENO:
+		w = c.m.stderr
+	}
+	if w != nil {
+		var n int64
+		var err error
+		for i := 0; i < int(iovcnt) && err == nil; i++ {
+			p := iov + uintptr(i)*2*ptrSize
+			base, len := readPtr(p), readULong(p+ptrSize)
+			var m int
+			m, err = w.Write((*[math.MaxInt32]byte)(memR(base, int(len)))[:len])
+			n += int64(m)
+		}
+		if strace {
+			fmt.Fprintf(os.Stderr, "writev(%#x, %#x, %#x) %v %v\t; %s\n", fd, iov, iovcnt, n, err, c.pos())
+		}
+		if err != nil && n == 0 {
+			c.setErrno(err)
+			writeLong(c.rp, -1)
+			return
+		}
+
+		writeLong(c.rp, n)
+		return
+	}
+
 	n, _, err := syscall.Syscall(syscall.SYS_WRITEV, uintptr(fd), iov, uintptr(iovcnt))
 	if strace {
 		fmt.Fprintf(os.Stderr, "writev(%#x, %#x, %#x) %v %v\t; %s\n", fd, iov, iovcnt, n, err, c.pos())
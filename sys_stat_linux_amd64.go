@@ -24,6 +24,15 @@ func init() {
 func (c *cpu) fstat64() {
 	sp, buf := popPtr(c.sp)
 	fildes := readI32(sp)
+	if f := c.m.fds.get(fildes); f != nil {
+		fi, err := f.Stat()
+		if strace {
+			fmt.Fprintf(os.Stderr, "fstat(%v, %#x) %v\t; %s\n", fildes, buf, err, c.pos())
+		}
+		c.statResult(buf, fi, err)
+		return
+	}
+
 	r, _, err := syscall.Syscall(syscall.SYS_FSTAT, uintptr(fildes), buf, 0)
 	if strace {
 		fmt.Fprintf(os.Stderr, "fstat(%v, %#x) %v %v\t; %s\n", fildes, buf, r, err, c.pos())
@@ -38,26 +47,31 @@ func (c *cpu) fstat64() {
 func (c *cpu) lstat64() {
 	sp, buf := popPtr(c.sp)
 	file := readPtr(sp)
-	r, _, err := syscall.Syscall(syscall.SYS_LSTAT, file, buf, 0)
+	fi, err := c.m.fs.Lstat(GoString(file))
 	if strace {
-		fmt.Fprintf(os.Stderr, "lstat(%q, %#x) %v %v\t; %s\n", GoString(file), buf, r, err, c.pos())
+		fmt.Fprintf(os.Stderr, "lstat(%q, %#x) %v\t; %s\n", GoString(file), buf, err, c.pos())
 	}
-	if err != 0 {
-		c.setErrno(err)
+	c.statResult(buf, fi, err)
+}
+
+// int mkdir(const char *path, mode_t mode);
+func (c *cpu) mkdir() {
+	sp, mode := popU32(c.sp)
+	path := readPtr(sp)
+	err := c.m.fs.Mkdir(GoString(path), os.FileMode(mode)&os.ModePerm)
+	if strace {
+		fmt.Fprintf(os.Stderr, "mkdir(%q, %#o) %v\t; %s\n", GoString(path), mode, err, c.pos())
 	}
-	writeI32(c.rp, int32(r))
+	c.fsResult(err)
 }
 
 // extern int stat64(char *__file, struct stat64 *__buf);
 func (c *cpu) stat64() {
 	sp, buf := popPtr(c.sp)
 	file := readPtr(sp)
-	r, _, err := syscall.Syscall(syscall.SYS_STAT, file, buf, 0)
+	fi, err := c.m.fs.Stat(GoString(file))
 	if strace {
-		fmt.Fprintf(os.Stderr, "stat(%q, %#x) %v %v\t; %s\n", GoString(file), buf, r, err, c.pos())
-	}
-	if err != 0 {
-		c.setErrno(err)
+		fmt.Fprintf(os.Stderr, "stat(%q, %#x) %v\t; %s\n", GoString(file), buf, err, c.pos())
 	}
-	writeI32(c.rp, int32(r))
+	c.statResult(buf, fi, err)
 }
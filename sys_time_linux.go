@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"syscall"
+	tim "time"
 )
 
 func init() {
@@ -18,12 +19,53 @@ func init() {
 }
 
 // int gettimeofday(struct timeval *restrict tp, void *restrict tzp);
+//
+// In the deterministic mode the time comes from the clock of the machine and
+// the time zone is UTC.
 func (c *cpu) gettimeofday() {
 	sp, tzp := popPtr(c.sp)
 	tp := readPtr(sp)
-	r, _, err := syscall.Syscall(syscall.SYS_GETTIMEOFDAY, tzp, tp, 0)
+	if c.m.det == nil {
+		r, _, err := syscall.Syscall(syscall.SYS_GETTIMEOFDAY, tp, tzp, 0)
+		if strace {
+			fmt.Fprintf(os.Stderr, "gettimeofday(%#x, %#x) %v %v\n", tp, tzp, r, err)
+		}
+		if err != 0 {
+			c.setErrno(err)
+		}
+		writeI32(c.rp, int32(r))
+		return
+	}
+
+	t := c.now()
+	if tp != 0 {
+		writeLong(tp, t.Unix())
+		writeLong(tp+longBits/8, int64(t.Nanosecond()/1000))
+	}
+	if tzp != 0 {
+		writeI32(tzp, 0)
+		writeI32(tzp+4, 0)
+	}
+	if strace {
+		fmt.Fprintf(os.Stderr, "gettimeofday(%#x, %#x) %v\n", tp, tzp, t)
+	}
+	writeI32(c.rp, 0)
+}
+
+// int utimes(const char *path, const struct timeval times[2]);
+func (c *cpu) utimes() {
+	sp, times := popPtr(c.sp)
+	path := readPtr(sp)
+	atime := c.now()
+	mtime := atime
+	if times != 0 {
+		const tv = 2 * longBits / 8 // sizeof(struct timeval)
+		atime = tim.Unix(readLong(times), 1000*readLong(times+longBits/8))
+		mtime = tim.Unix(readLong(times+tv), 1000*readLong(times+tv+longBits/8))
+	}
+	err := c.m.fs.Chtimes(GoString(path), atime, mtime)
 	if strace {
-		fmt.Fprintf(os.Stderr, "gettimeofday(%#x, %#x) %v %v\n", tzp, tp, r, err)
+		fmt.Fprintf(os.Stderr, "utimes(%q, %#x) %v\t; %s\n", GoString(path), times, err, c.pos())
 	}
-	writeI32(c.rp, int32(r))
+	c.fsResult(err)
 }
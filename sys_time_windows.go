@@ -6,3 +6,6 @@ package virtual
 
 // int gettimeofday(struct timeval *restrict tp, void *restrict tzp);
 func (c *cpu) gettimeofday() { panic("unreachable") }
+
+// int utimes(const char *path, const struct timeval times[2]);
+func (c *cpu) utimes() { panic("unreachable") }
@@ -5,18 +5,42 @@
 package virtual
 
 import (
+	"context"
 	"fmt"
 	"github.com/edsrzf/mmap-go"
 )
 
 var (
+	_ FFIArgument = Bytes(nil)
+	_ FFIArgument = Complex128(0)
+	_ FFIArgument = Complex64(0)
+	_ FFIArgument = Float32(0)
 	_ FFIArgument = Float64(0)
+	_ FFIArgument = Int16(0)
 	_ FFIArgument = Int32(0)
 	_ FFIArgument = Int64(0)
+	_ FFIArgument = Int8(0)
+	_ FFIArgument = Ptr(0)
+	_ FFIArgument = String("")
+	_ FFIArgument = Struct(nil)
+	_ FFIArgument = Uint16(0)
+	_ FFIArgument = Uint32(0)
+	_ FFIArgument = Uint64(0)
+	_ FFIArgument = Uint8(0)
+	_ FFIResult   = Complex128Result{}
+	_ FFIResult   = Complex64Result{}
+	_ FFIResult   = Float32Result{}
 	_ FFIResult   = Float64Result{}
+	_ FFIResult   = Int16Result{}
 	_ FFIResult   = Int32Result{}
 	_ FFIResult   = Int64Result{}
+	_ FFIResult   = Int8Result{}
 	_ FFIResult   = PtrResult{}
+	_ FFIResult   = StructResult{}
+	_ FFIResult   = Uint16Result{}
+	_ FFIResult   = Uint32Result{}
+	_ FFIResult   = Uint64Result{}
+	_ FFIResult   = Uint8Result{}
 )
 
 // FFIArgument is immplemented by all types of FFI arguments.
@@ -30,7 +54,7 @@ type FFIResult interface {
 }
 
 // Float64 is an float64 FFI argument.
-type Float64 int64
+type Float64 float64
 
 func (Float64) arg() {}
 
@@ -69,6 +93,121 @@ type PtrResult struct{ Value *uintptr }
 
 func (PtrResult) result() {}
 
+// Int8 is an int8 FFI argument.
+type Int8 int8
+
+func (Int8) arg() {}
+
+// Int16 is an int16 FFI argument.
+type Int16 int16
+
+func (Int16) arg() {}
+
+// Uint8 is an uint8 FFI argument.
+type Uint8 uint8
+
+func (Uint8) arg() {}
+
+// Uint16 is an uint16 FFI argument.
+type Uint16 uint16
+
+func (Uint16) arg() {}
+
+// Uint32 is an uint32 FFI argument.
+type Uint32 uint32
+
+func (Uint32) arg() {}
+
+// Uint64 is an uint64 FFI argument.
+type Uint64 uint64
+
+func (Uint64) arg() {}
+
+// Float32 is a float32 FFI argument.
+type Float32 float32
+
+func (Float32) arg() {}
+
+// Complex64 is a complex64 FFI argument.
+type Complex64 complex64
+
+func (Complex64) arg() {}
+
+// Complex128 is a complex128 FFI argument.
+type Complex128 complex128
+
+func (Complex128) arg() {}
+
+// Struct is a struct FFI argument passed by value. It holds the memory image
+// of the C struct, including any padding.
+type Struct []byte
+
+func (Struct) arg() {}
+
+// Bytes is a pointer FFI argument. The bytes are copied to memory allocated
+// for the duration of the call. The function receives a pointer to the copy,
+// which is copied back to the Bytes when the call returns.
+type Bytes []byte
+
+func (Bytes) arg() {}
+
+// String is a char* FFI argument. The string is copied to a C string
+// allocated for the duration of the call.
+type String string
+
+func (String) arg() {}
+
+// Int8Result is an FFI int8 result.
+type Int8Result struct{ Value *int8 }
+
+func (Int8Result) result() {}
+
+// Int16Result is an FFI int16 result.
+type Int16Result struct{ Value *int16 }
+
+func (Int16Result) result() {}
+
+// Uint8Result is an FFI uint8 result.
+type Uint8Result struct{ Value *uint8 }
+
+func (Uint8Result) result() {}
+
+// Uint16Result is an FFI uint16 result.
+type Uint16Result struct{ Value *uint16 }
+
+func (Uint16Result) result() {}
+
+// Uint32Result is an FFI uint32 result.
+type Uint32Result struct{ Value *uint32 }
+
+func (Uint32Result) result() {}
+
+// Uint64Result is an FFI uint64 result.
+type Uint64Result struct{ Value *uint64 }
+
+func (Uint64Result) result() {}
+
+// Float32Result is an FFI float32 result.
+type Float32Result struct{ Value *float32 }
+
+func (Float32Result) result() {}
+
+// Complex64Result is an FFI complex64 result.
+type Complex64Result struct{ Value *complex64 }
+
+func (Complex64Result) result() {}
+
+// Complex128Result is an FFI complex128 result.
+type Complex128Result struct{ Value *complex128 }
+
+func (Complex128Result) result() {}
+
+// StructResult is an FFI struct result. The size of the struct is len(Value).
+// The memory image of the returned C struct is copied to Value.
+type StructResult struct{ Value []byte }
+
+func (StructResult) result() {}
+
 type tls struct {
 	errno    int32
 	threadID uintptr
@@ -77,11 +216,54 @@ type tls struct {
 // Thread is a thread of VM execution.
 type Thread struct {
 	cpu
-	ss       uintptr // Stack segment
+	detached bool
+	done     chan struct{} // Closed when a thread created by pthread_create exits.
+	result   uintptr       // Value returned by the start routine.
+	ss       uintptr       // Stack segment
 	stackMem mmap.MMap
 }
 
-func (t *Thread) close() error { return t.stackMem.Unmap() }
+// start runs the C function void *fn(void *arg) on a new goroutine. A thread
+// stopped by its context exits without killing the machine.
+func (t *Thread) start(fn, arg uintptr) {
+	t.done = make(chan struct{})
+	// Alloc result
+	t.sp -= ptrStackSz
+	// Arguments
+	t.rpStack = append(t.rpStack, t.rp)
+	t.rp = t.sp
+	r := t.rp
+	// Argument #1
+	t.sp -= ptrStackSz
+	writePtr(t.sp, arg)
+	go func() {
+		m := t.m
+		if _, err := t.run(fn - ffiProlog); err != nil {
+			if _, ok := err.(ContextError); !ok {
+				if m.stderr != nil {
+					fmt.Fprintln(m.stderr, err)
+				}
+				m.Kill()
+			}
+		}
+
+		t.result = readPtr(r)
+		m.threadsMu.Lock()
+		detached := t.detached
+		close(t.done)
+		m.threadsMu.Unlock()
+		if detached {
+			t.Close()
+		}
+	}()
+}
+
+func (t *Thread) close() error {
+	if memcheck {
+		memMapRemove(t.ss)
+	}
+	return t.stackMem.Unmap()
+}
 
 // Close frees resources acquired from the OS by t.
 func (t *Thread) Close() error {
@@ -95,7 +277,7 @@ func (t *Thread) Close() error {
 		}
 	}
 	t.m.threadsMu.Unlock()
-	return t.stackMem.Unmap()
+	return t.close()
 }
 
 // FFI0 executes a void function fn using 'in' as arguments.  The number and
@@ -114,36 +296,83 @@ func (t *Thread) FFI1(fn int, out FFIResult, in ...FFIArgument) (int, error) {
 
 // FFI executes function fn using 'in' as arguments.  The number and types  of
 // 'out' and 'in' items must match the number and types of the function results
-// and arguments. Variadic functions are supported.
+// and arguments. Variadic functions are supported. If the Binary records the
+// signature of fn, a mismatch is reported as an error before fn is executed.
 func (t *Thread) FFI(fn int, out []FFIResult, in ...FFIArgument) (int, error) {
+	return t.FFIContext(context.Background(), fn, out, in...)
+}
+
+// FFIContext is like FFI, but the execution of fn stops with ContextError when
+// ctx is done. The thread remains usable for subsequent calls.
+func (t *Thread) FFIContext(ctx context.Context, fn int, out []FFIResult, in ...FFIArgument) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, ContextError{err}
+	}
+
+	if err := t.m.checkFFI(fn, out, in); err != nil {
+		return -1, err
+	}
+
+	restore := t.setContext(ctx)
+	defer restore()
+
 	rpStack := t.rpStack
 	rp := t.rp
 	sp := t.sp
+	defer func() {
+		t.rpStack = rpStack
+		t.rp = rp
+		t.sp = sp
+	}()
 
 	// Alloc result(s)
 	for _, v := range out {
-		switch x := v.(type) {
-		case Int32Result:
-			t.sp -= i32StackSz
-		case Int64Result:
-			t.sp -= i64StackSz
-		case Float64Result:
-			t.sp -= f64StackSz
-		case PtrResult:
-			t.sp -= ptrStackSz
-		default:
-			panic(fmt.Errorf("%T", x))
-		}
+		t.sp -= uintptr(ffiResultSize(v))
 	}
 	// Arguments
 	t.rpStack = append(t.rpStack, t.rp)
 	t.rp = t.sp
 	r := t.rp
+	var copies []ffiCopy
+	defer func() {
+		for _, v := range copies {
+			if v.b != nil {
+				copy(v.b, memBytes(v.p, len(v.b)))
+			}
+			t.m.free(v.p)
+		}
+	}()
+
 	for _, v := range in {
 		switch x := v.(type) {
+		case Bytes:
+			p := t.m.malloc(len(x) + 1)
+			if p == 0 {
+				return -1, fmt.Errorf("out of memory")
+			}
+
+			copy(memBytes(p, len(x)), x)
+			copies = append(copies, ffiCopy{x, p})
+			t.sp -= ptrStackSz
+			writePtr(t.sp, p)
+		case Complex128:
+			t.sp -= c128StackSz
+			writeC128(t.sp, complex128(x))
+		case Complex64:
+			t.sp -= c64StackSz
+			writeC64(t.sp, complex64(x))
+		case Float32:
+			t.sp -= f32StackSz
+			writeF32(t.sp, float32(x))
 		case Float64:
 			t.sp -= f64StackSz
 			writeF64(t.sp, float64(x))
+		case Int8:
+			t.sp -= i8StackSz
+			writeI8(t.sp, int8(x))
+		case Int16:
+			t.sp -= i16StackSz
+			writeI16(t.sp, int16(x))
 		case Int32:
 			t.sp -= i32StackSz
 			writeI32(t.sp, int32(x))
@@ -153,42 +382,131 @@ func (t *Thread) FFI(fn int, out []FFIResult, in ...FFIArgument) (int, error) {
 		case Ptr:
 			t.sp -= ptrStackSz
 			writePtr(t.sp, uintptr(x))
+		case String:
+			p := t.m.CString(string(x))
+			if p == 0 {
+				return -1, fmt.Errorf("out of memory")
+			}
+
+			copies = append(copies, ffiCopy{nil, p})
+			t.sp -= ptrStackSz
+			writePtr(t.sp, p)
+		case Struct:
+			t.sp -= uintptr(roundup(len(x), stackAlign))
+			copy(memBytes(t.sp, len(x)), x)
+		case Uint8:
+			t.sp -= i8StackSz
+			writeU8(t.sp, uint8(x))
+		case Uint16:
+			t.sp -= i16StackSz
+			writeU16(t.sp, uint16(x))
+		case Uint32:
+			t.sp -= i32StackSz
+			writeU32(t.sp, uint32(x))
+		case Uint64:
+			t.sp -= i64StackSz
+			writeU64(t.sp, uint64(x))
 		default:
 			panic(fmt.Errorf("%T", x))
 		}
 	}
 	s, err := t.run(uintptr(fn))
 	if err != nil {
-		t.rpStack = rpStack
-		t.rp = rp
-		t.sp = sp
 		return s, err
 	}
 
 	for _, v := range out {
 		switch x := v.(type) {
-		case Int32Result:
+		case Complex128Result:
 			if p := x.Value; p != nil {
-				r, *p = popI32(r)
+				*p = readC128(r)
 			}
-		case Int64Result:
+		case Complex64Result:
+			if p := x.Value; p != nil {
+				*p = readC64(r)
+			}
+		case Float32Result:
 			if p := x.Value; p != nil {
-				r, *p = popI64(r)
+				*p = readF32(r)
 			}
 		case Float64Result:
 			if p := x.Value; p != nil {
-				r, *p = popF64(r)
+				*p = readF64(r)
+			}
+		case Int8Result:
+			if p := x.Value; p != nil {
+				*p = readI8(r)
+			}
+		case Int16Result:
+			if p := x.Value; p != nil {
+				*p = readI16(r)
+			}
+		case Int32Result:
+			if p := x.Value; p != nil {
+				*p = readI32(r)
+			}
+		case Int64Result:
+			if p := x.Value; p != nil {
+				*p = readI64(r)
 			}
 		case PtrResult:
 			if p := x.Value; p != nil {
-				r, *p = popPtr(r)
+				*p = readPtr(r)
+			}
+		case StructResult:
+			copy(x.Value, memBytes(r, len(x.Value)))
+		case Uint8Result:
+			if p := x.Value; p != nil {
+				*p = readU8(r)
+			}
+		case Uint16Result:
+			if p := x.Value; p != nil {
+				*p = readU16(r)
+			}
+		case Uint32Result:
+			if p := x.Value; p != nil {
+				*p = readU32(r)
+			}
+		case Uint64Result:
+			if p := x.Value; p != nil {
+				*p = readU64(r)
 			}
-		default:
-			panic(fmt.Errorf("%T", x))
 		}
+		r += uintptr(ffiResultSize(v))
 	}
-	t.rpStack = rpStack
-	t.rp = rp
-	t.sp = sp
 	return s, err
 }
+
+// ffiCopy is memory allocated for an FFI argument.
+type ffiCopy struct {
+	b []byte // Non nil: Copy back after the call.
+	p uintptr
+}
+
+// ffiResultSize returns the stack size of an FFI result.
+func ffiResultSize(v FFIResult) int {
+	switch x := v.(type) {
+	case Complex128Result:
+		return c128StackSz
+	case Complex64Result:
+		return c64StackSz
+	case Float32Result:
+		return f32StackSz
+	case Float64Result:
+		return f64StackSz
+	case Int8Result, Uint8Result:
+		return i8StackSz
+	case Int16Result, Uint16Result:
+		return i16StackSz
+	case Int32Result, Uint32Result:
+		return i32StackSz
+	case Int64Result, Uint64Result:
+		return i64StackSz
+	case PtrResult:
+		return ptrStackSz
+	case StructResult:
+		return roundup(len(x.Value), stackAlign)
+	default:
+		panic(fmt.Errorf("%T", x))
+	}
+}
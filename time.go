@@ -4,9 +4,59 @@
 
 package virtual
 
+import (
+	"fmt"
+	"os"
+	tim "time"
+)
+
 func init() {
 	registerBuiltins(map[int]Opcode{
 		dict.SID("localtime"): localtime,
 		dict.SID("time"):      time,
 	})
 }
+
+// Layout of struct tm.
+const (
+	tmGmtoff = (9*i32Size + longBits/8 - 1) &^ (longBits/8 - 1)
+	tmZone   = (tmGmtoff + longBits/8 + ptrSize - 1) &^ (ptrSize - 1)
+	tmSize   = tmZone + ptrSize
+	tmZoneSz = 16 // Room for tm_zone, following the struct.
+)
+
+// struct tm *localtime(const time_t *timer);
+func (c *cpu) localtime() {
+	timer := readPtr(c.sp)
+	t := tim.Unix(readLong(timer), 0).In(c.location())
+	zone, off := t.Zone()
+	m := c.m
+	m.tmOnce.Do(func() { m.tm = m.calloc(tmSize + tmZoneSz) })
+	p := m.tm
+	for i, v := range []int{t.Second(), t.Minute(), t.Hour(), t.Day(), int(t.Month()) - 1, t.Year() - 1900, int(t.Weekday()), t.YearDay() - 1, 0} {
+		writeI32(p+uintptr(i*i32Size), int32(v))
+	}
+	writeLong(p+tmGmtoff, int64(off))
+	if len(zone) >= tmZoneSz {
+		zone = zone[:tmZoneSz-1]
+	}
+	CopyString(p+tmSize, zone, true)
+	writePtr(p+tmZone, p+tmSize)
+	if strace {
+		fmt.Fprintf(os.Stderr, "localtime(%#x) %v\t; %s\n", timer, t, c.pos())
+	}
+	writePtr(c.rp, p)
+}
+
+// time_t time(time_t *tloc);
+func (c *cpu) time() {
+	tloc := readPtr(c.sp)
+	t := c.now().Unix()
+	if tloc != 0 {
+		writeLong(tloc, t)
+	}
+	if strace {
+		fmt.Fprintf(os.Stderr, "time(%#x) %v\t; %s\n", tloc, t, c.pos())
+	}
+	writeLong(c.rp, t)
+}
@@ -6,12 +6,12 @@ package virtual
 
 import (
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"os/signal"
 	"syscall"
 	tim "time"
-	"unsafe"
 
 	"github.com/cznic/ccir/libc/errno"
 	"github.com/cznic/ccir/libc/unistd"
@@ -47,19 +47,25 @@ func init() {
 func (c *cpu) access() {
 	sp, amode := popI32(c.sp)
 	path := readPtr(sp)
-	r, _, err := syscall.Syscall(syscall.SYS_ACCESS, path, uintptr(amode), 0)
+	err := c.m.fs.Access(GoString(path), uint32(amode))
 	if strace {
-		fmt.Fprintf(os.Stderr, "access(%q) %v %v\t; %s\t; %s\n", GoString(path), r, err, c.pos(), c.pos())
+		fmt.Fprintf(os.Stderr, "access(%q, %#o) %v\t; %s\n", GoString(path), amode, err, c.pos())
 	}
-	if err != 0 {
-		c.setErrno(err)
-	}
-	writeI32(c.rp, int32(r))
+	c.fsResult(err)
 }
 
 // int close(int fd);
 func (c *cpu) close() {
 	fd := readI32(c.sp)
+	if f := c.m.fds.remove(fd); f != nil {
+		err := f.Close()
+		if strace {
+			fmt.Fprintf(os.Stderr, "close(%v) %v\t; %s\n", fd, err, c.pos())
+		}
+		c.fsResult(err)
+		return
+	}
+
 	r, _, err := syscall.Syscall(syscall.SYS_CLOSE, uintptr(fd), 0, 0)
 	if strace {
 		fmt.Fprintf(os.Stderr, "close(%v) %v %v\t; %s\n", fd, r, err, c.pos())
@@ -73,6 +79,15 @@ func (c *cpu) close() {
 // int fsync(int fildes);
 func (c *cpu) fsync() {
 	fildes := readI32(c.sp)
+	if f := c.m.fds.get(fildes); f != nil {
+		err := f.Sync()
+		if strace {
+			fmt.Fprintf(os.Stderr, "fsync(%v) %v\t; %s\n", fildes, err, c.pos())
+		}
+		c.fsResult(err)
+		return
+	}
+
 	r, _, err := syscall.Syscall(syscall.SYS_FSYNC, uintptr(fildes), 0, 0)
 	if strace {
 		fmt.Fprintf(os.Stderr, "fsync(%v) %v %v\t; %s\n", fildes, r, err, c.pos())
@@ -87,6 +102,15 @@ func (c *cpu) fsync() {
 func (c *cpu) ftruncate64() {
 	sp, length := popI64(c.sp)
 	fildes := readI32(sp)
+	if f := c.m.fds.get(fildes); f != nil {
+		err := f.Truncate(length)
+		if strace {
+			fmt.Fprintf(os.Stderr, "ftruncate(%#x, %#x) %v\t; %s\n", fildes, length, err, c.pos())
+		}
+		c.fsResult(err)
+		return
+	}
+
 	r, _, err := syscall.Syscall(syscall.SYS_FTRUNCATE, uintptr(fildes), uintptr(length), 0)
 	if strace {
 		fmt.Fprintf(os.Stderr, "ftruncate(%#x, %#x) %v, %v\t; %s\n", fildes, length, r, err, c.pos())
@@ -101,14 +125,21 @@ func (c *cpu) ftruncate64() {
 func (c *cpu) getcwd() {
 	sp, size := popLong(c.sp)
 	buf := readPtr(sp)
-	r, _, err := syscall.Syscall(syscall.SYS_GETCWD, buf, uintptr(size), 0)
+	wd, err := c.m.fs.Getwd()
+	if err == nil && int64(len(wd)) >= size {
+		err = syscall.ERANGE
+	}
 	if strace {
-		fmt.Fprintf(os.Stderr, "getcwd(%#x, %#x) %v %v %q\t; %s\n", buf, size, r, err, GoString(buf), c.pos())
+		fmt.Fprintf(os.Stderr, "getcwd(%#x, %#x) %q %v\t; %s\n", buf, size, wd, err, c.pos())
 	}
-	if err != 0 {
+	if err != nil {
 		c.setErrno(err)
+		writePtr(c.rp, 0)
+		return
 	}
-	writePtr(c.rp, r)
+
+	CopyString(buf, wd, true)
+	writePtr(c.rp, buf)
 }
 
 // uid_t geteuid(void);
@@ -125,6 +156,9 @@ func (c *cpu) gethostname() {
 	sp, maxlen := popLong(c.sp)
 	name := readPtr(sp)
 	nm, err := os.Hostname()
+	if c.m.det != nil {
+		nm, err = c.m.det.hostname, nil
+	}
 	if int64(len(nm))+1 > maxlen {
 		nm = nm[:maxlen-1]
 	}
@@ -144,6 +178,9 @@ func (c *cpu) gethostname() {
 // pid_t getpid(void);
 func (c *cpu) getpid() {
 	r, _, _ := syscall.RawSyscall(syscall.SYS_GETPID, 0, 0, 0)
+	if c.m.det != nil {
+		r = uintptr(c.m.det.pid)
+	}
 	if strace {
 		fmt.Fprintf(os.Stderr, "getpid() %v\t; %s\n", r, c.pos())
 	}
@@ -159,6 +196,12 @@ func (c *cpu) isatty() {
 		return
 	}
 
+	if c.hostFd(fd) != nil {
+		c.setErrno(errno.XENOTTY)
+		writeI32(c.rp, 0)
+		return
+	}
+
 	if fd >= 0 && fd <= 2 { //TODO incorrect fd checking
 		writeI32(c.rp, 1)
 		return
@@ -179,6 +222,19 @@ func (c *cpu) lseek64() {
 	sp, whence := popI32(c.sp)
 	sp, offset := popI64(sp)
 	fildes := readI32(sp)
+	if f := c.m.fds.get(fildes); f != nil {
+		r, err := f.Seek(offset, int(whence))
+		if strace {
+			fmt.Fprintf(os.Stderr, "lseek(%v, %v, %v) %v %v\t; %s\n", fildes, offset, whence, r, err, c.pos())
+		}
+		if err != nil {
+			c.setErrno(err)
+			r = -1
+		}
+		writeLong(c.rp, r)
+		return
+	}
+
 	r, _, err := syscall.Syscall(syscall.SYS_LSEEK, uintptr(fildes), uintptr(offset), uintptr(whence))
 	if strace {
 		fmt.Fprintf(os.Stderr, "lseek(%v, %v, %v) %v %v\t; %s\n", fildes, offset, whence, r, err, c.pos())
@@ -199,10 +255,32 @@ func (c *cpu) pause() { //TODO This is incomplete signal handling.
 }
 
 // ssize_t read(int fd, void *buf, size_t count);
-func (c *cpu) read() { //TODO stdin
+func (c *cpu) read() {
 	sp, count := popLong(c.sp)
 	sp, buf := popPtr(sp)
 	fd := readI32(sp)
+	var rd io.Reader
+	switch f := c.m.fds.get(fd); {
+	case f != nil:
+		rd = f
+	case fd == unistd.XSTDIN_FILENO:
+		rd = c.m.files.reader(c.m.files.stdin, c)
+	}
+	if rd != nil {
+		n, err := rd.Read((*[math.MaxInt32]byte)(memW(buf, int(count)))[:count])
+		if strace {
+			fmt.Fprintf(os.Stderr, "read(%v, %#x, %v) %v %v\t; %s\n", fd, buf, count, n, err, c.pos())
+		}
+		if err != nil && err != io.EOF {
+			c.setErrno(err)
+			writeLong(c.rp, -1)
+			return
+		}
+
+		writeLong(c.rp, int64(n))
+		return
+	}
+
 	r, _, err := syscall.Syscall(syscall.SYS_READ, uintptr(fd), buf, uintptr(count))
 	if strace {
 		fmt.Fprintf(os.Stderr, "read(%v, %#x, %v) %v %v\t; %s\n", fd, buf, count, r, err, c.pos())
@@ -213,6 +291,48 @@ func (c *cpu) read() { //TODO stdin
 	writeLong(c.rp, int64(r))
 }
 
+// ssize_t readlink(const char *path, char *buf, size_t bufsiz);
+func (c *cpu) readlink() {
+	sp, bufsiz := popLong(c.sp)
+	sp, buf := popPtr(sp)
+	path := readPtr(sp)
+	s, err := c.m.fs.Readlink(GoString(path))
+	if strace {
+		fmt.Fprintf(os.Stderr, "readlink(%q, %#x, %v) %q %v\t; %s\n", GoString(path), buf, bufsiz, s, err, c.pos())
+	}
+	if err != nil {
+		c.setErrno(err)
+		writeLong(c.rp, -1)
+		return
+	}
+
+	if int64(len(s)) > bufsiz {
+		s = s[:bufsiz]
+	}
+	CopyString(buf, s, false)
+	writeLong(c.rp, int64(len(s)))
+}
+
+// int rmdir(const char *path);
+func (c *cpu) rmdir() {
+	path := readPtr(c.sp)
+	err := c.remove(GoString(path), true)
+	if strace {
+		fmt.Fprintf(os.Stderr, "rmdir(%q) %v\t; %s\n", GoString(path), err, c.pos())
+	}
+	c.fsResult(err)
+}
+
+// unsigned sleep(unsigned seconds);
+func (c *cpu) sleep() {
+	seconds := readU32(c.sp)
+	c.sleepFor(tim.Duration(seconds) * tim.Second)
+	if strace {
+		fmt.Fprintf(os.Stderr, "sleep(%v)\t; %s\n", seconds, c.pos())
+	}
+	writeU32(c.rp, 0)
+}
+
 // long sysconf(int name);
 func (c *cpu) sysconf() {
 	switch n := readI32(c.sp); n {
@@ -226,14 +346,27 @@ func (c *cpu) sysconf() {
 // int unlink(const char *path);
 func (c *cpu) unlink() {
 	path := readPtr(c.sp)
-	r, _, err := syscall.Syscall(syscall.SYS_UNLINK, path, 0, 0)
+	err := c.remove(GoString(path), false)
 	if strace {
-		fmt.Fprintf(os.Stderr, "unlink(%q) %v %v\t; %s\n", GoString(path), r, err, c.pos())
+		fmt.Fprintf(os.Stderr, "unlink(%q) %v\t; %s\n", GoString(path), err, c.pos())
 	}
-	if err != 0 {
-		c.setErrno(err)
+	c.fsResult(err)
+}
+
+// remove removes the directory name, if dir is true, or the file name
+// otherwise.
+func (c *cpu) remove(name string, dir bool) error {
+	fi, err := c.m.fs.Lstat(name)
+	switch {
+	case err != nil:
+		return err
+	case dir && !fi.IsDir():
+		return syscall.ENOTDIR
+	case !dir && fi.IsDir():
+		return syscall.EISDIR
 	}
-	writeI32(c.rp, int32(r))
+
+	return c.m.fs.Remove(name)
 }
 
 // ssize_t write(int fd, const void *buf, size_t count);
@@ -241,16 +374,31 @@ func (c *cpu) write() {
 	sp, count := popLong(c.sp)
 	sp, buf := popPtr(sp)
 	fd := readI32(sp)
+	if f := c.m.fds.get(fd); f != nil {
+		n, err := f.Write((*[math.MaxInt32]byte)(memR(buf, int(count)))[:count])
+		if strace {
+			fmt.Fprintf(os.Stderr, "write(%v, %#x, %v) %v %v\t; %s\n", fd, buf, count, n, err, c.pos())
+		}
+		if err != nil {
+			c.setErrno(err)
+			writeLong(c.rp, -1)
+			return
+		}
+
+		writeLong(c.rp, int64(n))
+		return
+	}
+
 	switch fd {
 	case unistd.XSTDOUT_FILENO:
-		n, err := c.m.stdout.Write((*[math.MaxInt32]byte)(unsafe.Pointer(buf))[:count])
+		n, err := c.m.stdout.Write((*[math.MaxInt32]byte)(memR(buf, int(count)))[:count])
 		if err != nil {
 			c.thread.setErrno(err)
 		}
 		writeLong(c.rp, int64(n))
 		return
 	case unistd.XSTDERR_FILENO:
-		n, err := c.m.stderr.Write((*[math.MaxInt32]byte)(unsafe.Pointer(buf))[:count])
+		n, err := c.m.stderr.Write((*[math.MaxInt32]byte)(memR(buf, int(count)))[:count])
 		if err != nil {
 			c.thread.setErrno(err)
 		}
@@ -270,7 +418,7 @@ func (c *cpu) write() {
 // int usleep(useconds_t usec);
 func (c *cpu) usleep() {
 	usec := readU32(c.sp)
-	tim.Sleep(tim.Duration(usec) * tim.Microsecond)
+	c.sleepFor(tim.Duration(usec) * tim.Microsecond)
 	if strace {
 		fmt.Fprintf(os.Stderr, "usleep(%#x)", usec)
 	}
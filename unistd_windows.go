@@ -71,6 +71,9 @@ func (c *cpu) read() {
 	writeLong(c.rp, int64(r))
 }
 
+// unsigned sleep(unsigned seconds);
+func (c *cpu) sleep() { panic("unreachable") }
+
 // long sysconf(int name);
 func (c *cpu) sysconf() { panic("unreachable") }
 
@@ -83,7 +86,7 @@ func (c *cpu) write() { panic("unreachable") }
 // int usleep(useconds_t usec);
 func (c *cpu) usleep() {
 	usec := readU32(c.sp)
-	tim.Sleep(tim.Duration(usec) * tim.Microsecond)
+	c.sleepFor(tim.Duration(usec) * tim.Microsecond)
 	if strace {
 		fmt.Fprintf(os.Stderr, "usleep(%#x)", usec)
 	}
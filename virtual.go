@@ -14,9 +14,11 @@
 package virtual
 
 import (
+	"context"
 	"fmt"
 	"io"
 
+	"github.com/cznic/ir"
 	"github.com/cznic/xc"
 )
 
@@ -31,10 +33,45 @@ var (
 type Option func(*options) error
 
 type options struct {
+	coverage            *Coverage
+	debugger            *Debugger
+	det                 *determinism
+	fs                  FileSystem
+	fuel                int64 // Negative: not metered.
+	host                map[ir.NameID]HostFunction
 	profileFunctions    bool
 	profileInstructions bool
 	profileLines        bool
 	profileRate         int
+	profileStacks       bool
+	sandbox             *sandbox
+	trackAllocations    bool
+	trackAllocationsW   io.Writer
+}
+
+// Debug attaches d to the machine.
+func Debug(d *Debugger) Option {
+	return func(o *options) error {
+		o.debugger = d
+		return nil
+	}
+}
+
+// Fuel limits the number of instructions executed by all threads of the
+// machine to n. A machine which runs out of fuel stops with OutOfFuelError.
+// The fuel is checked every 1024 instructions, so a thread can overrun the
+// limit by less than 1024 instructions before it stops, but every executed
+// instruction is charged. The remaining fuel can be inspected and refilled
+// using the Machine's Fuel and SetFuel methods.
+func Fuel(n int64) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("Fuel: invalid value %v", n)
+		}
+
+		o.fuel = n
+		return nil
+	}
 }
 
 // ProfileFunctions turns profiling of functions on.
@@ -61,6 +98,15 @@ func ProfileInstructions() Option {
 	}
 }
 
+// ProfileStacks turns profiling of call stacks on. The collected samples can
+// be written in the pprof format using Machine.WritePprof.
+func ProfileStacks() Option {
+	return func(o *options) error {
+		o.profileStacks = true
+		return nil
+	}
+}
+
 // ProfileRate set the profilig rate.
 func ProfileRate(rate int) Option {
 	return func(o *options) error {
@@ -69,6 +115,20 @@ func ProfileRate(rate int) Option {
 	}
 }
 
+// TrackAllocations turns on tracking of the heap blocks allocated by the
+// program. Freed blocks are poisoned and invalid frees are reported as errors.
+// Blocks allocated by the machine itself, for example strings passed to the
+// program, may be freed by the program but are not reported as leaks. Double
+// frees are detected for the most recently freed blocks only. If w is not nil, blocks not freed when the machine is closed are reported to
+// w together with their allocation sites. See also Machine.Leaks.
+func TrackAllocations(w io.Writer) Option {
+	return func(o *options) error {
+		o.trackAllocations = true
+		o.trackAllocationsW = w
+		return nil
+	}
+}
+
 // New runs the program in b and returns its exit status or an error, if any.
 // It's the caller responsibility to ensure the binary was produced for the
 // correct architecture and platform.
@@ -81,7 +141,17 @@ func ProfileRate(rate int) Option {
 // external functions. Its Close method must be called eventually to free any
 // resources it has acquired from the OS.
 func New(b *Binary, args []string, stdin io.Reader, stdout, stderr io.Writer, heapSize, stackSize int, tracePath string, opts ...Option) (m *Machine, exitStatus int, err error) {
-	var o options
+	return NewContext(context.Background(), b, args, stdin, stdout, stderr, heapSize, stackSize, tracePath, opts...)
+}
+
+// NewContext is like New, but the program stops with ContextError when ctx is
+// done.
+func NewContext(ctx context.Context, b *Binary, args []string, stdin io.Reader, stdout, stderr io.Writer, heapSize, stackSize int, tracePath string, opts ...Option) (m *Machine, exitStatus int, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, -1, ContextError{err}
+	}
+
+	o := options{fuel: -1}
 	for _, opt := range opts {
 		if err := opt(&o); err != nil {
 			return nil, -1, err
@@ -97,16 +167,7 @@ func New(b *Binary, args []string, stdin io.Reader, stdout, stderr io.Writer, he
 		return nil, -1, err
 	}
 
-	if o.profileFunctions {
-		m.ProfileFunctions = map[PCInfo]int{}
-	}
-	if o.profileLines {
-		m.ProfileLines = map[PCInfo]int{}
-	}
-	if o.profileInstructions {
-		m.ProfileInstructions = map[Opcode]int{}
-	}
-	m.ProfileRate = o.profileRate
+	m.setOptions(&o)
 
 	t, err := m.NewThread(stackSize)
 	if err != nil {
@@ -122,6 +183,9 @@ func New(b *Binary, args []string, stdin io.Reader, stdout, stderr io.Writer, he
 		writePtr(pargv+uintptr(i*ptrSize), v)
 	}
 
+	restore := t.setContext(ctx)
+	defer restore()
+
 	// void _start(int args, char **argv);
 	t.rp = t.sp
 	t.sp -= i32StackSz
@@ -134,14 +198,56 @@ func New(b *Binary, args []string, stdin io.Reader, stdout, stderr io.Writer, he
 		return nil, exitStatus, err
 	}
 
+	// Returning from _start is equivalent to calling exit.
+	if exitStatus, err = t.exit(exitStatus); err != nil {
+		return nil, exitStatus, err
+	}
+
 	return m, exitStatus, nil
 }
 
+// setOptions configures m according to o.
+func (m *Machine) setOptions(o *options) {
+	if o.profileFunctions {
+		m.ProfileFunctions = map[PCInfo]int{}
+	}
+	if o.profileLines {
+		m.ProfileLines = map[PCInfo]int{}
+	}
+	if o.profileInstructions {
+		m.ProfileInstructions = map[Opcode]int{}
+	}
+	if o.profileStacks {
+		m.profileStacks = map[string]int{}
+	}
+	m.ProfileRate = o.profileRate
+	if o.trackAllocations {
+		m.allocs = newAllocTracker(o.trackAllocationsW)
+	}
+	if o.coverage != nil {
+		m.setCover(o.coverage)
+	}
+	m.debugger = o.debugger
+	m.det = o.det
+	m.host = o.host
+	m.fuel = o.fuel
+	m.sandbox = o.sandbox
+	if o.fs != nil {
+		m.fs = o.fs
+	}
+}
+
 // Exec is a convenience wrapper around New. It takes care of calling the
 // Close method of the Machine returned by New.
 func Exec(b *Binary, args []string, stdin io.Reader, stdout, stderr io.Writer, heapSize, stackSize int, tracePath string, opts ...Option) (exitStatus int, err error) {
+	return ExecContext(context.Background(), b, args, stdin, stdout, stderr, heapSize, stackSize, tracePath, opts...)
+}
+
+// ExecContext is like Exec, but the program stops with ContextError when ctx is
+// done.
+func ExecContext(ctx context.Context, b *Binary, args []string, stdin io.Reader, stdout, stderr io.Writer, heapSize, stackSize int, tracePath string, opts ...Option) (exitStatus int, err error) {
 	var m *Machine
-	m, exitStatus, err = New(b, args, stdin, stdout, stderr, heapSize, stackSize, tracePath, opts...)
+	m, exitStatus, err = NewContext(ctx, b, args, stdin, stdout, stderr, heapSize, stackSize, tracePath, opts...)
 	if m != nil {
 		if e := m.Close(); e != nil && err == nil {
 			err = e